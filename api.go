@@ -1,5 +1,10 @@
 package pgit
 
+import (
+	"os"
+	"time"
+)
+
 // Pgit is an instance of Pgit that is bound to a specific schema
 // directory where the database schema is located and a particular
 // database connection.
@@ -8,22 +13,333 @@ type Pgit struct {
 	schema *schemaDirectory
 }
 
+// Option configures optional behavior of a Pgit instance
+type Option func(p *Pgit)
+
+// Environment sets the name of the environment being migrated, such as "dev"
+// or "prod". Files that are restricted to other environments are skipped.
+func Environment(name string) Option {
+	return func(p *Pgit) {
+		p.schema.environment = name
+	}
+}
+
+// Variables sets the values used to fill in the {{ .Name }} placeholders in
+// changeset and definition files. Using a placeholder without a value is an
+// error.
+func Variables(variables map[string]string) Option {
+	return func(p *Pgit) {
+		p.schema.variables = variables
+	}
+}
+
+// Hook registers a function to run at the given phase of every migration or
+// rollback. Returning an error stops the migration or rollback; changes that
+// were already committed are not undone.
+func Hook(phase HookPhase, hook func(event HookEvent) error) Option {
+	return func(p *Pgit) {
+		if p.schema.hooks == nil {
+			p.schema.hooks = make(map[HookPhase][]func(HookEvent) error)
+		}
+		p.schema.hooks[phase] = append(p.schema.hooks[phase], hook)
+	}
+}
+
+// AllowDestructive approves running SQL that destroys data, such as DROP
+// TABLE or DROP COLUMN, in any file. Without it a migration or rollback that
+// would run such SQL returns a *DestructiveError before changing anything,
+// unless every destructive change is annotated with -- change destructive.
+func AllowDestructive() Option {
+	return func(p *Pgit) {
+		p.schema.allowDestructive = true
+	}
+}
+
+// LintRules adds rules to those run by Lint
+func LintRules(rules ...LintRule) Option {
+	return func(p *Pgit) {
+		p.schema.lintRules = append(p.schema.lintRules, rules...)
+	}
+}
+
+// LintSeverity overrides the severity of lint rules by name. Rules set to
+// SeverityOff are not run.
+func LintSeverity(severities map[string]Severity) Option {
+	return func(p *Pgit) {
+		p.schema.lintSeverities = severities
+	}
+}
+
+// Observe sends the events of every migration and rollback to the observer.
+// Without it only warnings and failures are printed, to standard output.
+func Observe(observer Observer) Option {
+	return func(p *Pgit) {
+		p.schema.observer = observer
+	}
+}
+
+// VersionTable sets the name of the version table Import reads the applied
+// migrations from, such as a schema qualified name, when the migration tool
+// was configured to use a table other than its default
+func VersionTable(name string) Option {
+	return func(p *Pgit) {
+		p.schema.versionTable = name
+	}
+}
+
+// PlannedStep is SQL that applying the latest version of the schema would run
+// for a file, rendered with the values of any variables
+type PlannedStep struct {
+	Path          string
+	FromVersion   string
+	ToVersion     string
+	SQL           string
+	NoTransaction bool
+
+	// Destructive lists the operations in SQL that destroy data, such as
+	// DROP TABLE, and were not approved. ApplyLatest refuses to run them
+	// without the AllowDestructive option.
+	Destructive []string
+}
+
+// States of the items reported by Status
+const (
+	StateApplied = "applied"
+	StatePending = "pending"
+	StateSkipped = "skipped"
+)
+
+// StatusItem is the state of a file, or of a single change in a changeset
+// file, compared with the database. Change is empty for other types of
+// files.
+type StatusItem struct {
+	Path   string
+	Change string
+	State  string
+
+	// Destructive lists the operations that destroy data, such as DROP
+	// TABLE, in a pending item that were not approved
+	Destructive []string
+}
+
+// MigrationRecord is a migration recorded in the database along with the
+// versions of the files it applied. StartedAt and FinishedAt are zero for
+// migrations recorded before pgit tracked them, and FinishedAt is also zero
+// for a migration that did not finish.
+type MigrationRecord struct {
+	ID         int
+	Completed  bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Files      []FileVersion
+}
+
+// FileVersion is the version of a file applied by a migration
+type FileVersion struct {
+	Path    string
+	Version string
+}
+
 // New initializes and returns a new Pgit instance
-func New(rootPath string, db DatabaseConnection) (*Pgit, error) {
+func New(rootPath string, db DatabaseConnection, options ...Option) (*Pgit, error) {
 	schema, err := newSchemaDirectory(rootPath)
 	if err != nil {
 		return nil, err
 	}
-	return &Pgit{db: db, schema: schema}, nil
+	schema.observer = warningObserver{next: NewTextObserver(os.Stdout)}
+	p := &Pgit{db: db, schema: schema}
+	for _, option := range options {
+		option(p)
+	}
+	return p, nil
 }
 
 // ApplyLatest ensures the latest version of the schema has been applied
 // to the database, and if not applies it.
 func (p *Pgit) ApplyLatest() error {
-	return p.schema.applyLatest(p.db)
+	return p.withLock(func() error {
+		return p.schema.applyLatest(p.db)
+	})
+}
+
+// Plan returns the SQL that ApplyLatest would run, without changing the
+// database
+func (p *Pgit) Plan() ([]PlannedStep, error) {
+	return p.schema.plan(p.db)
+}
+
+// Status reports which files and changes have been applied, which are pending
+// and which are skipped for the current environment
+func (p *Pgit) Status() ([]StatusItem, error) {
+	return p.schema.status(p.db)
+}
+
+// History returns the migrations recorded in the database, oldest first. The
+// database is not changed, so the connection may be read-only.
+func (p *Pgit) History() ([]MigrationRecord, error) {
+	return p.db.readHistory()
+}
+
+// Baseline adopts a database whose schema was created without pgit by
+// recording the current version of every file as applied in a new migration,
+// without running any SQL. Overrides map the path of a file, relative to the
+// root of the git repository, to the version to record instead: the number of
+// changesets applied for a changeset file, a commit for a definition, view or
+// grants file, or an empty string to leave the file to the next migration.
+func (p *Pgit) Baseline(overrides map[string]string) error {
+	return p.withLock(func() error {
+		return p.schema.baseline(p.db, overrides)
+	})
 }
 
 // Rollback rolls back the last migration that was applied
 func (p *Pgit) Rollback() error {
-	return p.schema.rollback(p.db)
+	return p.withLock(func() error {
+		return p.schema.rollback(p.db)
+	})
+}
+
+// withLock runs f while holding the connection's lock, if it has one
+func (p *Pgit) withLock(f func() error) error {
+	l, ok := p.db.(locker)
+
+	if !ok {
+		return f()
+	}
+
+	unlock, err := l.lock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := f(); err != nil {
+		unlock()
+		return err
+	}
+
+	return unlock()
+}
+
+// VerifyRollbacks applies every pending changeset, and every revision of the
+// definition files, one at a time, rolling each back and applying it again to
+// check that the rollback restores the database catalog. Hooks are not run and
+// destructive changes are not refused, so the Pgit instance must be connected
+// to a scratch database.
+func (p *Pgit) VerifyRollbacks() ([]RollbackVerification, error) {
+	var results []RollbackVerification
+	err := p.withLock(func() error {
+		var err error
+		results, err = p.schema.verifyRollbacks(p.db)
+		return err
+	})
+	return results, err
+}
+
+// Drift migrates the shadow database, which must be empty, to the latest
+// version of the schema and returns the differences between its catalog and
+// the catalog of the database, such as changes made to it by hand. Hooks
+// registered with the Hook option are not run on the shadow database.
+func (p *Pgit) Drift(shadow DatabaseConnection) (*SchemaDrift, error) {
+	return p.schema.drift(p.db, shadow)
+}
+
+// Squash replaces the first through changesets of the changeset file at path,
+// relative to the root of the git repository, with a single changeset that
+// creates the objects they leave behind. Databases that already applied them
+// record the squashed changeset in their place on their next migration. The
+// Pgit instance must be connected to an empty scratch database, which is
+// migrated to read the objects from its catalog.
+func (p *Pgit) Squash(path string, through int) error {
+	return p.withLock(func() error {
+		return p.schema.squash(p.db, path, through)
+	})
+}
+
+// NewFile creates a schema file of the given type, such as changeset or
+// definition, at path relative to the schema root and returns its full path.
+// The file only holds the header and the blocks its type needs.
+func (p *Pgit) NewFile(fileType, path string) (string, error) {
+	return p.schema.createFile(fileType, path)
+}
+
+// NewChange appends an empty change to the changeset file at path, relative
+// to the schema root, and returns its full path
+func (p *Pgit) NewChange(path string) (string, error) {
+	return p.schema.addChange(path)
+}
+
+// ImportDefinitions writes a file for every function, procedure and view in
+// the given schema of the database, under <schema>/functions and
+// <schema>/views in the schema root, and returns their paths relative to the
+// schema root. Functions are written as definition files whose rollback drops
+// them, and views as view files.
+func (p *Pgit) ImportDefinitions(schema string) ([]string, error) {
+	return p.schema.importDefinitions(p.db, schema)
+}
+
+// Import converts the migrations of another tool in each of the directories
+// into a changeset file named after the directory in the schema root, with a
+// change for each migration, and returns their paths relative to the schema
+// root. When the Pgit instance has a database the migrations that the version
+// table of the tool records as applied are recorded as applied before the
+// files are written, so that they do not run again. Rolling back the migration
+// that records them only removes the recorded versions.
+func (p *Pgit) Import(tool MigrationTool, dirs ...string) ([]string, error) {
+	var paths []string
+	err := p.withLock(func() error {
+		var err error
+		paths, err = p.schema.importMigrations(p.db, tool, dirs)
+		return err
+	})
+	return paths, err
+}
+
+// ExportScript returns a psql script that a DBA can run by hand to apply
+// everything pending in the database, including the statements that record
+// the new versions in the migration state tables named after tableName (pgit
+// when empty). The state of the database is read without changing it, so the
+// connection may be read-only. An empty script is returned when there is
+// nothing to apply.
+func (p *Pgit) ExportScript(tableName string) (string, error) {
+	state, err := p.db.readRecordedState()
+	if err != nil {
+		return "", err
+	}
+	return p.schema.exportScript(p.db, state, tableName)
+}
+
+// ExportScriptFromState is like ExportScript for a database that cannot be
+// reached, whose files are at the given versions, keyed by their path
+// relative to the root of the git repository. Files that read the database
+// catalog, such as grants files, cannot be exported without the database.
+func (p *Pgit) ExportScriptFromState(tableName string, versions map[string]string) (string, error) {
+	state := newMigrationState()
+	for path, version := range versions {
+		state.fileStates[path] = &fileMigrationState{path: path, version: version}
+	}
+	return p.schema.exportScript(nil, state, tableName)
+}
+
+// Test runs the assertions in the test files of the schema directory against
+// the database and returns the result of each one. Nothing done by the tests
+// is committed to the database. Setup statements, which have no expectation,
+// only appear in the results when they fail.
+func (p *Pgit) Test() ([]TestResult, error) {
+	return p.schema.runTests(p.db)
+}
+
+// Lint checks the changesets and definitions that are pending in the
+// database for operations that are hazardous to run against a live database,
+// such as building an index without CONCURRENTLY. When the Pgit instance has
+// no database connection every changeset and definition is checked.
+func (p *Pgit) Lint() ([]LintFinding, error) {
+	return p.schema.lint(p.db)
+}
+
+// Validate parses every file in the schema directory without connecting to
+// the database. If any file is invalid a ParseErrors is returned describing
+// all of the problems found.
+func (p *Pgit) Validate() error {
+	return p.schema.validate()
 }
@@ -0,0 +1,166 @@
+package pgit
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// baseline records the current version of every file as applied in a new
+// migration without running any SQL, so that pgit can adopt a database whose
+// schema was created without it. Rolling the migration back only removes it.
+// Overrides map the path of a file to the version to record for it instead:
+// the number of changesets applied for a changeset file, a commit for a
+// definition, view or grants file, or an empty string to leave the file to
+// the next migration.
+func (s *schemaDirectory) baseline(db DatabaseConnection, overrides map[string]string) error {
+	if err := s.readFromDisk(); err != nil {
+		return errors.Wrap(err, "failed to populate schema from disk")
+	}
+
+	if err := s.readMigrationState(db); err != nil {
+		return errors.Wrap(err, "failed to read migration state")
+	}
+
+	if len(s.state.fileStates) > 0 {
+		return errors.New("the database has already been migrated, a baseline can only be recorded for a database pgit has not migrated")
+	}
+
+	for path := range overrides {
+		if _, ok := s.files[path]; !ok {
+			return errors.Errorf("unable to override the baseline of %v, there is no such schema file", path)
+		}
+	}
+
+	s.useDatabase(db)
+
+	versions := make([]FileVersion, 0, len(s.files))
+
+	for _, filePath := range s.sortedPaths() {
+		file := s.files[filePath]
+
+		version, ok := "", false
+		override, overridden := overrides[filePath]
+
+		if overridden && override == "" {
+			s.notify(Event{Type: FileSkipped, Path: filePath, Message: "left to the next migration by the baseline"})
+			continue
+		}
+
+		if overridden {
+			v, err := baselineVersion(file, override)
+			if err != nil {
+				return errors.Wrapf(err, "invalid baseline version for %v", filePath)
+			}
+			version, ok = v, true
+		} else {
+			steps, err := getApplySteps(file, "")
+			if err != nil {
+				return errors.Wrapf(err, "unable to determine the version of %v", filePath)
+			}
+			if len(steps) > 0 {
+				version, ok = steps[len(steps)-1].version, true
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		if versionCommit(version) == uncommittedVersion {
+			return errors.Errorf("%v has uncommitted changes, commit them before recording a baseline", filePath)
+		}
+
+		versions = append(versions, FileVersion{Path: filePath, Version: version})
+	}
+
+	if len(versions) == 0 {
+		return nil
+	}
+
+	migration, err := db.createAdoptedMigration()
+
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	s.notify(Event{Type: MigrationStarted, MigrationID: migration.id})
+
+	for _, v := range versions {
+		fileState := &fileMigrationState{path: v.Path}
+		s.state.fileStates[v.Path] = fileState
+
+		event := Event{MigrationID: migration.id, Path: v.Path, ToVersion: v.Version}
+
+		if err := db.applyAndUpdateStateForFile(fileState, "", v.Version, migration); err != nil {
+			event.Type, event.Message, event.Err = FileFailed, "unable to record the baseline of file", err
+			s.notify(event)
+			return errors.Wrapf(err, "unable to record the baseline of %v", v.Path)
+		}
+
+		fileState.version = v.Version
+		event.Type = FileApplied
+		s.notify(event)
+	}
+
+	if err := db.finishMigration(migration); err != nil {
+		return err
+	}
+
+	s.notify(Event{Type: MigrationFinished, MigrationID: migration.id, Duration: time.Since(started)})
+
+	return nil
+}
+
+// baselineVersion returns the version recorded for a file by an override of
+// its baseline
+func baselineVersion(file schemaFile, override string) (string, error) {
+	switch f := file.(type) {
+	case *changesetFile:
+		n, err := strconv.Atoi(override)
+		if err != nil {
+			// a version as it is recorded, such as create_users,add_email
+			if _, err := f.applied(override); err != nil {
+				return "", err
+			}
+			return override, nil
+		}
+		if n < 0 || n > len(f.changesets) {
+			return "", errors.Errorf("the file has %v changesets, got %v", len(f.changesets), n)
+		}
+		return f.version(n), nil
+	case *definitionFile:
+		return f.commitVersion(override)
+	case *viewFile:
+		return f.commitVersion(override)
+	case *grantsFile:
+		return f.commitVersion(override)
+	}
+
+	return override, nil
+}
+
+// commitVersion returns the version of the file at the commit, which may be
+// abbreviated
+func (d *definitionFile) commitVersion(commit string) (string, error) {
+	commits, err := d.getFileCommits()
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, c := range commits {
+		if strings.HasPrefix(c, commit) {
+			content, err := d.getFileAtCommit(c)
+			if err != nil {
+				return "", err
+			}
+			return d.fileVersion(c, withoutHeader(content))
+		}
+	}
+
+	return "", errors.Errorf("commit %v did not change the file", commit)
+}
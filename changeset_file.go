@@ -1,6 +1,10 @@
 package pgit
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -22,57 +26,603 @@ type changesetFile struct {
 
 // changeset contains the SQL for applying and rolling back a changeset
 type changeset struct {
+	id          string
 	applySQL    string
 	rollbackSQL string
+
+	// noTransaction changesets are executed outside of a transaction, for
+	// statements such as CREATE INDEX CONCURRENTLY
+	noTransaction bool
+	// runAlways changesets are executed again on every migration
+	runAlways bool
+	// runOnChange changesets are executed again whenever their SQL changes
+	runOnChange bool
+	// environments restricts the changeset to some environments, such as
+	// "dev,staging" or "!prod"
+	environments string
+	// skipped changesets are filtered out for the current environment. They
+	// are recorded in the migration state without being executed.
+	skipped bool
+	// destructive changesets are approved to run SQL that destroys data,
+	// both when they are applied and when they are rolled back
+	destructive bool
+	// squashes holds the keys, encoded as a version, of the changesets that
+	// the first changeset of a file replaced when they were squashed
+	squashes string
+
+	// applyLine and rollbackLine are the lines of the file on which the
+	// apply and rollback SQL begin
+	applyLine    int
+	rollbackLine int
+}
+
+// unapprovedOperations returns the destructive operations in the apply SQL of
+// a changeset that is not annotated as destructive
+func (cs *changeset) unapprovedOperations() ([]string, error) {
+	if cs.destructive {
+		return nil, nil
+	}
+	return destructiveOperations(cs.applySQL)
+}
+
+// hash returns a short digest of the changeset's apply SQL which is recorded
+// in the migration state for runOnChange changesets
+func (cs *changeset) hash() string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(cs.applySQL)))
+	return hex.EncodeToString(sum[:])[:12]
 }
 
+// skippedMarker follows the key of a changeset that was skipped for the
+// current environment in a changeset version
+const skippedMarker = "!"
+
+// changesetIDRegexp matches valid changeset IDs. IDs may not begin with a
+// digit so that they can never be confused with a legacy numeric version.
+var changesetIDRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
 func (c *changesetFile) getPath() string {
 	return c.path
 }
 
-func (c *changesetFile) getApplySQL(currentVersion string) (string, string, error) {
-	applySQL := ""
-	currentVersionNum, err := strconv.ParseUint(currentVersion, 10, 64)
+// key returns the name recorded in the migration state for the changeset at
+// index i, which is its ID or its 1-based position if it has no ID.
+func (c *changesetFile) key(i int) string {
+	if c.changesets[i].id != "" {
+		return c.changesets[i].id
+	}
+	return strconv.Itoa(i + 1)
+}
+
+// entry returns the value recorded in the migration state once the
+// changeset at index i has been applied. runOnChange changesets also record
+// the hash of their SQL as "key@hash", and skipped changesets are recorded as
+// "key!".
+func (c *changesetFile) entry(i int) string {
+	if c.changesets[i].skipped {
+		return c.key(i) + skippedMarker
+	}
+	if c.changesets[i].runOnChange {
+		return c.key(i) + "@" + c.changesets[i].hash()
+	}
+	return c.key(i)
+}
+
+// version returns the version of the file once the first n changesets have
+// been applied.
+func (c *changesetFile) version(n int) string {
+	entries := make([]string, n)
+	for i := 0; i < n; i++ {
+		entries[i] = c.entry(i)
+	}
+	return encodeChangesetVersion(entries)
+}
+
+// encodeChangesetVersion returns the version for a list of applied entries.
+// Files with only unnamed changesets use the number of applied changesets as
+// their version, otherwise the version is the comma separated list of
+// entries.
+func encodeChangesetVersion(entries []string) string {
+	for i, e := range entries {
+		if e != strconv.Itoa(i+1) {
+			return strings.Join(entries, ",")
+		}
+	}
+	return strconv.Itoa(len(entries))
+}
+
+// applied returns the entries recorded for the changesets that have been
+// applied when the file is at the given version. It returns an error if
+// changesets that have already been applied were removed, reordered or had
+// new changesets inserted before them.
+func (c *changesetFile) applied(currentVersion string) ([]string, error) {
+	if currentVersion == "" {
+		return []string{}, nil
+	}
+
+	currentVersion, err := c.unsquash(currentVersion)
 
 	if err != nil {
-		if currentVersion == "" {
-			currentVersionNum = 0
+		return nil, err
+	}
+
+	if n, err := strconv.ParseUint(currentVersion, 10, 64); err == nil {
+		if n > uint64(len(c.changesets)) {
+			return nil, errors.New("no changesets defined to reach specified version")
+		}
+		entries := make([]string, n)
+		for i := range entries {
+			entries[i] = c.key(i)
+		}
+		return entries, nil
+	}
+
+	applied := strings.Split(currentVersion, ",")
+	isApplied := make(map[string]bool)
+	for _, entry := range applied {
+		isApplied[entryKey(entry)] = true
+	}
+
+	for i, entry := range applied {
+		key := entryKey(entry)
+		position := -1
+		for j := range c.changesets {
+			if c.key(j) == key {
+				position = j
+				break
+			}
+		}
+
+		switch {
+		case position == -1:
+			return nil, errors.Errorf("already applied change %v was removed from the file", key)
+		case position == i:
+			continue
+		case position > i && !isApplied[c.key(i)]:
+			return nil, errors.Errorf("change %v was inserted before already applied change %v", c.key(i), key)
+		default:
+			return nil, errors.Errorf("already applied change %v was moved from position %v to %v", key, i+1, position+1)
+		}
+	}
+
+	return applied, nil
+}
+
+// unsquash returns the version of the file for a version recorded before its
+// first changesets were squashed, with the entries of the squashed changesets
+// replaced by the squashing changeset. Other versions are returned as they
+// are.
+func (c *changesetFile) unsquash(currentVersion string) (string, error) {
+	if len(c.changesets) == 0 || c.changesets[0].squashes == "" {
+		return currentVersion, nil
+	}
+
+	entries, squashed := decodeChangesetVersion(currentVersion), decodeChangesetVersion(c.changesets[0].squashes)
+
+	if len(entries) == 0 || entryKey(entries[0]) == c.key(0) {
+		return currentVersion, nil
+	}
+
+	for i := 0; i < len(entries) && i < len(squashed); i++ {
+		if entryKey(entries[i]) != squashed[i] {
+			return currentVersion, nil
+		}
+	}
+
+	if len(entries) < len(squashed) {
+		return "", errors.Errorf(
+			"only %v of the %v changes squashed into %v were applied, apply the rest with the file from before they were squashed",
+			len(entries), len(squashed), c.key(0),
+		)
+	}
+
+	unsquashed := []string{c.entry(0)}
+	for i, entry := range entries[len(squashed):] {
+		if i+1 >= len(c.changesets) {
+			return "", errors.Errorf("already applied change %v was removed from the file", entryKey(entry))
+		}
+		// unnamed changesets after the squashed ones move to new positions
+		unsquashed = append(unsquashed, c.key(i+1)+entry[len(entryKey(entry)):])
+	}
+
+	return encodeChangesetVersion(unsquashed), nil
+}
+
+// decodeChangesetVersion returns the entries of a version returned by
+// encodeChangesetVersion
+func decodeChangesetVersion(version string) []string {
+	if version == "" {
+		return []string{}
+	}
+	if n, err := strconv.Atoi(version); err == nil {
+		entries := make([]string, 0, n)
+		for i := 1; i <= n; i++ {
+			entries = append(entries, strconv.Itoa(i))
+		}
+		return entries
+	}
+	return strings.Split(version, ",")
+}
+
+// entryKey returns the changeset key of an entry in a changeset version
+func entryKey(entry string) string {
+	if i := strings.Index(entry, "@"); i != -1 {
+		return entry[:i]
+	}
+	return strings.TrimSuffix(entry, skippedMarker)
+}
+
+// entrySkipped reports whether an entry in a changeset version was skipped
+// rather than executed
+func entrySkipped(entry string) bool {
+	return strings.HasSuffix(entry, skippedMarker)
+}
+
+// getApplySteps returns the steps needed to bring the file up to date from
+// the given version. Consecutive changesets are applied together in a single
+// transaction, while each noTransaction changeset gets a step of its own.
+// Steps that only re-run runAlways changesets leave the version unchanged.
+// Changesets skipped for the current environment are recorded without being
+// executed, and are executed later if they are no longer skipped.
+func (c *changesetFile) getApplySteps(currentVersion string) ([]applyStep, error) {
+	return c.applySteps(currentVersion, false)
+}
+
+// getChangeSteps returns the steps needed to bring the file up to date from
+// the given version with a step of its own for every changeset, so that each
+// can be rolled back separately
+func (c *changesetFile) getChangeSteps(currentVersion string) ([]applyStep, error) {
+	return c.applySteps(currentVersion, true)
+}
+
+// applySteps returns the steps for getApplySteps, or for getChangeSteps when
+// perChange is true
+func (c *changesetFile) applySteps(currentVersion string, perChange bool) ([]applyStep, error) {
+	applied, err := c.applied(currentVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	run := make([]int, 0)
+	for i, entry := range applied {
+		cs := c.changesets[i]
+		if !cs.skipped && c.needsRun(i, entry) {
+			run = append(run, i)
+		}
+	}
+	for i := len(applied); i < len(c.changesets); i++ {
+		run = append(run, i)
+	}
+
+	steps := make([]applyStep, 0)
+
+	if len(run) == 0 {
+		// the version may still change if the recorded state predates
+		// changeset IDs, in which case it is migrated without running SQL
+		state := make([]string, len(applied))
+		for i, entry := range applied {
+			state[i] = entry
+			if !c.changesets[i].skipped && !entrySkipped(entry) {
+				state[i] = c.entry(i)
+			}
+		}
+		if newVersion := encodeChangesetVersion(state); currentVersion != "" && newVersion != currentVersion {
+			steps = append(steps, applyStep{version: newVersion})
+		}
+		return steps, nil
+	}
+
+	state := append([]string{}, applied...)
+	pending := make([]string, 0)
+	var destructive []string
+
+	flush := func(noTransaction bool) error {
+		if len(pending) == 0 {
+			return nil
+		}
+		sql, err := joinStatements(pending...)
+		if err != nil {
+			return errors.Wrap(err, "unable to split changesets into statements")
+		}
+		steps = append(steps, applyStep{
+			sql:           sql,
+			version:       encodeChangesetVersion(state),
+			noTransaction: noTransaction,
+			destructive:   destructive,
+		})
+		pending, destructive = make([]string, 0), nil
+		return nil
+	}
+
+	for _, i := range run {
+		cs := c.changesets[i]
+
+		if cs.skipped {
+			state = append(state, c.entry(i))
+			continue
+		}
+
+		if cs.noTransaction {
+			if err := flush(false); err != nil {
+				return nil, err
+			}
+		}
+
+		pending = append(pending, cs.applySQL)
+
+		operations, err := cs.unapprovedOperations()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to classify changeset SQL")
+		}
+		destructive = append(destructive, operations...)
+
+		if i < len(state) {
+			state[i] = c.entry(i)
 		} else {
-			return "", "", errors.Wrap(err, "expected integer for currentVersion")
+			state = append(state, c.entry(i))
+		}
+
+		if cs.noTransaction || perChange {
+			if err := flush(cs.noTransaction); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	if currentVersionNum > uint64(len(c.changesets)) {
-		return "", "", errors.New("no changesets defined to reach specified version")
+	if err := flush(false); err != nil {
+		return nil, err
 	}
 
-	if currentVersionNum == uint64(len(c.changesets)) {
+	// record changesets that were skipped after the last one executed
+	lastVersion := currentVersion
+	if len(steps) > 0 {
+		lastVersion = steps[len(steps)-1].version
+	}
+	if newVersion := encodeChangesetVersion(state); newVersion != lastVersion {
+		steps = append(steps, applyStep{version: newVersion})
+	}
+
+	return steps, nil
+}
+
+// needsRun reports whether the changeset at index i, recorded as entry, has
+// to be executed again
+func (c *changesetFile) needsRun(i int, entry string) bool {
+	cs := c.changesets[i]
+	return entrySkipped(entry) ||
+		cs.runAlways ||
+		(cs.runOnChange && entry != entryKey(entry) && entry != c.entry(i))
+}
+
+func (c *changesetFile) getApplySQL(currentVersion string) (string, string, error) {
+	steps, err := c.getApplySteps(currentVersion)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(steps) == 0 {
 		return "", currentVersion, nil
 	}
 
-	for i := currentVersionNum; i < uint64(len(c.changesets)); i++ {
-		applySQL += c.changesets[i].applySQL + "\n"
+	sql := make([]string, 0)
+	for _, step := range steps {
+		if step.sql != "" {
+			sql = append(sql, step.sql)
+		}
 	}
 
-	return applySQL, strconv.FormatInt(int64(len(c.changesets)), 10), nil
+	return strings.Join(sql, "\n"), steps[len(steps)-1].version, nil
 }
 
 func (c *changesetFile) getRollbackSQL(currentVersion string) (string, string, error) {
-	currentVersionNum, err := strconv.ParseUint(currentVersion, 10, 64)
+	applied, err := c.applied(currentVersion)
 
 	if err != nil {
-		if currentVersion == "" {
-			return "", "0", nil
+		return "", "", err
+	}
+
+	if len(applied) == 0 {
+		return "", "0", nil
+	}
+
+	previousVersion := encodeChangesetVersion(applied[:len(applied)-1])
+
+	if entrySkipped(applied[len(applied)-1]) {
+		return "", previousVersion, nil
+	}
+
+	return c.changesets[len(applied)-1].rollbackSQL, previousVersion, nil
+}
+
+// getRollbackSteps returns the steps that roll the file back from
+// currentVersion to previousVersion, the version it was at before the
+// migration being rolled back, undoing the changesets executed since in
+// reverse order. Entries that changed without their changeset being
+// executed, such as a numeric version upgraded to IDs, are rolled back
+// without running SQL.
+func (c *changesetFile) getRollbackSteps(currentVersion, previousVersion string) ([]applyStep, error) {
+	applied, err := c.applied(currentVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := c.applied(previousVersion)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read version %v recorded before the migration", previousVersion)
+	}
+
+	if len(before) > len(applied) {
+		return nil, errors.Errorf("version %v has fewer changes applied than version %v recorded before it", currentVersion, previousVersion)
+	}
+
+	state := append([]string{}, applied...)
+	steps := make([]applyStep, 0)
+
+	for i := len(applied) - 1; i >= 0; i-- {
+		executed := !entrySkipped(applied[i]) && (i >= len(before) || entrySkipped(before[i]))
+
+		if i >= len(before) {
+			state = state[:i]
+		} else if executed {
+			state[i] = before[i]
+		} else {
+			continue
+		}
+
+		step := applyStep{version: encodeChangesetVersion(state)}
+
+		if executed {
+			cs := c.changesets[i]
+			step.sql, step.noTransaction = cs.rollbackSQL, cs.noTransaction
+			if !cs.destructive {
+				if step.destructive, err = destructiveOperations(cs.rollbackSQL); err != nil {
+					return nil, errors.Wrap(err, "unable to classify rollback SQL")
+				}
+			}
 		}
 
-		return "", "", errors.Wrap(err, "expected integer for currentVersion")
+		steps = append(steps, step)
 	}
 
-	if currentVersionNum == 0 {
-		return "", "0", nil
+	if len(steps) > 0 {
+		steps[len(steps)-1].version = previousVersion
+	} else if currentVersion != previousVersion {
+		steps = append(steps, applyStep{version: previousVersion})
+	}
+
+	return steps, nil
+}
+
+// status returns the state of each changeset in the file when the file is at
+// the given version
+func (c *changesetFile) status(currentVersion string) ([]StatusItem, error) {
+	applied, err := c.applied(currentVersion)
+
+	if err != nil {
+		return nil, err
 	}
 
-	return c.changesets[currentVersionNum-1].rollbackSQL, strconv.FormatUint(currentVersionNum-1, 10), nil
+	items := make([]StatusItem, len(c.changesets))
+
+	for i, cs := range c.changesets {
+		items[i] = StatusItem{Path: c.path, Change: c.key(i), State: StatePending}
+
+		switch {
+		case cs.skipped && (i >= len(applied) || entrySkipped(applied[i])):
+			items[i].State = StateSkipped
+		case i < len(applied) && (cs.skipped || !c.needsRun(i, applied[i]) || cs.runAlways):
+			items[i].State = StateApplied
+		}
+
+		if items[i].State == StatePending {
+			if items[i].Destructive, err = cs.unapprovedOperations(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// setEnvironment marks the changesets that are filtered out for the
+// environment as skipped. fileEnvironments applies to every changeset in the
+// file.
+func (c *changesetFile) setEnvironment(fileEnvironments string, environment string) {
+	for i := range c.changesets {
+		cs := &c.changesets[i]
+		cs.skipped = !environmentEnabled(fileEnvironments, environment) || !environmentEnabled(cs.environments, environment)
+	}
+}
+
+// parseOptions populates the changeset from the options following the
+// "-- change" annotation on the given line
+func (c *changesetFile) parseOptions(cs *changeset, annotation string, line int) error {
+	options := strings.Fields(strings.TrimPrefix(annotation, changesetAnnotation))
+
+	for _, option := range options {
+		column := strings.Index(annotation, option) + 1
+		name, value := option, ""
+		if i := strings.Index(option, "="); i != -1 {
+			name, value = option[:i], option[i+1:]
+		}
+
+		switch name {
+		case "id":
+			if !changesetIDRegexp.MatchString(value) {
+				return &ParseError{
+					Path:    c.path,
+					Line:    line,
+					Column:  column,
+					Message: fmt.Sprintf("invalid change id %q", value),
+					Hint:    "ids must start with a letter and contain only letters, digits, '_', '.' and '-'",
+				}
+			}
+			for i := range c.changesets {
+				if c.changesets[i].id == value {
+					return &ParseError{
+						Path:    c.path,
+						Line:    line,
+						Column:  column,
+						Message: fmt.Sprintf("duplicate change id %q", value),
+						Hint:    "each change in a file must have a unique id",
+					}
+				}
+			}
+			cs.id = value
+		case "notransaction":
+			cs.noTransaction = true
+		case "runAlways":
+			cs.runAlways = true
+		case "runOnChange":
+			cs.runOnChange = true
+		case "destructive":
+			cs.destructive = true
+		case "squashes":
+			if len(c.changesets) > 0 || value == "" {
+				return &ParseError{
+					Path:    c.path,
+					Line:    line,
+					Column:  column,
+					Message: "invalid squashes option",
+					Hint:    "only the first change of a file may squash others, such as squashes=create_users,add_email",
+				}
+			}
+			cs.squashes = value
+		case "env":
+			if value == "" {
+				return &ParseError{
+					Path:    c.path,
+					Line:    line,
+					Column:  column,
+					Message: "missing environments for env option",
+					Hint:    "list environments such as env=dev,staging or env=!prod",
+				}
+			}
+			cs.environments = value
+		default:
+			return &ParseError{
+				Path:    c.path,
+				Line:    line,
+				Column:  column,
+				Message: fmt.Sprintf("unknown change option %q", name),
+			}
+		}
+	}
+
+	if cs.squashes != "" && cs.id == "" {
+		return &ParseError{
+			Path:    c.path,
+			Line:    line,
+			Column:  1,
+			Message: "a change that squashes others needs an id",
+			Hint:    "add an id, such as -- change id=squashed_40 squashes=40",
+		}
+	}
+
+	return nil
 }
 
 // readFromFile populates the changeset
@@ -90,13 +640,38 @@ func (c *changesetFile) parse(fileContent []byte) error {
 		return errors.New("empty file")
 	}
 
+	quoted, err := quotedLines(string(fileContent))
+
+	if err != nil {
+		return inFile(err, c.path)
+	}
+
+	// isAnnotation reports whether the given line is the annotation, ignoring
+	// lines that are part of a string literal, dollar-quoted body or comment
+	isAnnotation := func(i int, annotation string) bool {
+		return lines[i] == annotation && !quoted[i+1]
+	}
+
+	// isChange reports whether the given line is a change annotation, which
+	// may be followed by options such as "-- change id=add_email"
+	isChange := func(i int) bool {
+		return isAnnotation(i, changesetAnnotation) ||
+			(strings.HasPrefix(lines[i], changesetAnnotation+" ") && !quoted[i+1])
+	}
+
 	captureRollback := func(i int) (int, string, error) {
 		r := ""
 
 		for j := i; j < len(lines); j++ {
-			if lines[j] == rollbackAnnotation {
-				return j, r, errors.Errorf("unexpected rollback statement (line %v)", j+1)
-			} else if lines[j] != changesetAnnotation {
+			if isAnnotation(j, rollbackAnnotation) {
+				return j, r, &ParseError{
+					Path:    c.path,
+					Line:    j + 1,
+					Column:  1,
+					Message: "unexpected rollback annotation",
+					Hint:    "each change may only have one rollback",
+				}
+			} else if !isChange(j) {
 				r += lines[j] + "\n"
 			} else {
 				return j, r, nil
@@ -107,42 +682,70 @@ func (c *changesetFile) parse(fileContent []byte) error {
 	}
 
 	captureChangeset := func(i int) (int, *changeset, error) {
-		c := &changeset{}
+		cs := &changeset{applyLine: i + 1}
 		j := i
 		for ; j < len(lines); j++ {
-			if lines[j] == changesetAnnotation {
-				return 0, nil, errors.Errorf("unexpected changeset statement (line %v", j+1)
-			} else if lines[j] != rollbackAnnotation {
-				c.applySQL += lines[j] + "\n"
+			if isChange(j) {
+				return 0, nil, &ParseError{
+					Path:    c.path,
+					Line:    j + 1,
+					Column:  1,
+					Message: "unexpected change annotation",
+					Hint:    fmt.Sprintf("the change on line %v is missing a rollback", i),
+				}
+			} else if !isAnnotation(j, rollbackAnnotation) {
+				cs.applySQL += lines[j] + "\n"
 			} else {
+				cs.rollbackLine = j + 2
 				j, rollback, err := captureRollback(j + 1)
 				if err != nil {
 					return 0, nil, err
 				}
-				c.rollbackSQL = rollback
-				return j - 1, c, nil
+				cs.rollbackSQL = rollback
+				return j - 1, cs, nil
 			}
 		}
 
-		if c.rollbackSQL == "" {
-			return 0, nil, errors.Errorf("missing rollback statement (line %v)", j)
+		if cs.rollbackSQL == "" {
+			return 0, nil, &ParseError{
+				Path:    c.path,
+				Line:    i,
+				Column:  1,
+				Message: "missing rollback annotation",
+				Hint:    "add a " + rollbackAnnotation + " block after the change",
+			}
 		}
 
-		return len(lines), c, nil
+		return len(lines), cs, nil
 	}
 
 	for i := 0; i < len(lines); i++ {
-		if lines[i] == changesetAnnotation {
+		if isChange(i) {
 			newIndex, changeset, err := captureChangeset(i + 1)
 			if err != nil {
 				return err
 			}
+			if err = c.parseOptions(changeset, lines[i], i+1); err != nil {
+				return err
+			}
 			c.changesets = append(c.changesets, *changeset)
 			i = newIndex
-		} else if lines[i] == rollbackAnnotation {
-			return errors.Errorf("unexpected rollback statement (line %v)", i+1)
-		} else if lines[i] != "" {
-			return errors.New("could not parse file")
+		} else if isAnnotation(i, rollbackAnnotation) {
+			return &ParseError{
+				Path:    c.path,
+				Line:    i + 1,
+				Column:  1,
+				Message: "unexpected rollback annotation",
+				Hint:    "a rollback must follow a " + changesetAnnotation + " block",
+			}
+		} else if strings.TrimSpace(lines[i]) != "" {
+			return &ParseError{
+				Path:    c.path,
+				Line:    i + 1,
+				Column:  firstColumn(lines[i]),
+				Message: "SQL outside of a change",
+				Hint:    "statements must follow a " + changesetAnnotation + " annotation",
+			}
 		}
 	}
 
@@ -25,13 +25,17 @@ func TestChangesetFileParse(t *testing.T) {
 	}
 
 	assert.Equal(t, changeset{
-		applySQL:    "CREATE TABLE awesome_table (\n    col_a text,\n    col_b text\n);\n\n",
-		rollbackSQL: "DROP TABLE awesome_table;\n\n",
+		applySQL:     "CREATE TABLE awesome_table (\n    col_a text,\n    col_b text\n);\n\n",
+		rollbackSQL:  "DROP TABLE awesome_table;\n\n",
+		applyLine:    2,
+		rollbackLine: 8,
 	}, c.changesets[0], "should populate first changeset")
 
 	assert.Equal(t, changeset{
-		applySQL:    "ALTER TABLE awesome_table ADD COLUMN col_c text;\n\n",
-		rollbackSQL: "ALTER TABLE awesome_table DROP COLUMN col_c;\n\n",
+		applySQL:     "ALTER TABLE awesome_table ADD COLUMN col_c text;\n\n",
+		rollbackSQL:  "ALTER TABLE awesome_table DROP COLUMN col_c;\n\n",
+		applyLine:    11,
+		rollbackLine: 14,
 	}, c.changesets[1], "should populate second changeset")
 }
 
@@ -43,7 +47,12 @@ func TestChangesetInvalidParse(t *testing.T) {
 		assert.FailNowf(t, "error reading test data", "got error: %v", err)
 	}
 
-	assert.Error(t, c.parse(fileContent), "should detect invalid formatting of file")
+	assert.Equal(t, &ParseError{
+		Line:    7,
+		Column:  1,
+		Message: "missing rollback annotation",
+		Hint:    "add a -- rollback block after the change",
+	}, c.parse(fileContent), "should detect invalid formatting of file")
 }
 
 func TestChangesetGetApplySQL(t *testing.T) {
@@ -67,7 +76,7 @@ func TestChangesetGetApplySQL(t *testing.T) {
 
 	assert.Equal(
 		t,
-		"CREATE TABLE awesome_table (\n    col_a text,\n    col_b text\n);\n\n\nALTER TABLE awesome_table ADD COLUMN col_c text;\n\n\n",
+		"CREATE TABLE awesome_table (\n    col_a text,\n    col_b text\n);\nALTER TABLE awesome_table ADD COLUMN col_c text;",
 		applyAllSQL,
 		"should return the SQL to apply all of the changes in the file",
 	)
@@ -81,7 +90,7 @@ func TestChangesetGetApplySQL(t *testing.T) {
 
 	assert.Equal(
 		t,
-		"ALTER TABLE awesome_table ADD COLUMN col_c text;\n\n\n",
+		"ALTER TABLE awesome_table ADD COLUMN col_c text;",
 		applyAllSQL,
 		"should return the SQL to apply missing changes in the file",
 	)
@@ -138,3 +147,359 @@ func TestChangesetGetRollbackSQL(t *testing.T) {
 	)
 	assert.Equal(t, "0", newVersion, "should return 0 as the version if rolled back 1")
 }
+
+func TestChangesetParseDollarQuoted(t *testing.T) {
+	c := changesetFile{}
+
+	err := c.parse([]byte(`
+-- change
+CREATE FUNCTION f() RETURNS text AS $$
+SELECT '
+-- change
+'
+$$ LANGUAGE sql;
+
+-- rollback
+DROP FUNCTION f()
+`))
+
+	if err != nil {
+		assert.FailNowf(t, "should parse file", "got error: %v", err)
+	}
+
+	assert.Equal(t, 1, len(c.changesets), "should not treat annotations inside dollar quotes as changesets")
+
+	c = changesetFile{}
+	assert.Error(t, c.parse([]byte("\n-- change\nSELECT $$;\n\n-- rollback\nSELECT 1;\n")), "should detect unterminated dollar quotes")
+}
+
+func TestChangesetNamed(t *testing.T) {
+	fileContent, err := ioutil.ReadFile("./testdata/change_style_named.sql")
+
+	if err != nil {
+		assert.FailNowf(t, "unable to read test data", "got error: %v", err)
+	}
+
+	c := changesetFile{}
+
+	if err := c.parse(fileContent); err != nil {
+		assert.FailNowf(t, "should parse named changesets", "got error: %v", err)
+	}
+
+	assert.Equal(t, []string{"", "add_email_column", "add_name_column"}, []string{
+		c.changesets[0].id, c.changesets[1].id, c.changesets[2].id,
+	}, "should read the id of each changeset")
+
+	t.Run("apply from legacy numeric version", func(t *testing.T) {
+		sql, version, err := c.getApplySQL("1")
+
+		assert.NoError(t, err, "should return apply SQL")
+		assert.Equal(
+			t,
+			"ALTER TABLE awesome_table ADD COLUMN email text;\nALTER TABLE awesome_table ADD COLUMN name text;",
+			sql,
+			"should apply the changesets after the numeric version",
+		)
+		assert.Equal(t, "1,add_email_column,add_name_column", version, "should record the applied keys")
+
+		sql, version, err = c.getApplySQL("3")
+
+		assert.NoError(t, err, "should migrate legacy numeric version")
+		assert.Equal(t, "", sql, "should not run any SQL when migrating the version")
+		assert.Equal(t, "1,add_email_column,add_name_column", version, "should convert numeric version to keys")
+
+		steps, err := c.getRollbackSteps("1,add_email_column,add_name_column", "3")
+
+		assert.NoError(t, err, "should return rollback steps")
+		assert.Equal(t, []applyStep{{version: "3"}}, steps, "should restore the numeric version without running SQL")
+	})
+
+	t.Run("apply and rollback named versions", func(t *testing.T) {
+		sql, version, err := c.getApplySQL("1,add_email_column")
+
+		assert.NoError(t, err, "should return apply SQL")
+		assert.Equal(t, "ALTER TABLE awesome_table ADD COLUMN name text;", sql, "should apply the pending changeset")
+		assert.Equal(t, "1,add_email_column,add_name_column", version, "should record the applied keys")
+
+		sql, version, err = c.getApplySQL("1,add_email_column,add_name_column")
+
+		assert.NoError(t, err, "should return apply SQL")
+		assert.Equal(t, "", sql, "should not apply anything when up to date")
+		assert.Equal(t, "1,add_email_column,add_name_column", version, "should keep the current version")
+
+		sql, version, err = c.getRollbackSQL("1,add_email_column")
+
+		assert.NoError(t, err, "should return rollback SQL")
+		assert.Equal(t, "ALTER TABLE awesome_table DROP COLUMN email;\n\n", sql, "should roll back the last applied changeset")
+		assert.Equal(t, "1", version, "should return a numeric version when no named changesets remain")
+	})
+
+	t.Run("detect changes to applied changesets", func(t *testing.T) {
+		_, _, err := c.getApplySQL("1,add_phone_column")
+		assert.EqualError(t, err, "already applied change add_phone_column was removed from the file")
+
+		_, _, err = c.getApplySQL("1,add_name_column")
+		assert.EqualError(t, err, "change add_email_column was inserted before already applied change add_name_column")
+
+		_, _, err = c.getApplySQL("1,add_name_column,add_email_column")
+		assert.EqualError(t, err, "already applied change add_name_column was moved from position 2 to 3")
+
+		_, _, err = c.getRollbackSQL("add_email_column")
+		assert.EqualError(t, err, "change 1 was inserted before already applied change add_email_column")
+	})
+
+	t.Run("invalid ids", func(t *testing.T) {
+		c := changesetFile{}
+		err := c.parse([]byte("\n-- change id=1abc\nSELECT 1;\n-- rollback\nSELECT 1;\n"))
+		assert.EqualError(t, err, `line 2, column 11: invalid change id "1abc" (hint: ids must start with a letter and contain only letters, digits, '_', '.' and '-')`)
+
+		c = changesetFile{path: "a.sql"}
+		err = c.parse([]byte("\n-- change id=a\nSELECT 1;\n-- rollback\nSELECT 1;\n-- change id=a\nSELECT 2;\n-- rollback\nSELECT 2;\n"))
+		assert.EqualError(t, err, `a.sql:6:11: duplicate change id "a" (hint: each change in a file must have a unique id)`)
+	})
+}
+
+func TestChangesetOptions(t *testing.T) {
+	fileContent, err := ioutil.ReadFile("./testdata/change_style_options.sql")
+
+	if err != nil {
+		assert.FailNowf(t, "unable to read test data", "got error: %v", err)
+	}
+
+	c := changesetFile{}
+
+	if err := c.parse(fileContent); err != nil {
+		assert.FailNowf(t, "should parse changeset options", "got error: %v", err)
+	}
+
+	assert.True(t, c.changesets[1].noTransaction, "should read notransaction option")
+	assert.True(t, c.changesets[2].runAlways, "should read runAlways option")
+	assert.True(t, c.changesets[3].runOnChange, "should read runOnChange option")
+
+	hash := c.changesets[3].hash()
+	latest := "create_table,index_col_a,refresh_grants,comment@" + hash
+
+	t.Run("split steps around notransaction changesets", func(t *testing.T) {
+		steps, err := c.getApplySteps("")
+
+		assert.NoError(t, err, "should return apply steps")
+		assert.Equal(t, []applyStep{
+			{
+				sql:     "CREATE TABLE awesome_table (\n    col_a text\n);",
+				version: "create_table",
+			},
+			{
+				sql:           "CREATE INDEX CONCURRENTLY awesome_table_col_a ON awesome_table (col_a);",
+				version:       "create_table,index_col_a",
+				noTransaction: true,
+			},
+			{
+				sql:     "GRANT SELECT ON awesome_table TO reader;\nCOMMENT ON TABLE awesome_table IS 'awesome';",
+				version: latest,
+			},
+		}, steps, "should apply the notransaction changeset on its own")
+	})
+
+	t.Run("split steps around every changeset", func(t *testing.T) {
+		steps, err := c.getChangeSteps("")
+
+		assert.NoError(t, err, "should return change steps")
+		assert.Equal(t, []applyStep{
+			{
+				sql:     "CREATE TABLE awesome_table (\n    col_a text\n);",
+				version: "create_table",
+			},
+			{
+				sql:           "CREATE INDEX CONCURRENTLY awesome_table_col_a ON awesome_table (col_a);",
+				version:       "create_table,index_col_a",
+				noTransaction: true,
+			},
+			{
+				sql:     "GRANT SELECT ON awesome_table TO reader;",
+				version: "create_table,index_col_a,refresh_grants",
+			},
+			{
+				sql:     "COMMENT ON TABLE awesome_table IS 'awesome';",
+				version: latest,
+			},
+		}, steps, "should apply every changeset on its own")
+	})
+
+	t.Run("re-run runAlways changesets", func(t *testing.T) {
+		steps, err := c.getApplySteps(latest)
+
+		assert.NoError(t, err, "should return apply steps")
+		assert.Equal(t, []applyStep{
+			{sql: "GRANT SELECT ON awesome_table TO reader;", version: latest},
+		}, steps, "should re-run the runAlways changeset without changing the version")
+	})
+
+	t.Run("re-run changed runOnChange changesets", func(t *testing.T) {
+		steps, err := c.getApplySteps("create_table,index_col_a,refresh_grants,comment@000000000000")
+
+		assert.NoError(t, err, "should return apply steps")
+		assert.Equal(t, []applyStep{
+			{
+				sql:     "GRANT SELECT ON awesome_table TO reader;\nCOMMENT ON TABLE awesome_table IS 'awesome';",
+				version: latest,
+			},
+		}, steps, "should re-run the changed changeset and record its new hash")
+	})
+
+	t.Run("roll back runOnChange changesets", func(t *testing.T) {
+		sql, version, err := c.getRollbackSQL(latest)
+
+		assert.NoError(t, err, "should return rollback SQL")
+		assert.Equal(t, "COMMENT ON TABLE awesome_table IS NULL;\n\n", sql, "should roll back the last changeset")
+		assert.Equal(t, "create_table,index_col_a,refresh_grants", version, "should remove the last entry")
+	})
+
+	t.Run("roll back a migration", func(t *testing.T) {
+		steps, err := c.getRollbackSteps(latest, "create_table")
+
+		assert.NoError(t, err, "should return rollback steps")
+		assert.Equal(t, []applyStep{
+			{
+				sql:     "COMMENT ON TABLE awesome_table IS NULL;\n\n",
+				version: "create_table,index_col_a,refresh_grants",
+			},
+			{
+				sql:     "REVOKE SELECT ON awesome_table FROM reader;\n\n",
+				version: "create_table,index_col_a",
+			},
+			{
+				sql:           "DROP INDEX CONCURRENTLY awesome_table_col_a;\n\n",
+				version:       "create_table",
+				noTransaction: true,
+			},
+		}, steps, "should roll back every changeset applied since the previous version, outside of a transaction when needed")
+
+		steps, err = c.getRollbackSteps(latest, "create_table,index_col_a,refresh_grants,comment@000000000000")
+
+		assert.NoError(t, err, "should return rollback steps")
+		assert.Equal(t, []applyStep{
+			{version: "create_table,index_col_a,refresh_grants,comment@000000000000"},
+		}, steps, "should only restore the version of a changeset that was run again")
+	})
+}
+
+func TestChangesetEnvironments(t *testing.T) {
+	fileContent, err := ioutil.ReadFile("./testdata/change_style_env.sql")
+
+	if err != nil {
+		assert.FailNowf(t, "unable to read test data", "got error: %v", err)
+	}
+
+	c := changesetFile{}
+
+	if err := c.parse(fileContent); err != nil {
+		assert.FailNowf(t, "should parse changeset environments", "got error: %v", err)
+	}
+
+	assert.Equal(t, "dev,staging", c.changesets[1].environments, "should read env option")
+	assert.Equal(t, "!prod", c.changesets[2].environments, "should read negated env option")
+
+	t.Run("skip changesets for other environments", func(t *testing.T) {
+		c.setEnvironment("", "prod")
+
+		sql, version, err := c.getApplySQL("")
+
+		assert.NoError(t, err, "should return apply SQL")
+		assert.Equal(t, "CREATE TABLE users (\n    email text\n);", sql, "should only apply the unfiltered changeset")
+		assert.Equal(t, "1,2!,3!", version, "should record the skipped changesets")
+
+		steps, err := c.getApplySteps("1,2!,3!")
+
+		assert.NoError(t, err, "should return apply steps")
+		assert.Empty(t, steps, "should not apply skipped changesets again")
+
+		items, err := c.status("1,2!,3!")
+
+		assert.NoError(t, err, "should return the status")
+		assert.Equal(t, []StatusItem{
+			{Change: "1", State: StateApplied},
+			{Change: "2", State: StateSkipped},
+			{Change: "3", State: StateSkipped},
+		}, items, "should report skipped changesets")
+
+		sql, version, err = c.getRollbackSQL("1,2!,3!")
+
+		assert.NoError(t, err, "should return rollback SQL")
+		assert.Equal(t, "", sql, "should not roll back a skipped changeset")
+		assert.Equal(t, "1,2!", version, "should remove the skipped entry")
+	})
+
+	t.Run("apply previously skipped changesets", func(t *testing.T) {
+		c.setEnvironment("", "staging")
+
+		items, err := c.status("1,2!,3!")
+
+		assert.NoError(t, err, "should return the status")
+		assert.Equal(t, StatePending, items[1].State, "should report the changeset as pending")
+
+		sql, version, err := c.getApplySQL("1,2!,3!")
+
+		assert.NoError(t, err, "should return apply SQL")
+		assert.Equal(
+			t,
+			"INSERT INTO users (email) VALUES ('sample@example.com');\n"+
+				"CREATE FUNCTION debug_users() RETURNS bigint AS 'SELECT count(*) FROM users' LANGUAGE SQL;",
+			sql,
+			"should apply the changesets that are no longer skipped",
+		)
+		assert.Equal(t, "3", version, "should record the changesets as applied")
+	})
+
+	t.Run("skip every changeset of a filtered file", func(t *testing.T) {
+		c.setEnvironment("!test", "test")
+
+		steps, err := c.getApplySteps("")
+
+		assert.NoError(t, err, "should return apply steps")
+		assert.Equal(t, []applyStep{{version: "1!,2!,3!"}}, steps, "should only record the skipped changesets")
+	})
+
+	t.Run("invalid env option", func(t *testing.T) {
+		err := (&changesetFile{path: "env.sql"}).parse([]byte("\n-- change env=\nSELECT 1;\n-- rollback\nSELECT 2;\n"))
+
+		assert.EqualError(t, err, "env.sql:2:11: missing environments for env option (hint: list environments such as env=dev,staging or env=!prod)", "should require environments")
+	})
+}
+
+func TestChangesetDestructive(t *testing.T) {
+	c := changesetFile{path: "destructive.sql"}
+	err := c.parse([]byte(`-- change id=drop_email destructive
+ALTER TABLE users DROP COLUMN email;
+
+-- rollback
+ALTER TABLE users ADD COLUMN email text;
+
+-- change id=truncate
+TRUNCATE sessions;
+
+-- rollback
+SELECT 1;
+`))
+
+	assert.NoError(t, err, "should parse the destructive option")
+	assert.True(t, c.changesets[0].destructive, "should mark the change as destructive")
+
+	steps, err := c.getApplySteps("")
+
+	assert.NoError(t, err, "should get apply steps")
+	assert.Equal(t, []string{"TRUNCATE"}, steps[0].destructive, "should only report operations that were not approved")
+
+	steps, err = c.getRollbackSteps("drop_email,truncate", "")
+
+	assert.NoError(t, err, "should get rollback steps")
+	assert.Equal(t, []applyStep{
+		{sql: "SELECT 1;\n\n", version: "drop_email"},
+		{sql: "ALTER TABLE users ADD COLUMN email text;\n\n", version: ""},
+	}, steps, "should roll back the changes in reverse order")
+
+	items, err := c.status("")
+
+	assert.NoError(t, err, "should get status")
+	assert.Nil(t, items[0].Destructive, "should not highlight approved changes")
+	assert.Equal(t, []string{"TRUNCATE"}, items[1].Destructive, "should highlight pending destructive changes")
+}
@@ -1,62 +1,910 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"strings"
+	"time"
 
 	"github.com/chriscasola/pgit"
 )
 
+// variableFlags collects the key=value pairs of repeated -var flags
+type variableFlags map[string]string
+
+func (v variableFlags) String() string {
+	return fmt.Sprint(map[string]string(v))
+}
+
+func (v variableFlags) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 1 {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	v[value[:i]] = value[i+1:]
+	return nil
+}
+
 func main() {
+	configPath := flag.String("config", "", "path to a pgit.yaml or pgit.toml config file (default: found in the working directory or git root)")
 	dbURL := flag.String("database", "", "PSQL url of the database")
+	scratchURL := flag.String("scratch-database", "", "PSQL url of a scratch database for drift, squash and verify-rollbacks, which may change anything in it")
 	rootPath := flag.String("root", "", "path to the root of the schema definition files")
+	tableName := flag.String("table", "", "name of the table used to track the migration state (default: pgit)")
+	environment := flag.String("env", "", "name of the environment being migrated, such as dev or prod")
+	varsPath := flag.String("vars", "", "path to a file of key=value template variables")
+	output := flag.String("output", "text", "format of the output, text or json")
+	allowDestructive := flag.Bool("allow-destructive", false, "allow migrations and rollbacks to run SQL that destroys data, such as DROP TABLE")
+	vars := variableFlags{}
+	flag.Var(vars, "var", "template variable as key=value, may be repeated")
+	baselines := variableFlags{}
+	flag.Var(baselines, "baseline-version", "version recorded by baseline for a file as path=version, may be repeated")
 
 	flag.Parse()
 
+	r := &reporter{json: *output == "json", command: flag.Arg(0)}
+
 	printUsage := func() {
-		fmt.Println("Usage: pgit [options] command\ncommand is one of migrate or rollback")
+		if r.json {
+			return
+		}
+		fmt.Println("Usage: pgit [options] command\ncommand is one of baseline, drift, history, lint, migrate, plan, rollback, status, test, validate or verify-rollbacks,\nor export-script <-from-state <file>|-from-db>, import -from <tool> [-version-table <name>] <directory>..., import-definitions [-schema <name>], new <type|change> <file> or squash <file> -through <n>")
+		fmt.Println("Settings are read from the config file, then PGIT_* environment variables, then flags.")
 		flag.PrintDefaults()
 	}
 
-	if flag.NFlag() != 2 || len(flag.Args()) != 1 {
+	if *output != "text" && *output != "json" {
 		printUsage()
-		os.Exit(1)
+		r.fail(exitUsage, "Invalid output", fmt.Errorf("expected text or json, got %q", *output))
+	}
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		r.fail(exitConfig, "Error reading config", err)
 	}
 
+	// flags take precedence over PGIT_* environment variables, which take
+	// precedence over the config file
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	setting := func(name string, flagValue string, envName string, configValue string) string {
+		if set[name] {
+			return flagValue
+		}
+		if value, ok := os.LookupEnv(envName); ok {
+			return value
+		}
+		return configValue
+	}
+
+	*dbURL = setting("database", *dbURL, "PGIT_DATABASE", config.Database)
+	*rootPath = setting("root", *rootPath, "PGIT_ROOT", config.Root)
+	*tableName = setting("table", *tableName, "PGIT_TABLE", config.Table)
+	*environment = setting("env", *environment, "PGIT_ENV", config.Environment)
+	*scratchURL = setting("scratch-database", *scratchURL, "PGIT_SCRATCH_DATABASE", "")
+
 	command := flag.Arg(0)
 
-	conn, err := pgit.NewSQLDatabaseConnection(*dbURL, "")
+	// only some commands take arguments
+	takesArgs := command == "export-script" || command == "import" || command == "import-definitions" || command == "new" || command == "squash"
+	if *rootPath == "" || command == "" || (len(flag.Args()) != 1 && !takesArgs) {
+		printUsage()
+		r.fail(exitUsage, "Missing root or command", nil)
+	}
+
+	variables, err := readVariables(config.Variables, *varsPath, vars)
 
 	if err != nil {
-		fmt.Printf("Error connecting to DB: %v\n", err)
-		os.Exit(1)
+		r.fail(exitConfig, "Error reading variables", err)
+	}
+
+	if command == "validate" {
+		validate(r, *rootPath, pgit.Variables(variables), pgit.Environment(*environment))
+	}
+
+	if command == "new" {
+		if len(flag.Args()) != 3 {
+			printUsage()
+			r.fail(exitUsage, "Missing file type or path", nil)
+		}
+		newFile(r, *rootPath, flag.Arg(1), flag.Arg(2))
+	}
+
+	lintSeverity := pgit.LintSeverity(config.Lint.Rules)
+
+	// without a database every change is linted rather than only the
+	// pending ones
+	if command == "lint" && *dbURL == "" {
+		instance, err := pgit.New(*rootPath, nil, pgit.Variables(variables), pgit.Environment(*environment), lintSeverity)
+		if err != nil {
+			r.fail(exitError, "Error initializing Pgit", err)
+		}
+		lint(r, instance)
 	}
 
-	instance, err := pgit.New(*rootPath, conn)
+	// verify-rollbacks and squash apply and roll back changes freely, so they
+	// are only run against a database named as a scratch database
+	if command == "verify-rollbacks" || command == "squash" {
+		if *scratchURL == "" {
+			printUsage()
+			r.fail(exitUsage, "Missing scratch database", nil)
+		}
+		*dbURL = *scratchURL
+	}
+
+	// a script exported from a state file needs no database
+	if command == "export-script" {
+		exportFlags := flag.NewFlagSet(command, flag.ContinueOnError)
+		fromState := exportFlags.String("from-state", "", "JSON file mapping the path of each file to its version in the database")
+		fromDB := exportFlags.Bool("from-db", false, "read the versions from the database, which may be a read-only connection")
+
+		if positional, err := commandArgs(exportFlags, flag.Args()[1:]); err != nil || len(positional) > 0 || (*fromState == "") == !*fromDB {
+			printUsage()
+			r.fail(exitUsage, "Expected export-script -from-state <file> or export-script -from-db", err)
+		}
+
+		if *fromState != "" {
+			instance, err := pgit.New(*rootPath, nil, pgit.Variables(variables), pgit.Environment(*environment))
+			if err != nil {
+				r.fail(exitError, "Error initializing Pgit", err)
+			}
+			exportScript(r, func() (string, error) {
+				versions, err := readState(*fromState)
+				if err != nil {
+					return "", err
+				}
+				return instance.ExportScriptFromState(*tableName, versions)
+			})
+		}
+	}
+
+	// the version table named by import is an option of the Pgit instance,
+	// so its arguments are read before the instance is created
+	var importTool pgit.MigrationTool
+	var importDirs []string
+	versionTable := ""
+	if command == "import" {
+		if importTool, versionTable, importDirs, err = importArgs(flag.Args()[1:]); err != nil {
+			r.fail(exitUsage, "Expected import -from <golang-migrate|goose|flyway> [-version-table <name>] <directory>...", err)
+		}
+	}
+
+	// without a database imported migrations are only converted
+	if command == "import" && *dbURL == "" {
+		instance, err := pgit.New(*rootPath, nil)
+		if err != nil {
+			r.fail(exitError, "Error initializing Pgit", err)
+		}
+		importMigrations(r, instance, importTool, importDirs)
+	}
+
+	if *dbURL == "" {
+		printUsage()
+		r.fail(exitUsage, "Missing database", nil)
+	}
+
+	connectionOptions := make([]pgit.ConnectionOption, 0)
+	if config.Lock.Enabled {
+		connectionOptions = append(connectionOptions, pgit.AdvisoryLock(config.Lock.Key, config.Lock.Wait))
+	}
+	if config.Timeouts.Statement > 0 {
+		connectionOptions = append(connectionOptions, pgit.StatementTimeout(config.Timeouts.Statement))
+	}
+	if config.Timeouts.Lock > 0 {
+		connectionOptions = append(connectionOptions, pgit.LockTimeout(config.Timeouts.Lock))
+	}
+
+	conn, err := pgit.NewSQLDatabaseConnection(*dbURL, *tableName, connectionOptions...)
 
 	if err != nil {
-		fmt.Printf("Error initializing Pgit: %v\n", err)
-		os.Exit(1)
+		r.fail(exitConnection, "Error connecting to DB", err)
+	}
+
+	// the output of hook commands must not mix with a JSON report
+	var hookOutput io.Writer = os.Stdout
+	if r.json {
+		hookOutput = os.Stderr
 	}
 
-	if command == "migrate" {
+	recorder := newEventRecorder()
+	var observer pgit.Observer = recorder
+	if !r.json {
+		text := pgit.NewTextObserver(os.Stdout)
+		observer = pgit.ObserverFunc(func(event pgit.Event) {
+			recorder.Notify(event)
+			text.Notify(event)
+		})
+	}
+
+	options := []pgit.Option{
+		pgit.Variables(variables),
+		pgit.Environment(*environment),
+		pgit.Observe(observer),
+		lintSeverity,
+		pgit.VersionTable(versionTable),
+	}
+	if *allowDestructive {
+		options = append(options, pgit.AllowDestructive())
+	}
+	options = append(options, shellHooks(pgit.BeforeMigrate, config.Hooks.BeforeMigrate, hookOutput)...)
+	options = append(options, shellHooks(pgit.AfterEachFile, config.Hooks.AfterEachFile, hookOutput)...)
+	options = append(options, shellHooks(pgit.AfterMigrate, config.Hooks.AfterMigrate, hookOutput)...)
+	options = append(options, shellHooks(pgit.BeforeRollback, config.Hooks.BeforeRollback, hookOutput)...)
+	options = append(options, shellHooks(pgit.AfterRollback, config.Hooks.AfterRollback, hookOutput)...)
+
+	instance, err := pgit.New(*rootPath, conn, options...)
+
+	if err != nil {
+		r.fail(exitError, "Error initializing Pgit", err)
+	}
+
+	switch command {
+	case "migrate":
 		if err = instance.ApplyLatest(); err != nil {
-			fmt.Printf("Error updating the database to the latest schema: %v\n", err)
-			os.Exit(1)
+			r.exit(recorder.report, errorCode(err, exitMigrationFailed), "Error updating the database to the latest schema", err)
 		}
 
-		fmt.Println("Finished applying latest version of schemas to the database.")
-		os.Exit(0)
-	}
+		if recorder.failed > 0 {
+			r.exit(recorder.report, exitMigrationFailed, fmt.Sprintf("Error updating the database to the latest schema: %v files failed", recorder.failed), nil)
+		}
+
+		if !r.json {
+			fmt.Println("Finished applying latest version of schemas to the database.")
+		}
+		r.exit(recorder.report, exitOK, "", nil)
+	case "plan":
+		steps, err := instance.Plan()
+
+		if err != nil {
+			r.fail(errorCode(err, exitError), "Error planning the migration", err)
+		}
+
+		rep := &planReport{Steps: make([]planStep, len(steps))}
+
+		destructive := 0
 
-	if command == "rollback" {
+		for i, step := range steps {
+			rep.Steps[i] = planStep(step)
+			if rep.Steps[i].Destructive == nil {
+				rep.Steps[i].Destructive = make([]string, 0)
+			}
+			if len(step.Destructive) > 0 {
+				destructive++
+			}
+			if r.json {
+				continue
+			}
+			fmt.Printf("-- %v (%q -> %q)\n", step.Path, step.FromVersion, step.ToVersion)
+			if step.NoTransaction {
+				fmt.Println("-- runs outside of a transaction")
+			}
+			if len(step.Destructive) > 0 {
+				fmt.Printf("-- DESTRUCTIVE: %v\n", strings.Join(step.Destructive, ", "))
+			}
+			fmt.Printf("%v\n\n", strings.TrimSpace(step.SQL))
+		}
+
+		if !r.json {
+			fmt.Printf("%v steps to apply\n", len(steps))
+			if destructive > 0 {
+				fmt.Printf("%v steps are destructive and need -allow-destructive or -- change destructive\n", destructive)
+			}
+		}
+		r.exit(rep, exitOK, "", nil)
+	case "status":
+		items, err := instance.Status()
+
+		if err != nil {
+			r.fail(errorCode(err, exitError), "Error reading the status of the schema", err)
+		}
+
+		rep := &statusReport{
+			Items:   make([]statusItem, len(items)),
+			Summary: map[string]int{pgit.StateApplied: 0, pgit.StatePending: 0, pgit.StateSkipped: 0},
+		}
+
+		for i, item := range items {
+			rep.Items[i] = statusItem(item)
+			if rep.Items[i].Destructive == nil {
+				rep.Items[i].Destructive = make([]string, 0)
+			}
+			rep.Summary[item.State]++
+			if r.json {
+				continue
+			}
+			line := fmt.Sprintf("%-8v %v", item.State, item.Path)
+			if item.Change != "" {
+				line += fmt.Sprintf(" (change %v)", item.Change)
+			}
+			if len(item.Destructive) > 0 {
+				line += fmt.Sprintf(" DESTRUCTIVE: %v", strings.Join(item.Destructive, ", "))
+			}
+			fmt.Println(line)
+		}
+
+		if !r.json {
+			fmt.Printf(
+				"%v applied, %v pending, %v skipped\n",
+				rep.Summary[pgit.StateApplied], rep.Summary[pgit.StatePending], rep.Summary[pgit.StateSkipped],
+			)
+		}
+		r.exit(rep, exitOK, "", nil)
+	case "history":
+		migrations, err := instance.History()
+
+		if err != nil {
+			r.fail(errorCode(err, exitError), "Error reading the migration history", err)
+		}
+
+		rep := &historyReport{Migrations: make([]historyMigration, len(migrations))}
+
+		for i, m := range migrations {
+			entry := historyMigration{ID: m.ID, Completed: m.Completed, Files: make([]historyFile, len(m.Files))}
+			if !m.StartedAt.IsZero() {
+				entry.StartedAt = &migrations[i].StartedAt
+			}
+			if !m.FinishedAt.IsZero() {
+				entry.FinishedAt = &migrations[i].FinishedAt
+			}
+			for j, f := range m.Files {
+				entry.Files[j] = historyFile(f)
+			}
+			rep.Migrations[i] = entry
+
+			if r.json {
+				continue
+			}
+			state := "completed"
+			if !m.Completed {
+				state = "incomplete"
+			}
+			if m.StartedAt.IsZero() {
+				fmt.Printf("migration %v (%v)\n", m.ID, state)
+			} else {
+				fmt.Printf("migration %v (%v) started %v\n", m.ID, state, m.StartedAt.Format(time.RFC3339))
+			}
+			for _, f := range m.Files {
+				fmt.Printf("  %v %v\n", f.Path, f.Version)
+			}
+		}
+
+		if !r.json {
+			fmt.Printf("%v migrations\n", len(migrations))
+		}
+		r.exit(rep, exitOK, "", nil)
+	case "test":
+		if err = instance.ApplyLatest(); err != nil {
+			r.fail(errorCode(err, exitMigrationFailed), "Error updating the database to the latest schema", err)
+		}
+
+		// the tests would run against a partly migrated schema
+		if recorder.failed > 0 {
+			r.fail(exitMigrationFailed, fmt.Sprintf("Error updating the database to the latest schema: %v files failed", recorder.failed), nil)
+		}
+
+		results, err := instance.Test()
+
+		if err != nil {
+			r.fail(exitError, "Error running tests", err)
+		}
+
+		rep := &testReport{Results: make([]testResult, len(results))}
+		failed := 0
+
+		for i, result := range results {
+			rep.Results[i] = testResult(result)
+			if !result.Passed {
+				failed++
+			}
+			if r.json {
+				continue
+			}
+			if result.Passed {
+				fmt.Printf("PASS %v:%v\n", result.Path, result.Line)
+			} else {
+				fmt.Printf("FAIL %v:%v: %v\n", result.Path, result.Line, result.Message)
+			}
+		}
+
+		if !r.json {
+			fmt.Printf("%v passed, %v failed\n", len(results)-failed, failed)
+		}
+
+		if failed > 0 {
+			r.exit(rep, exitTestsFailed, fmt.Sprintf("%v tests failed", failed), nil)
+		}
+		r.exit(rep, exitOK, "", nil)
+	case "lint":
+		lint(r, instance)
+	case "verify-rollbacks":
+		verifyRollbacks(r, instance)
+	case "drift":
+		if *scratchURL == "" {
+			printUsage()
+			r.fail(exitUsage, "Missing scratch database", nil)
+		}
+
+		shadow, err := pgit.NewSQLDatabaseConnection(*scratchURL, *tableName, connectionOptions...)
+
+		if err != nil {
+			r.fail(exitConnection, "Error connecting to the scratch database", err)
+		}
+
+		drift(r, instance, shadow)
+	case "squash":
+		path, through, err := squashArgs(flag.Args()[1:])
+
+		if err != nil {
+			printUsage()
+			r.fail(exitUsage, "Invalid squash arguments", err)
+		}
+
+		if err = instance.Squash(path, through); err != nil {
+			r.fail(errorCode(err, exitError), "Error squashing changes", err)
+		}
+
+		if !r.json {
+			fmt.Printf("Squashed the first %v changes of %v\n", through, path)
+		}
+		r.exit(&squashReport{Path: path, Through: through}, exitOK, "", nil)
+	case "export-script":
+		exportScript(r, func() (string, error) {
+			return instance.ExportScript(*tableName)
+		})
+	case "import":
+		importMigrations(r, instance, importTool, importDirs)
+	case "import-definitions":
+		importFlags := flag.NewFlagSet(command, flag.ContinueOnError)
+		schema := importFlags.String("schema", "public", "schema to import the functions and views of")
+
+		if positional, err := commandArgs(importFlags, flag.Args()[1:]); err != nil || len(positional) > 0 {
+			printUsage()
+			r.fail(exitUsage, "Invalid import-definitions arguments", err)
+		}
+
+		paths, err := instance.ImportDefinitions(*schema)
+
+		if err != nil {
+			r.fail(errorCode(err, exitError), "Error importing definitions", err)
+		}
+
+		if !r.json {
+			for _, path := range paths {
+				fmt.Printf("Created %v\n", path)
+			}
+			fmt.Printf("Imported %v functions and views from %v\n", len(paths), *schema)
+		}
+		r.exit(&importReport{Paths: paths}, exitOK, "", nil)
+	case "baseline":
+		if err = instance.Baseline(baselines); err != nil {
+			r.exit(recorder.report, errorCode(err, exitMigrationFailed), "Error recording the baseline", err)
+		}
+
+		if !r.json {
+			recorded := 0
+			for _, f := range recorder.report.Files {
+				if f.Status == fileApplied {
+					recorded++
+				}
+			}
+			fmt.Printf("Recorded the baseline of %v files\n", recorded)
+		}
+		r.exit(recorder.report, exitOK, "", nil)
+	case "rollback":
 		if err = instance.Rollback(); err != nil {
-			fmt.Printf("Error rolling back last migration: %v\n", err)
-			os.Exit(1)
+			r.exit(recorder.report, errorCode(err, exitMigrationFailed), "Error rolling back last migration", err)
 		}
 
-		fmt.Println("Rolled back last migration")
-		os.Exit(0)
+		if !r.json {
+			fmt.Println("Rolled back last migration")
+		}
+		r.exit(recorder.report, exitOK, "", nil)
 	}
+
+	printUsage()
+	r.fail(exitUsage, "Unknown command", fmt.Errorf("%q", command))
+}
+
+// validate checks the schema files without connecting to the database and
+// prints any problems as "path:line:col: message" so that editors and CI
+// systems can annotate them.
+func validate(r *reporter, rootPath string, options ...pgit.Option) {
+	instance, err := pgit.New(rootPath, nil, options...)
+
+	if err != nil {
+		r.fail(exitError, "Error initializing Pgit", err)
+	}
+
+	rep := &validateReport{Errors: make([]validateError, 0)}
+
+	if err = instance.Validate(); err != nil {
+		if parseErrors, ok := err.(pgit.ParseErrors); ok {
+			for _, parseErr := range parseErrors {
+				rep.Errors = append(rep.Errors, validateError(*parseErr))
+				if !r.json {
+					fmt.Println(parseErr)
+				}
+			}
+			r.exit(rep, exitInvalidSchema, fmt.Sprintf("%v problems found in schema files", len(parseErrors)), nil)
+		}
+
+		r.fail(exitError, "Error validating schema files", err)
+	}
+
+	if !r.json {
+		fmt.Println("All schema files are valid.")
+	}
+	r.exit(rep, exitOK, "", nil)
+}
+
+// newFile creates a schema file of the given type, or appends a change to a
+// changeset file when the type is change, and prints its path
+func newFile(r *reporter, rootPath string, fileType string, path string) {
+	instance, err := pgit.New(rootPath, nil)
+
+	if err != nil {
+		r.fail(exitError, "Error initializing Pgit", err)
+	}
+
+	var filePath string
+	if fileType == "change" {
+		filePath, err = instance.NewChange(path)
+	} else {
+		filePath, err = instance.NewFile(fileType, path)
+	}
+
+	if err != nil {
+		r.fail(exitError, "Error creating schema file", err)
+	}
+
+	if !r.json {
+		if fileType == "change" {
+			fmt.Printf("Added a change to %v\n", filePath)
+		} else {
+			fmt.Printf("Created %v\n", filePath)
+		}
+	}
+	r.exit(&newReport{Path: filePath}, exitOK, "", nil)
+}
+
+// lint checks the changes for operations that are hazardous on a live
+// database and prints each finding as "path:line: severity: message (rule)"
+func lint(r *reporter, instance *pgit.Pgit) {
+	findings, err := instance.Lint()
+
+	if err != nil {
+		r.fail(errorCode(err, exitError), "Error linting schema files", err)
+	}
+
+	rep := &lintReport{Findings: make([]lintFinding, len(findings))}
+	errorCount := 0
+
+	for i, finding := range findings {
+		rep.Findings[i] = lintFinding(finding)
+		if finding.Severity == pgit.SeverityError {
+			errorCount++
+		}
+		if !r.json {
+			fmt.Println(finding)
+		}
+	}
+
+	if !r.json {
+		fmt.Printf("%v errors, %v warnings\n", errorCount, len(findings)-errorCount)
+	}
+
+	if errorCount > 0 {
+		r.exit(rep, exitLint, fmt.Sprintf("%v lint errors", errorCount), nil)
+	}
+	r.exit(rep, exitOK, "", nil)
+}
+
+// verifyRollbacks applies each pending change to the scratch database, rolls
+// it back and applies it again, and prints the changes whose rollback did not
+// restore the database
+func verifyRollbacks(r *reporter, instance *pgit.Pgit) {
+	results, err := instance.VerifyRollbacks()
+
+	rep := &verifyReport{Results: make([]verifyResult, len(results))}
+	counts := map[string]int{pgit.VerifyPassed: 0, pgit.VerifyFailed: 0, pgit.VerifySkipped: 0}
+
+	for i, result := range results {
+		rep.Results[i] = verifyResult(result)
+		if rep.Results[i].Missing == nil {
+			rep.Results[i].Missing = make([]string, 0)
+		}
+		if rep.Results[i].Extra == nil {
+			rep.Results[i].Extra = make([]string, 0)
+		}
+		counts[result.Result]++
+		if r.json {
+			continue
+		}
+		line := fmt.Sprintf("%v %v", strings.ToUpper(result.Result[:4]), result.Path)
+		if result.Change != "" {
+			line += fmt.Sprintf(" (change %v)", result.Change)
+		} else {
+			line += fmt.Sprintf(" (%q -> %q)", result.FromVersion, result.ToVersion)
+		}
+		if result.Message != "" {
+			line += ": " + result.Message
+		}
+		fmt.Println(line)
+		for _, object := range result.Missing {
+			fmt.Printf("  missing after rollback: %v\n", object)
+		}
+		for _, object := range result.Extra {
+			fmt.Printf("  left by rollback: %v\n", object)
+		}
+	}
+
+	if err != nil {
+		r.exit(rep, errorCode(err, exitError), "Error verifying rollbacks", err)
+	}
+
+	if !r.json {
+		fmt.Printf("%v passed, %v failed, %v skipped\n", counts[pgit.VerifyPassed], counts[pgit.VerifyFailed], counts[pgit.VerifySkipped])
+	}
+
+	if counts[pgit.VerifyFailed] > 0 {
+		r.exit(rep, exitRollbackFailed, fmt.Sprintf("%v changes failed to roll back cleanly", counts[pgit.VerifyFailed]), nil)
+	}
+	r.exit(rep, exitOK, "", nil)
+}
+
+// drift migrates the scratch database from scratch and prints the differences
+// between it and the database, one object per line, prefixed by "- " for
+// objects missing from the database and "+ " for objects only in it
+func drift(r *reporter, instance *pgit.Pgit, shadow pgit.DatabaseConnection) {
+	result, err := instance.Drift(shadow)
+
+	if err != nil {
+		r.fail(errorCode(err, exitError), "Error checking for drift", err)
+	}
+
+	rep := &driftReport{Missing: result.Missing, Extra: result.Extra, Diff: result.Diff()}
+
+	if !r.json {
+		for _, line := range rep.Diff {
+			fmt.Println(line)
+		}
+		fmt.Printf("%v objects missing from the database, %v objects not in the schema files\n", len(result.Missing), len(result.Extra))
+	}
+
+	if result.HasDrift() {
+		r.exit(rep, exitDrift, "The database has drifted from the schema files", nil)
+	}
+	r.exit(rep, exitOK, "", nil)
+}
+
+// commandArgs parses the arguments of a command, which may mix flags and
+// positional arguments, and returns the positional arguments
+func commandArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	flags.SetOutput(ioutil.Discard)
+	positional := make([]string, 0)
+
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// squashArgs parses the arguments of the squash command, the path of the
+// changeset file relative to the git root and the -through flag
+func squashArgs(args []string) (string, int, error) {
+	flags := flag.NewFlagSet("squash", flag.ContinueOnError)
+	through := flags.Int("through", 0, "number of changes to squash")
+
+	positional, err := commandArgs(flags, args)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(positional) != 1 {
+		return "", 0, fmt.Errorf("expected the path of a changeset file, got %q", positional)
+	}
+
+	if *through < 2 {
+		return "", 0, fmt.Errorf("-through must be at least 2, got %v", *through)
+	}
+
+	return positional[0], *through, nil
+}
+
+// importArgs parses the arguments of the import command, the tool, the
+// version table and the directories of migrations
+func importArgs(args []string) (pgit.MigrationTool, string, []string, error) {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	from := flags.String("from", "", "tool the migrations are from, golang-migrate, goose or flyway")
+	versionTable := flags.String("version-table", "", "name of the version table of the tool, when it is not the default")
+
+	dirs, err := commandArgs(flags, args)
+
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if *from == "" || len(dirs) == 0 {
+		return "", "", nil, fmt.Errorf("expected -from and at least one directory")
+	}
+
+	return pgit.MigrationTool(*from), *versionTable, dirs, nil
+}
+
+// importMigrations converts the migrations of another tool into changeset
+// files and, when connected to a database, records the migrations the tool
+// applied as applied
+func importMigrations(r *reporter, instance *pgit.Pgit, tool pgit.MigrationTool, dirs []string) {
+	paths, err := instance.Import(tool, dirs...)
+
+	if err != nil {
+		r.fail(errorCode(err, exitError), "Error importing migrations", err)
+	}
+
+	if !r.json {
+		for _, path := range paths {
+			fmt.Printf("Created %v\n", path)
+		}
+	}
+	r.exit(&importReport{Paths: paths}, exitOK, "", nil)
+}
+
+// exportScript prints the psql script returned by export, or only a message
+// to standard error when there is nothing to apply so that the output can be
+// redirected to a file
+func exportScript(r *reporter, export func() (string, error)) {
+	script, err := export()
+
+	if err != nil {
+		r.fail(errorCode(err, exitError), "Error exporting the deploy script", err)
+	}
+
+	if !r.json {
+		if script == "" {
+			fmt.Fprintln(os.Stderr, "The database is up to date, there is nothing to export")
+		}
+		fmt.Print(script)
+	}
+	r.exit(&exportReport{Script: script}, exitOK, "", nil)
+}
+
+// readState reads a JSON object mapping the path of each file, relative to
+// the git root, to its version in the database
+func readState(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]string)
+
+	if err := json.Unmarshal(content, &versions); err != nil {
+		return nil, fmt.Errorf("invalid state file %v: %v", path, err)
+	}
+
+	return versions, nil
+}
+
+// loadConfig reads the config file at path, or the one found in the working
+// directory or git root when path is empty. An empty config is returned when
+// there is no config file.
+func loadConfig(path string) (*pgit.Config, error) {
+	if path == "" {
+		path = os.Getenv("PGIT_CONFIG")
+	}
+
+	if path == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		if path, err = pgit.FindConfig(wd); err != nil {
+			return nil, err
+		}
+	}
+
+	if path == "" {
+		return &pgit.Config{}, nil
+	}
+
+	return pgit.LoadConfig(path)
+}
+
+// shellHooks returns options registering the shell commands configured for a
+// hook phase. The details of the event are passed to the commands in
+// PGIT_HOOK_* environment variables and their output is written to output.
+func shellHooks(phase pgit.HookPhase, commands []string, output io.Writer) []pgit.Option {
+	options := make([]pgit.Option, len(commands))
+
+	for i, command := range commands {
+		command := command
+		options[i] = pgit.Hook(phase, func(event pgit.HookEvent) error {
+			cmd := exec.Command("sh", "-c", command)
+			cmd.Stdout = output
+			cmd.Stderr = os.Stderr
+			cmd.Env = append(
+				os.Environ(),
+				"PGIT_HOOK_PHASE="+string(event.Phase),
+				fmt.Sprintf("PGIT_HOOK_MIGRATION_ID=%v", event.MigrationID),
+				"PGIT_HOOK_PATH="+event.Path,
+				"PGIT_HOOK_FROM_VERSION="+event.FromVersion,
+				"PGIT_HOOK_TO_VERSION="+event.ToVersion,
+			)
+
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("command %q failed: %v", command, err)
+			}
+
+			return nil
+		})
+	}
+
+	return options
+}
+
+// readVariables returns the template variables from the config file, then
+// the variables file, then PGIT_VAR_<name> environment variables and then
+// -var flags, with later sources taking precedence
+func readVariables(config map[string]string, path string, flags variableFlags) (map[string]string, error) {
+	variables := make(map[string]string)
+
+	for key, value := range config {
+		variables[key] = value
+	}
+
+	if path != "" {
+		file, err := os.Open(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for lineNumber := 1; scanner.Scan(); lineNumber++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			i := strings.Index(line, "=")
+			if i < 1 {
+				return nil, fmt.Errorf("%v:%v: expected key=value", path, lineNumber)
+			}
+			variables[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, "PGIT_VAR_") {
+			i := strings.Index(env, "=")
+			variables[env[len("PGIT_VAR_"):i]] = env[i+1:]
+		}
+	}
+
+	for key, value := range flags {
+		variables[key] = value
+	}
+
+	return variables, nil
 }
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/chriscasola/pgit"
+	"github.com/pkg/errors"
+)
+
+// reportVersion is the version of the JSON documents written with -output
+// json. It changes only when a field is removed or changes meaning.
+const reportVersion = 1
+
+// Exit codes, one for each class of failure
+const (
+	exitOK              = 0
+	exitError           = 1
+	exitUsage           = 2
+	exitConfig          = 3
+	exitInvalidSchema   = 4
+	exitConnection      = 5
+	exitLocked          = 6
+	exitMigrationFailed = 7
+	exitTestsFailed     = 8
+	exitDestructive     = 9
+	exitLint            = 10
+	exitRollbackFailed  = 11
+	exitDrift           = 12
+)
+
+// exitClasses names the class of failure of each exit code in JSON reports
+var exitClasses = map[int]string{
+	exitError:           "error",
+	exitUsage:           "usage",
+	exitConfig:          "config",
+	exitInvalidSchema:   "invalid-schema",
+	exitConnection:      "connection",
+	exitLocked:          "locked",
+	exitMigrationFailed: "migration-failed",
+	exitTestsFailed:     "tests-failed",
+	exitDestructive:     "destructive",
+	exitLint:            "lint",
+	exitRollbackFailed:  "rollback-failed",
+	exitDrift:           "drift",
+}
+
+// errorCode returns the exit code for an error returned by pgit, or fallback
+// when the error has no class of its own
+func errorCode(err error, fallback int) int {
+	switch errors.Cause(err).(type) {
+	case pgit.ParseErrors, *pgit.ParseError:
+		return exitInvalidSchema
+	case *pgit.DestructiveError:
+		return exitDestructive
+	}
+
+	if errors.Cause(err) == pgit.ErrLocked {
+		return exitLocked
+	}
+
+	return fallback
+}
+
+// report is a JSON document written with -output json
+type report interface {
+	header() *reportHeader
+}
+
+// reportHeader holds the fields shared by every JSON report
+type reportHeader struct {
+	Version  int          `json:"version"`
+	Command  string       `json:"command"`
+	OK       bool         `json:"ok"`
+	ExitCode int          `json:"exit_code"`
+	Error    *reportError `json:"error"`
+}
+
+func (h *reportHeader) header() *reportHeader {
+	return h
+}
+
+type reportError struct {
+	Class   string `json:"class"`
+	Message string `json:"message"`
+}
+
+// migrationReport is the report of the migrate and rollback commands
+type migrationReport struct {
+	reportHeader
+	MigrationID int             `json:"migration_id"`
+	DurationMS  float64         `json:"duration_ms"`
+	Files       []*fileResult   `json:"files"`
+	Warnings    []reportWarning `json:"warnings"`
+}
+
+// File statuses in migration reports
+const (
+	fileApplied    = "applied"
+	fileRolledBack = "rolled-back"
+	fileFailed     = "failed"
+	fileSkipped    = "skipped"
+)
+
+type fileResult struct {
+	Path        string  `json:"path"`
+	Status      string  `json:"status"`
+	FromVersion string  `json:"from_version"`
+	ToVersion   string  `json:"to_version"`
+	DurationMS  float64 `json:"duration_ms"`
+	Message     string  `json:"message,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+type reportWarning struct {
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// planReport is the report of the plan command
+type planReport struct {
+	reportHeader
+	Steps []planStep `json:"steps"`
+}
+
+type planStep struct {
+	Path          string   `json:"path"`
+	FromVersion   string   `json:"from_version"`
+	ToVersion     string   `json:"to_version"`
+	SQL           string   `json:"sql"`
+	NoTransaction bool     `json:"no_transaction"`
+	Destructive   []string `json:"destructive"`
+}
+
+// statusReport is the report of the status command
+type statusReport struct {
+	reportHeader
+	Items   []statusItem   `json:"items"`
+	Summary map[string]int `json:"summary"`
+}
+
+type statusItem struct {
+	Path        string   `json:"path"`
+	Change      string   `json:"change,omitempty"`
+	State       string   `json:"state"`
+	Destructive []string `json:"destructive"`
+}
+
+// historyReport is the report of the history command
+type historyReport struct {
+	reportHeader
+	Migrations []historyMigration `json:"migrations"`
+}
+
+type historyMigration struct {
+	ID         int           `json:"id"`
+	Completed  bool          `json:"completed"`
+	StartedAt  *time.Time    `json:"started_at"`
+	FinishedAt *time.Time    `json:"finished_at"`
+	Files      []historyFile `json:"files"`
+}
+
+type historyFile struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// testReport is the report of the test command
+type testReport struct {
+	reportHeader
+	Results []testResult `json:"results"`
+}
+
+type testResult struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// validateReport is the report of the validate command
+type validateReport struct {
+	reportHeader
+	Errors []validateError `json:"errors"`
+}
+
+type validateError struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// lintReport is the report of the lint command
+type lintReport struct {
+	reportHeader
+	Findings []lintFinding `json:"findings"`
+}
+
+type lintFinding struct {
+	Path     string        `json:"path"`
+	Change   string        `json:"change,omitempty"`
+	Line     int           `json:"line"`
+	Rule     string        `json:"rule"`
+	Severity pgit.Severity `json:"severity"`
+	Message  string        `json:"message"`
+}
+
+// verifyReport is the report of the verify-rollbacks command
+type verifyReport struct {
+	reportHeader
+	Results []verifyResult `json:"results"`
+}
+
+type verifyResult struct {
+	Path        string   `json:"path"`
+	Change      string   `json:"change,omitempty"`
+	FromVersion string   `json:"from_version"`
+	ToVersion   string   `json:"to_version"`
+	Result      string   `json:"result"`
+	Missing     []string `json:"missing"`
+	Extra       []string `json:"extra"`
+	Message     string   `json:"message,omitempty"`
+}
+
+// driftReport is the report of the drift command
+type driftReport struct {
+	reportHeader
+	Missing []string `json:"missing"`
+	Extra   []string `json:"extra"`
+	Diff    []string `json:"diff"`
+}
+
+// exportReport is the report of the export-script command
+type exportReport struct {
+	reportHeader
+	Script string `json:"script"`
+}
+
+// importReport is the report of the import and import-definitions commands
+type importReport struct {
+	reportHeader
+	Paths []string `json:"paths"`
+}
+
+// newReport is the report of the new command
+type newReport struct {
+	reportHeader
+	Path string `json:"path"`
+}
+
+// squashReport is the report of the squash command
+type squashReport struct {
+	reportHeader
+	Path    string `json:"path"`
+	Through int    `json:"through"`
+}
+
+// reporter finishes a command by writing its report, as text or as JSON, and
+// exiting with the code for its outcome
+type reporter struct {
+	json    bool
+	command string
+}
+
+// exit writes the report and exits with code
+func (r *reporter) exit(rep report, code int, message string, err error) {
+	r.write(os.Stdout, rep, code, message, err)
+	os.Exit(code)
+}
+
+// write fills in the header of the report and writes it to w. In text mode
+// the report has already been printed by the command and only the error
+// message is written.
+func (r *reporter) write(w io.Writer, rep report, code int, message string, err error) {
+	h := rep.header()
+	h.Version, h.Command, h.ExitCode, h.OK = reportVersion, r.command, code, code == exitOK
+
+	if code != exitOK {
+		if err != nil {
+			message = fmt.Sprintf("%v: %v", message, err)
+		}
+		h.Error = &reportError{Class: exitClasses[code], Message: message}
+		if !r.json {
+			fmt.Fprintln(w, message)
+		}
+	}
+
+	if r.json {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(rep)
+	}
+}
+
+// fail exits with code after a failure that has no report of its own
+func (r *reporter) fail(code int, message string, err error) {
+	r.exit(&reportHeader{}, code, message, err)
+}
+
+// eventRecorder builds the per-file results of a migration or rollback from
+// its events
+type eventRecorder struct {
+	report *migrationReport
+	files  map[string]*fileResult
+	failed int
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{
+		report: &migrationReport{Files: make([]*fileResult, 0), Warnings: make([]reportWarning, 0)},
+		files:  make(map[string]*fileResult),
+	}
+}
+
+func (r *eventRecorder) Notify(event pgit.Event) {
+	switch event.Type {
+	case pgit.MigrationStarted, pgit.RollbackStarted:
+		r.report.MigrationID = event.MigrationID
+	case pgit.MigrationFinished, pgit.RollbackFinished:
+		r.report.DurationMS = milliseconds(event.Duration)
+	case pgit.Warning:
+		r.report.Warnings = append(r.report.Warnings, reportWarning{Path: event.Path, Message: event.Message})
+	case pgit.FileApplied, pgit.FileRolledBack:
+		f := r.file(event)
+		f.Status, f.ToVersion = fileApplied, event.ToVersion
+		if event.Type == pgit.FileRolledBack {
+			f.Status = fileRolledBack
+		}
+		f.DurationMS += milliseconds(event.Duration)
+	case pgit.FileFailed:
+		f := r.file(event)
+		f.Status, f.Message = fileFailed, event.Message
+		f.DurationMS += milliseconds(event.Duration)
+		if event.Err != nil {
+			f.Error = event.Err.Error()
+		}
+		r.failed++
+	case pgit.FileSkipped:
+		f := r.file(event)
+		f.Status, f.Message = fileSkipped, event.Message
+	}
+}
+
+// file returns the result for the file of an event. A file applied in
+// several steps has a single result from its first to its last version.
+func (r *eventRecorder) file(event pgit.Event) *fileResult {
+	f, ok := r.files[event.Path]
+	if !ok {
+		f = &fileResult{Path: event.Path, FromVersion: event.FromVersion, ToVersion: event.FromVersion}
+		r.files[event.Path] = f
+		r.report.Files = append(r.report.Files, f)
+	}
+	return f
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/chriscasola/pgit"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, exitInvalidSchema, errorCode(errors.Wrap(pgit.ParseErrors{}, "failed"), exitError), "should classify invalid schemas")
+	assert.Equal(t, exitInvalidSchema, errorCode(&pgit.ParseError{}, exitError), "should classify a single parse error")
+	assert.Equal(t, exitDestructive, errorCode(errors.Wrap(&pgit.DestructiveError{}, "refused"), exitError), "should classify destructive changes")
+	assert.Equal(t, exitLocked, errorCode(errors.Wrap(pgit.ErrLocked, "unable to take advisory lock"), exitError), "should classify a held lock")
+	assert.Equal(t, exitMigrationFailed, errorCode(errors.New("boom"), exitMigrationFailed), "should fall back for other errors")
+}
+
+func TestEventRecorder(t *testing.T) {
+	r := newEventRecorder()
+	failure := errors.New("syntax error")
+
+	for _, event := range []pgit.Event{
+		{Type: pgit.MigrationStarted, MigrationID: 3},
+		{Type: pgit.FileApplied, MigrationID: 3, Path: "users.sql", FromVersion: "1", ToVersion: "2", Duration: time.Millisecond},
+		{Type: pgit.FileApplied, MigrationID: 3, Path: "users.sql", FromVersion: "2", ToVersion: "3", Duration: 2 * time.Millisecond},
+		{Type: pgit.Warning, MigrationID: 3, Path: "orders.sql", Message: "applying uncommitted file"},
+		{Type: pgit.FileFailed, MigrationID: 3, Path: "orders.sql", Message: "unable to apply update for file", Err: failure},
+		{Type: pgit.FileSkipped, Path: "seeds.sql", Message: "not enabled for this environment"},
+		{Type: pgit.MigrationFinished, MigrationID: 3, Duration: 5 * time.Millisecond},
+	} {
+		r.Notify(event)
+	}
+
+	assert.Equal(t, &migrationReport{
+		MigrationID: 3,
+		DurationMS:  5,
+		Files: []*fileResult{
+			{Path: "users.sql", Status: fileApplied, FromVersion: "1", ToVersion: "3", DurationMS: 3},
+			{Path: "orders.sql", Status: fileFailed, Message: "unable to apply update for file", Error: "syntax error"},
+			{Path: "seeds.sql", Status: fileSkipped, Message: "not enabled for this environment"},
+		},
+		Warnings: []reportWarning{{Path: "orders.sql", Message: "applying uncommitted file"}},
+	}, r.report, "should combine the steps of a file into one result")
+	assert.Equal(t, 1, r.failed, "should count the failed files")
+
+	r = newEventRecorder()
+	r.Notify(pgit.Event{Type: pgit.FileRolledBack, Path: "users.sql", FromVersion: "3", ToVersion: "2"})
+	assert.Equal(t, fileRolledBack, r.report.Files[0].Status, "should report rolled back files")
+}
+
+func TestReporter(t *testing.T) {
+	var out bytes.Buffer
+
+	r := &reporter{json: true, command: "export-script"}
+	r.write(&out, &exportReport{Script: "BEGIN;\nCOMMIT;\n"}, exitOK, "", nil)
+
+	assert.Equal(t, `{
+  "version": 1,
+  "command": "export-script",
+  "ok": true,
+  "exit_code": 0,
+  "error": null,
+  "script": "BEGIN;\nCOMMIT;\n"
+}
+`, out.String(), "should write the header and the fields of the report")
+
+	out.Reset()
+	r = &reporter{json: true, command: "migrate"}
+	r.write(&out, newEventRecorder().report, exitLocked, "unable to migrate", pgit.ErrLocked)
+
+	assert.Equal(t, `{
+  "version": 1,
+  "command": "migrate",
+  "ok": false,
+  "exit_code": 6,
+  "error": {
+    "class": "locked",
+    "message": "unable to migrate: another migration holds the advisory lock"
+  },
+  "migration_id": 0,
+  "duration_ms": 0,
+  "files": [],
+  "warnings": []
+}
+`, out.String(), "should report the class of the failure")
+
+	out.Reset()
+	r = &reporter{command: "migrate"}
+	r.write(&out, &reportHeader{}, exitConfig, "unable to load config", errors.New("no such file"))
+
+	assert.Equal(t, "unable to load config: no such file\n", out.String(), "should only print the error in text mode")
+}
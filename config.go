@@ -0,0 +1,165 @@
+package pgit
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileNames are the names of the config files pgit looks for, in order
+// of preference
+var configFileNames = []string{"pgit.yaml", "pgit.yml", "pgit.toml"}
+
+// Config holds the settings read from a pgit.yaml or pgit.toml file
+type Config struct {
+	// Database is the URL of the database. ${NAME} is replaced with the value
+	// of the environment variable NAME.
+	Database string `yaml:"database"`
+	// Root is the directory containing the schema files, relative to the
+	// directory of the config file
+	Root string `yaml:"root"`
+	// Table is the name of the table used to track the migration state
+	Table       string            `yaml:"table"`
+	Environment string            `yaml:"environment"`
+	Variables   map[string]string `yaml:"variables"`
+	Lock        LockConfig        `yaml:"lock"`
+	Timeouts    TimeoutConfig     `yaml:"timeouts"`
+	Hooks       HookConfig        `yaml:"hooks"`
+	Lint        LintConfig        `yaml:"lint"`
+
+	// Path is the path of the file the config was read from
+	Path string `yaml:"-"`
+}
+
+// LockConfig configures the advisory lock taken while migrating so that two
+// migrations cannot run against the same database at the same time
+type LockConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Key     int64         `yaml:"key"`
+	Wait    time.Duration `yaml:"wait"`
+}
+
+// TimeoutConfig sets the statement_timeout and lock_timeout used while
+// migrating
+type TimeoutConfig struct {
+	Statement time.Duration `yaml:"statement"`
+	Lock      time.Duration `yaml:"lock"`
+}
+
+// HookConfig lists shell commands to run around migrations and rollbacks
+type HookConfig struct {
+	BeforeMigrate  []string `yaml:"before-migrate"`
+	AfterEachFile  []string `yaml:"after-each-file"`
+	AfterMigrate   []string `yaml:"after-migrate"`
+	BeforeRollback []string `yaml:"before-rollback"`
+	AfterRollback  []string `yaml:"after-rollback"`
+}
+
+// LintConfig configures the lint command
+type LintConfig struct {
+	// Rules sets the severity of rules by name to error, warning or off
+	Rules map[string]Severity `yaml:"rules"`
+}
+
+// FindConfig returns the path of the config file in dir or, failing that, in
+// the root of the git repository containing dir. It returns an empty string
+// when there is no config file.
+func FindConfig(dir string) (string, error) {
+	dirs := []string{dir}
+
+	if gitRoot, err := getGitRoot(dir); err == nil {
+		dirs = append(dirs, gitRoot)
+	}
+
+	for _, d := range dirs {
+		for _, name := range configFileNames {
+			path := filepath.Join(d, name)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			} else if !os.IsNotExist(err) {
+				return "", errors.Wrapf(err, "unable to read config file %v", path)
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// LoadConfig reads the config file at path. Files ending in .toml are read as
+// TOML and all others as YAML.
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read config file %v", path)
+	}
+
+	if strings.HasSuffix(path, ".toml") {
+		values := make(map[string]interface{})
+		if _, err := toml.Decode(string(content), &values); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse config file %v", path)
+		}
+		// the values are converted to YAML so that both formats share the
+		// same field names and decoding
+		if content, err = yaml.Marshal(values); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse config file %v", path)
+		}
+	}
+
+	config := &Config{}
+	decoder := yaml.NewDecoder(strings.NewReader(string(content)))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "unable to parse config file %v", path)
+	}
+
+	config.Path = path
+
+	if config.Database, err = expandEnv(config.Database); err != nil {
+		return nil, errors.Wrapf(err, "invalid database in config file %v", path)
+	}
+
+	for rule, severity := range config.Lint.Rules {
+		if severity != SeverityError && severity != SeverityWarning && severity != SeverityOff {
+			return nil, errors.Errorf("invalid severity %q for lint rule %v in config file %v, expected error, warning or off", severity, rule, path)
+		}
+	}
+
+	if config.Root != "" && !filepath.IsAbs(config.Root) {
+		config.Root = filepath.Join(filepath.Dir(path), config.Root)
+	}
+
+	return config, nil
+}
+
+var envReferenceRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} with the value of the environment variable NAME,
+// returning an error if it is not set
+func expandEnv(value string) (string, error) {
+	var missing []string
+
+	expanded := envReferenceRegexp.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReferenceRegexp.FindStringSubmatch(reference)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+
+	if len(missing) > 0 {
+		return "", errors.Errorf("environment variable %v is not set", strings.Join(missing, ", "))
+	}
+
+	return expanded, nil
+}
@@ -1,6 +1,8 @@
 package pgit
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"os/exec"
@@ -19,6 +21,23 @@ type definitionFile struct {
 	gitRoot string
 	path    string
 	content []byte
+
+	// variables are the values used to fill in the placeholders of a
+	// definition file that is a template
+	variables map[string]string
+
+	// scripts generates the SQL for moving between two revisions of the
+	// file. When nil the definition and rollback blocks of the file are used.
+	scripts revisionScripts
+}
+
+// revisionScripts is implemented by file types that reuse the git history
+// tracking of definitionFile but generate their SQL differently
+type revisionScripts interface {
+	// transitionSQL returns the SQL that replaces the revision of the file
+	// with content from by the revision with content to. Either may be
+	// empty when there is no such revision.
+	transitionSQL(from, to []byte) (string, error)
 }
 
 func (d *definitionFile) getPath() string {
@@ -39,13 +58,19 @@ func (d *definitionFile) parse(fileContent []byte) (string, string, error) {
 		return "", "", errors.New("empty file")
 	}
 
+	quoted, err := quotedLines(string(fileContent))
+
+	if err != nil {
+		return "", "", inFile(err, d.path)
+	}
+
 	definition, rollback := "", ""
 	inDefinition, inRollback := false, false
 
 	for i := 0; i < len(lines); i++ {
-		if lines[i] == definitionAnnotation {
+		if lines[i] == definitionAnnotation && !quoted[i+1] {
 			inDefinition = true
-		} else if lines[i] == rollbackAnnotation {
+		} else if lines[i] == rollbackAnnotation && !quoted[i+1] {
 			inRollback = true
 			inDefinition = false
 		} else if inDefinition {
@@ -56,16 +81,52 @@ func (d *definitionFile) parse(fileContent []byte) (string, string, error) {
 	}
 
 	if len(definition) == 0 {
-		return "", "", errors.New("must specify a definition")
+		return "", "", &ParseError{
+			Path:    d.path,
+			Line:    1,
+			Column:  1,
+			Message: "must specify a definition",
+			Hint:    "add a " + definitionAnnotation + " block",
+		}
 	}
 
 	if len(rollback) == 0 {
-		return "", "", errors.New("must specify a rollback")
+		return "", "", &ParseError{
+			Path:    d.path,
+			Line:    len(lines),
+			Column:  1,
+			Message: "must specify a rollback",
+			Hint:    "add a " + rollbackAnnotation + " block after the definition",
+		}
 	}
 
 	return definition, rollback, nil
 }
 
+// blockLines returns the lines of the file on which the definition and the
+// rollback SQL begin
+func (d *definitionFile) blockLines(fileContent []byte) (int, int, error) {
+	lines := strings.Split(strings.Replace(string(fileContent), "\r\n", "\n", -1), "\n")
+
+	quoted, err := quotedLines(string(fileContent))
+
+	if err != nil {
+		return 0, 0, inFile(err, d.path)
+	}
+
+	definitionLine, rollbackLine := 0, 0
+
+	for i, line := range lines {
+		if line == definitionAnnotation && !quoted[i+1] && definitionLine == 0 {
+			definitionLine = i + 2
+		} else if line == rollbackAnnotation && !quoted[i+1] && rollbackLine == 0 {
+			rollbackLine = i + 2
+		}
+	}
+
+	return definitionLine, rollbackLine, nil
+}
+
 var shaRegexp = regexp.MustCompile(`^([a-fA-F0-9]{40})\s*`)
 
 func (d *definitionFile) getCurrentSHA() (string, error) {
@@ -84,8 +145,7 @@ func (d *definitionFile) getCurrentSHA() (string, error) {
 
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			fmt.Printf("git command error: %v", string(exitErr.Stderr))
-			return "", errors.Wrapf(err, "git command failure: %v", exitErr.Error())
+			return "", errors.Wrapf(err, "git command failure: %v", strings.TrimSpace(string(exitErr.Stderr)))
 		}
 		return "", errors.Wrap(err, "git command failed")
 	}
@@ -99,49 +159,202 @@ func (d *definitionFile) getCurrentSHA() (string, error) {
 	return tokens[1], nil
 }
 
+// fileVersion returns the version recorded for the file at the given commit.
+// When the file is a template a hash of the rendered SQL is added to the
+// commit so that changing the value of a variable also changes the version.
+func (d *definitionFile) fileVersion(commit string, content []byte) (string, error) {
+	if d.scripts != nil || !isTemplate(content) {
+		return commit, nil
+	}
+
+	rendered, err := renderTemplate(d.path, content, d.variables)
+
+	if err != nil {
+		return "", err
+	}
+
+	return commit + "+" + fmt.Sprintf("%x", sha256.Sum256(rendered))[:12], nil
+}
+
+// withoutHeader returns the content of a file from git without its first
+// line, which holds the file type, as the content is read from disk
+func withoutHeader(content []byte) []byte {
+	if i := bytes.IndexAny(content, "\r\n"); i != -1 {
+		return content[i:]
+	}
+	return content
+}
+
+// versionCommit returns the commit of a version returned by fileVersion
+func versionCommit(version string) string {
+	if i := strings.Index(version, "+"); i != -1 {
+		return version[:i]
+	}
+	return version
+}
+
 func (d *definitionFile) getApplySQL(currentVersion string) (string, string, error) {
-	if currentVersion == uncommittedVersion {
-		fmt.Println("Cannot apply migration to an uncommitted version, please rollback the last migration first!")
-		return "", "", errors.New("cannot apply migration to an uncommitted version")
+	if versionCommit(currentVersion) == uncommittedVersion {
+		return "", "", errors.New("cannot apply migration to an uncommitted version, please rollback the last migration first")
 	}
 
-	fileVersion, err := d.getCurrentSHA()
+	commit, err := d.getCurrentSHA()
 
 	if err != nil {
 		return "", "", errors.Wrap(err, "unable to get current SHA of file")
 	}
 
+	fileVersion, err := d.fileVersion(commit, d.content)
+
+	if err != nil {
+		return "", "", err
+	}
+
 	if fileVersion == currentVersion {
 		return "", currentVersion, nil
 	}
 
-	if fileVersion == uncommittedVersion {
-		fmt.Printf("Applying uncommitted file %v, be sure to rollback before committing!\n", d.path)
+	var prevRevisionContent []byte
+
+	if currentVersion != "" {
+		prevRevisionContent, err = d.getFileAtCommit(versionCommit(currentVersion))
+		if err != nil {
+			return "", "", errors.Wrap(err, "unable to get previous version of file")
+		}
 	}
 
-	apply, _, err := d.parse(d.content)
+	sql, err := d.transitionSQL(prevRevisionContent, d.content)
 
 	if err != nil {
-		return "", "", errors.Wrap(err, "unable to parse file to get apply SQL")
+		return "", "", err
 	}
 
-	if currentVersion == "" {
-		return strings.TrimSpace(apply), fileVersion, nil
+	return sql, fileVersion, nil
+}
+
+// revisionSteps returns a step for every revision of the file after the
+// given version, oldest first, ending with the uncommitted content of the
+// file when it has been changed
+func (d *definitionFile) revisionSteps(currentVersion string) ([]applyStep, error) {
+	if versionCommit(currentVersion) == uncommittedVersion {
+		return nil, errors.New("cannot apply migration to an uncommitted version, please rollback the last migration first")
+	}
+
+	commit, err := d.getCurrentSHA()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get current SHA of file")
+	}
+
+	commits, err := d.getFileCommits()
+
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]string, 0)
+	found := currentVersion == ""
+
+	for _, c := range commits {
+		if c == versionCommit(currentVersion) {
+			found = true
+			break
+		}
+		revisions = append([]string{c}, revisions...)
+	}
+
+	if commit == uncommittedVersion {
+		revisions = append(revisions, uncommittedVersion)
 	}
 
-	prevRevisionContent, err := d.getFileAtCommit(currentVersion)
+	if !found || len(revisions) == 0 {
+		// the recorded version is not in the history of the file, or only
+		// the values of its variables changed
+		return getApplySteps(d, currentVersion)
+	}
+
+	var previous []byte
+
+	if currentVersion != "" {
+		if previous, err = d.getFileAtCommit(versionCommit(currentVersion)); err != nil {
+			return nil, errors.Wrap(err, "unable to get previous version of file")
+		}
+	}
+
+	steps := make([]applyStep, 0, len(revisions))
+
+	for _, revision := range revisions {
+		content := d.content
+		if revision != uncommittedVersion {
+			if content, err = d.getFileAtCommit(revision); err != nil {
+				return nil, errors.Wrapf(err, "unable to get revision %v of file", revision)
+			}
+		}
+
+		sql, err := d.transitionSQL(previous, content)
+
+		if err != nil {
+			return nil, err
+		}
+
+		version, err := d.fileVersion(revision, withoutHeader(content))
+
+		if err != nil {
+			return nil, err
+		}
+
+		steps = append(steps, applyStep{sql: sql, version: version})
+		previous = content
+	}
+
+	return steps, nil
+}
+
+// transitionSQL returns the SQL to replace the revision of the file with
+// content from by the revision with content to, both rendered with the
+// values of the variables
+func (d *definitionFile) transitionSQL(from, to []byte) (string, error) {
+	if d.scripts != nil {
+		return d.scripts.transitionSQL(from, to)
+	}
+
+	blocks := make([]string, 0, 2)
+
+	from, err := renderTemplate(d.path, from, d.variables)
 
 	if err != nil {
-		return "", "", errors.Wrap(err, "unable to get previous version of file")
+		return "", errors.Wrap(err, "unable to render previous version of file")
 	}
 
-	_, rollback, err := d.parse(prevRevisionContent)
+	to, err = renderTemplate(d.path, to, d.variables)
 
 	if err != nil {
-		return "", "", errors.Wrap(err, "unable to get rollback SQL from previous version of file")
+		return "", errors.Wrap(err, "unable to render file")
+	}
+
+	if len(from) > 0 {
+		_, rollback, err := d.parse(from)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to get rollback SQL from previous version of file")
+		}
+		blocks = append(blocks, rollback)
 	}
 
-	return strings.TrimSpace(rollback) + ";\n" + strings.TrimSpace(apply), fileVersion, nil
+	if len(to) > 0 {
+		apply, _, err := d.parse(to)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to parse file to get apply SQL")
+		}
+		blocks = append(blocks, apply)
+	}
+
+	sql, err := joinStatements(blocks...)
+
+	if err != nil {
+		return "", errors.Wrap(err, "unable to split rollback and apply SQL into statements")
+	}
+
+	return sql, nil
 }
 
 func (d *definitionFile) getRollbackSQL(currentVersion string) (string, string, error) {
@@ -149,6 +362,8 @@ func (d *definitionFile) getRollbackSQL(currentVersion string) (string, string,
 		return "", "", nil
 	}
 
+	currentVersion = versionCommit(currentVersion)
+
 	commits, err := d.getFileCommits()
 	if err != nil {
 		return "", "", err
@@ -188,27 +403,60 @@ func (d *definitionFile) getRollbackSQL(currentVersion string) (string, string,
 		}
 	}
 
-	apply, rollback := "", ""
+	if len(currentFileContent) == 0 {
+		return "", strings.TrimSpace(previousVersion), nil
+	}
 
-	if len(previousFileContent) > 0 {
-		apply, _, err = d.parse(previousFileContent)
-		if err != nil {
-			return "", "", err
-		}
+	sql, err := d.transitionSQL(currentFileContent, previousFileContent)
+
+	if err != nil {
+		return "", "", err
 	}
 
-	if len(currentFileContent) > 0 {
-		_, rollback, err = d.parse(currentFileContent)
-		if err != nil {
-			return "", "", err
+	return sql, previousVersion, nil
+}
+
+// getRollbackSteps returns the step that replaces the revision of the file
+// recorded by the migration being rolled back with the revision recorded
+// before it. The values of the variables are not recorded, so both revisions
+// are rendered with the current values.
+func (d *definitionFile) getRollbackSteps(currentVersion, previousVersion string) ([]applyStep, error) {
+	if currentVersion == previousVersion {
+		return nil, nil
+	}
+
+	var current, previous []byte
+	var err error
+
+	if versionCommit(currentVersion) == uncommittedVersion {
+		current, err = ioutil.ReadFile(filepath.Join(d.gitRoot, d.path))
+	} else if currentVersion != "" {
+		current, err = d.getFileAtCommit(versionCommit(currentVersion))
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get applied version of file")
+	}
+
+	if previousVersion != "" {
+		if previous, err = d.getFileAtCommit(versionCommit(previousVersion)); err != nil {
+			return nil, errors.Wrap(err, "unable to get previous version of file")
 		}
 	}
 
-	if len(previousFileContent) > 0 && len(currentFileContent) > 0 {
-		return strings.TrimSpace(rollback) + ";\n" + strings.TrimSpace(apply), previousVersion, nil
+	sql, err := d.transitionSQL(current, previous)
+
+	if err != nil {
+		return nil, err
+	}
+
+	destructive, err := destructiveOperations(sql)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to classify rollback SQL")
 	}
 
-	return strings.TrimSpace(rollback), strings.TrimSpace(previousVersion), nil
+	return []applyStep{{sql: sql, version: previousVersion, destructive: destructive}}, nil
 }
 
 func (d *definitionFile) getFileCommits() ([]string, error) {
@@ -239,8 +487,7 @@ func (d *definitionFile) getFileAtCommit(version string) ([]byte, error) {
 
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			fmt.Printf("git command error: %v", string(exitErr.Stderr))
-			return result, errors.Wrapf(err, "git command failure: %v", exitErr.Error())
+			return result, errors.Wrapf(err, "git command failure: %v", strings.TrimSpace(string(exitErr.Stderr)))
 		}
 		return result, errors.Wrap(err, "git command failed")
 	}
@@ -174,7 +174,7 @@ DROP FUNCTION func (text, text, text);
 		assert.NoError(t, err, "should not error when getting apply SQL")
 		assert.Equal(
 			t,
-			"DROP FUNCTION func (text, text);;\nCREATE FUNCTION func (text, text, text);",
+			"DROP FUNCTION func (text, text);\nCREATE FUNCTION func (text, text, text);",
 			sql,
 			"should return apply SQL",
 		)
@@ -193,7 +193,7 @@ DROP FUNCTION func (text, text, text);
 		assert.NoError(t, err, "should not error when getting rollback SQL")
 		assert.Equal(
 			t,
-			"DROP FUNCTION func (text, text, text);;\nCREATE FUNCTION func (text, text);",
+			"DROP FUNCTION func (text, text, text);\nCREATE FUNCTION func (text, text);",
 			sql,
 			"should return rollback SQL",
 		)
@@ -219,7 +219,7 @@ DROP FUNCTION func (text, text, text, text);
 		assert.NoError(t, err, "should not error when getting apply SQL")
 		assert.Equal(
 			t,
-			"DROP FUNCTION func (text, text, text);;\nCREATE FUNCTION func (text, text, text, text);",
+			"DROP FUNCTION func (text, text, text);\nCREATE FUNCTION func (text, text, text, text);",
 			sql,
 			"should return apply SQL",
 		)
@@ -237,13 +237,36 @@ DROP FUNCTION func (text, text, text, text);
 		assert.NoError(t, err, "should not error when getting rollback SQL")
 		assert.Equal(
 			t,
-			"DROP FUNCTION func (text, text, text, text);;\nCREATE FUNCTION func (text, text, text);",
+			"DROP FUNCTION func (text, text, text, text);\nCREATE FUNCTION func (text, text, text);",
 			sql,
 			"should return rollback SQL",
 		)
 		assert.Equal(t, secondVersion, version, "should rollback to second version")
 	})
 
+	t.Run("get revision steps", func(t *testing.T) {
+		fileContent, err := ioutil.ReadFile(filePath)
+		assert.NoError(t, err, "failed to read test file")
+
+		d := definitionFile{path: fileName, content: fileContent, gitRoot: gitRoot}
+
+		steps, err := d.revisionSteps("")
+
+		assert.NoError(t, err, "should not error when getting revision steps")
+		assert.Equal(t, []applyStep{
+			{sql: "CREATE FUNCTION func (text, text);", version: firstVersion},
+			{sql: "DROP FUNCTION func (text, text);\nCREATE FUNCTION func (text, text, text);", version: secondVersion},
+			{sql: "DROP FUNCTION func (text, text, text);\nCREATE FUNCTION func (text, text, text, text);", version: uncommittedVersion},
+		}, steps, "should return a step for every revision of the file")
+
+		steps, err = d.revisionSteps(secondVersion)
+
+		assert.NoError(t, err, "should not error when getting revision steps")
+		assert.Equal(t, []applyStep{
+			{sql: "DROP FUNCTION func (text, text, text);\nCREATE FUNCTION func (text, text, text, text);", version: uncommittedVersion},
+		}, steps, "should return the revisions after the current version")
+	})
+
 	t.Run("get apply SQL for second uncommitted version", func(t *testing.T) {
 		fileContent, err := ioutil.ReadFile(filePath)
 		assert.NoError(t, err, "failed to read test file")
@@ -0,0 +1,148 @@
+package pgit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DestructiveOperation is a statement that destroys data, such as DROP TABLE,
+// found in the SQL for a file
+type DestructiveOperation struct {
+	Path      string
+	Operation string
+}
+
+// DestructiveError is returned when a migration or rollback would run
+// destructive statements that were not approved. Nothing is run when it is
+// returned.
+type DestructiveError struct {
+	Operations []DestructiveOperation
+}
+
+func (e *DestructiveError) Error() string {
+	operations := make([]string, len(e.Operations))
+	for i, op := range e.Operations {
+		operations[i] = fmt.Sprintf("%v (%v)", op.Operation, op.Path)
+	}
+	return fmt.Sprintf(
+		"refusing to run destructive SQL: %v; annotate the change with -- change destructive or allow destructive changes",
+		strings.Join(operations, ", "),
+	)
+}
+
+// droppedObjects are the types of object whose DROP destroys data
+var droppedObjects = map[string]bool{
+	"DATABASE":  true,
+	"EXTENSION": true,
+	"OWNED":     true,
+	"SCHEMA":    true,
+	"SEQUENCE":  true,
+	"TABLE":     true,
+}
+
+// keptByDrop are the words following DROP in ALTER TABLE that remove
+// something other than a column
+var keptByDrop = map[string]bool{
+	"CONSTRAINT": true,
+	"DEFAULT":    true,
+	"EXPRESSION": true,
+	"IDENTITY":   true,
+	"NOT":        true,
+}
+
+// destructiveOperations returns the operations in a block of SQL that destroy
+// data: dropping tables, schemas and other objects holding data, dropping or
+// changing the type of columns, truncating tables and deleting every row.
+func destructiveOperations(sql string) ([]string, error) {
+	statements, err := splitStatements(sql)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var operations []string
+
+	for _, statement := range statements {
+		words, err := statementWords(statement.sql)
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, classifyStatement(words)...)
+	}
+
+	return operations, nil
+}
+
+// statementWords returns the upper-cased keywords and identifiers of a
+// statement, skipping strings and comments. Quoted identifiers are returned
+// as a single `"`.
+func statementWords(sql string) ([]string, error) {
+	l := newSQLLexer(sql)
+	words := make([]string, 0)
+
+	for !l.done() {
+		quotedIdentifier := l.peek(0) == '"'
+		word, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if quotedIdentifier {
+			word = `"`
+		}
+		if word != "" && word != ";" {
+			words = append(words, word)
+		}
+	}
+
+	return words, nil
+}
+
+// classifyStatement returns the destructive operations in a statement given
+// its words
+func classifyStatement(words []string) []string {
+	at := func(i int) string {
+		if i < len(words) {
+			return words[i]
+		}
+		return ""
+	}
+
+	switch at(0) {
+	case "DROP":
+		if droppedObjects[at(1)] {
+			return []string{"DROP " + at(1)}
+		}
+	case "TRUNCATE":
+		return []string{"TRUNCATE"}
+	case "DELETE":
+		if !containsString(words, "WHERE") {
+			return []string{"DELETE without WHERE"}
+		}
+	case "ALTER":
+		if at(1) != "TABLE" {
+			return nil
+		}
+		var operations []string
+		for i := 2; i < len(words); i++ {
+			switch words[i] {
+			case "DROP":
+				if !keptByDrop[at(i+1)] {
+					operations = append(operations, "DROP COLUMN")
+				}
+			case "ALTER":
+				// ALTER [COLUMN] name [SET DATA] TYPE
+				j := i + 1
+				if at(j) == "COLUMN" {
+					j++
+				}
+				j++
+				if at(j) == "TYPE" || (at(j) == "SET" && at(j+1) == "DATA" && at(j+2) == "TYPE") {
+					operations = append(operations, "ALTER COLUMN TYPE")
+				}
+			}
+		}
+		return operations
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package pgit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDestructiveOperations(t *testing.T) {
+	t.Run("destructive statements", func(t *testing.T) {
+		operations, err := destructiveOperations(`
+DROP TABLE IF EXISTS users;
+DROP SCHEMA audit CASCADE;
+ALTER TABLE users DROP COLUMN email, DROP "Name";
+ALTER TABLE ONLY users ALTER COLUMN age SET DATA TYPE smallint;
+ALTER TABLE users ALTER id TYPE int;
+TRUNCATE sessions;
+DELETE FROM sessions;`)
+
+		assert.NoError(t, err, "should classify statements")
+		assert.Equal(t, []string{
+			"DROP TABLE",
+			"DROP SCHEMA",
+			"DROP COLUMN",
+			"DROP COLUMN",
+			"ALTER COLUMN TYPE",
+			"ALTER COLUMN TYPE",
+			"TRUNCATE",
+			"DELETE without WHERE",
+		}, operations, "should return every destructive operation")
+	})
+
+	t.Run("non-destructive statements", func(t *testing.T) {
+		operations, err := destructiveOperations(`
+CREATE TABLE users (id int, type text);
+ALTER TABLE users ADD COLUMN type text, ALTER COLUMN id SET DEFAULT 1;
+ALTER TABLE users DROP CONSTRAINT users_pkey, ALTER COLUMN id DROP NOT NULL, ALTER id DROP DEFAULT;
+DROP INDEX users_id;
+DROP VIEW active_users;
+DROP FUNCTION f();
+DELETE FROM sessions WHERE expires < now();
+-- DROP TABLE users;
+SELECT 'DROP TABLE users';`)
+
+		assert.NoError(t, err, "should classify statements")
+		assert.Empty(t, operations, "should not return operations that keep data")
+	})
+}
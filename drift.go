@@ -0,0 +1,105 @@
+package pgit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SchemaDrift is the difference between a database and the schema its files
+// describe. Objects are described one per line in the format of the database
+// catalog snapshot, for example "column public.users.email text NOT NULL".
+type SchemaDrift struct {
+	// Missing are the objects created by the files that are not in the
+	// database
+	Missing []string
+	// Extra are the objects in the database that the files do not create,
+	// such as a hot fix made by hand
+	Extra []string
+}
+
+// HasDrift reports whether the database differs from the files
+func (d *SchemaDrift) HasDrift() bool {
+	return len(d.Missing) > 0 || len(d.Extra) > 0
+}
+
+// Diff returns the differences sorted by object, with missing objects
+// prefixed by "- " and extra objects by "+ ", so that a change to an object
+// appears as a pair of adjacent lines
+func (d *SchemaDrift) Diff() []string {
+	lines := make([]string, 0, len(d.Missing)+len(d.Extra))
+	for _, object := range d.Missing {
+		lines = append(lines, "- "+object)
+	}
+	for _, object := range d.Extra {
+		lines = append(lines, "+ "+object)
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool {
+		if lines[i][2:] != lines[j][2:] {
+			return lines[i][2:] < lines[j][2:]
+		}
+		return lines[i][0] == '-'
+	})
+
+	return lines
+}
+
+// drift migrates the empty shadow database to the latest version of the
+// schema and compares its catalog with the catalog of db. Only the hook files
+// are run on the shadow database, and destructive changes are allowed since
+// every change is applied from scratch.
+func (s *schemaDirectory) drift(db DatabaseConnection, shadow DatabaseConnection) (*SchemaDrift, error) {
+	shadowState, err := shadow.readMigrationState()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read migration state of the shadow database")
+	}
+
+	if len(shadowState.fileStates) > 0 {
+		return nil, errors.New("the shadow database has already been migrated, drift needs an empty database")
+	}
+
+	failures := make([]string, 0)
+
+	shadowSchema := &schemaDirectory{
+		gitRoot:          s.gitRoot,
+		root:             s.root,
+		files:            make(map[string]schemaFile),
+		state:            &migrationState{},
+		environment:      s.environment,
+		variables:        s.variables,
+		allowDestructive: true,
+		observer: ObserverFunc(func(event Event) {
+			if event.Type == FileFailed {
+				failures = append(failures, fmt.Sprintf("%v: %v: %v", event.Path, event.Message, event.Err))
+			}
+		}),
+	}
+
+	if err := shadowSchema.applyLatest(shadow); err != nil {
+		return nil, errors.Wrap(err, "unable to migrate the shadow database")
+	}
+
+	if len(failures) > 0 {
+		return nil, errors.Errorf("unable to migrate the shadow database: %v", strings.Join(failures, "; "))
+	}
+
+	expected, err := shadow.snapshotCatalog()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to snapshot the shadow database")
+	}
+
+	actual, err := db.snapshotCatalog()
+
+	if err != nil {
+		return nil, err
+	}
+
+	missing, extra := diffCatalogs(expected, actual)
+
+	return &SchemaDrift{Missing: missing, Extra: extra}, nil
+}
@@ -0,0 +1,24 @@
+package pgit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaDriftDiff(t *testing.T) {
+	drift := &SchemaDrift{
+		Missing: []string{"column public.users.email text NOT NULL", "index public.users_email CREATE UNIQUE INDEX users_email ON public.users USING btree (email)"},
+		Extra:   []string{"column public.users.email text", "function public.fix() 0cc175b9c0f1b6a831c399e269772661"},
+	}
+
+	assert.True(t, drift.HasDrift(), "should have drift")
+	assert.Equal(t, []string{
+		"+ column public.users.email text",
+		"- column public.users.email text NOT NULL",
+		"+ function public.fix() 0cc175b9c0f1b6a831c399e269772661",
+		"- index public.users_email CREATE UNIQUE INDEX users_email ON public.users USING btree (email)",
+	}, drift.Diff(), "should sort the differences by object")
+
+	assert.False(t, (&SchemaDrift{Missing: []string{}, Extra: []string{}}).HasDrift(), "should not have drift")
+}
@@ -0,0 +1,167 @@
+package pgit
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// exportScript returns a psql script that brings a database whose files are
+// at the versions in state up to date, recording the new versions in the
+// tables named after tableName as ApplyLatest would. The script runs in a
+// single transaction, which is committed before and begun again after each
+// step that cannot run inside of one, and stops if the recorded versions of
+// the files it changes differ from state. SQL hook files are included, but
+// not hooks registered with the Hook option. db is used by files that read
+// the database catalog, such as grants, and may be nil if there are none. An
+// empty script is returned when there is nothing to apply.
+func (s *schemaDirectory) exportScript(db DatabaseConnection, state *migrationState, tableName string) (string, error) {
+	if err := s.readFromDisk(); err != nil {
+		return "", errors.Wrap(err, "failed to populate schema from disk")
+	}
+
+	if tableName == "" {
+		tableName = "pgit"
+	}
+
+	s.state = state
+
+	if db != nil {
+		s.useDatabase(db)
+	} else {
+		for _, path := range s.sortedPaths() {
+			if _, ok := s.files[path].(*grantsFile); ok {
+				return "", errors.Errorf("%v reads the database catalog, export the script from the database instead", path)
+			}
+		}
+	}
+
+	if err := s.checkDestructive(); err != nil {
+		return "", err
+	}
+
+	migrationID := fmt.Sprintf("currval(pg_get_serial_sequence(%v, 'id'))", quoteLiteral(tableName+"_migrations"))
+
+	var body bytes.Buffer
+	expected := make([]string, 0)
+
+	for _, filePath := range s.sortedPaths() {
+		file := s.files[filePath]
+
+		if seed, ok := file.(*seedFile); ok && !seed.enabled {
+			continue
+		}
+
+		currentVersion := ""
+		if fileState, ok := s.state.fileStates[filePath]; ok {
+			currentVersion = fileState.version
+		}
+
+		steps, err := getApplySteps(file, currentVersion)
+
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to get SQL for applying update to %v", filePath)
+		}
+
+		if len(steps) == 0 {
+			continue
+		}
+
+		expected = append(expected, fmt.Sprintf("(%v, %v)", quoteLiteral(filePath), quoteLiteral(currentVersion)))
+
+		for _, step := range steps {
+			if versionCommit(step.version) == uncommittedVersion {
+				return "", errors.Errorf("%v has uncommitted changes, commit them before exporting a script", filePath)
+			}
+
+			sql, err := joinStatements(step.sql)
+
+			if err != nil {
+				return "", errors.Wrapf(err, "unable to split the SQL of %v into statements", filePath)
+			}
+
+			fmt.Fprintf(&body, "\n-- %v: %q -> %q\n", filePath, currentVersion, step.version)
+
+			if step.noTransaction {
+				// Postgres refuses to run these statements inside of a
+				// transaction, so the changes before them are committed
+				fmt.Fprintf(&body, "COMMIT;\n\n%v\n\nBEGIN;\n", sql)
+			} else if sql != "" {
+				body.WriteString(sql + "\n")
+			}
+
+			if step.version != currentVersion {
+				fmt.Fprintf(
+					&body,
+					"INSERT INTO %v (file, version, migration) VALUES (%v, %v, %v)\nON CONFLICT (file, migration) DO UPDATE SET version = EXCLUDED.version;\n",
+					tableName, quoteLiteral(filePath), quoteLiteral(step.version), migrationID,
+				)
+			}
+
+			currentVersion = step.version
+		}
+
+		body.WriteString(s.hookScript(AfterEachFile))
+	}
+
+	if len(expected) == 0 {
+		return "", nil
+	}
+
+	var script bytes.Buffer
+
+	script.WriteString("-- pgit deploy script, run it with psql -f\n\\set ON_ERROR_STOP on\n\nBEGIN;\n")
+	script.WriteString(unindent(migrationsTableSQL(tableName) + filesTableSQL(tableName)))
+
+	// the versions the files are recorded at in the database must still be
+	// the ones the script was exported from
+	fmt.Fprintf(&script, `
+
+DO $pgit$
+BEGIN
+	IF EXISTS (
+		SELECT 1 FROM (VALUES %v) AS expected (file, version)
+		WHERE CASE WHEN expected.version = '' THEN EXISTS (SELECT 1 FROM %v f WHERE f.file = expected.file)
+		ELSE NOT EXISTS (
+			SELECT 1 FROM %v f WHERE f.file = expected.file AND f.version = expected.version
+			AND f.migration = (SELECT max(l.migration) FROM %v l WHERE l.file = expected.file)
+		) END
+	) THEN
+		RAISE EXCEPTION 'the pgit state of the database is not the state the script was exported from';
+	END IF;
+END
+$pgit$;
+`, strings.Join(expected, ", "), tableName, tableName, tableName)
+
+	script.WriteString(s.hookScript(BeforeMigrate))
+	fmt.Fprintf(&script, "\nINSERT INTO %v_migrations (completed, started_at) VALUES (false, now());\n", tableName)
+	script.WriteString(body.String())
+	fmt.Fprintf(&script, "\nUPDATE %v_migrations SET completed = true, finished_at = now() WHERE id = %v;\n", tableName, migrationID)
+	script.WriteString(s.hookScript(AfterMigrate))
+	script.WriteString("\nCOMMIT;\n")
+
+	return script.String(), nil
+}
+
+// hookScript returns the SQL of the hook files for a phase, in path order
+func (s *schemaDirectory) hookScript(phase HookPhase) string {
+	var b bytes.Buffer
+	for _, path := range s.sortedPaths() {
+		if f, ok := s.files[path].(*hookFile); ok && f.phase == phase {
+			fmt.Fprintf(&b, "\n-- %v hook %v\n%v\n", phase, path, f.sql)
+		}
+	}
+	return b.String()
+}
+
+// quoteLiteral quotes a string as an SQL literal
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// unindent removes the indentation of SQL written inside of Go code
+func unindent(sql string) string {
+	return strings.TrimSpace(strings.Replace(sql, "\n\t\t", "\n", -1))
+}
@@ -0,0 +1,140 @@
+package pgit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportScript(t *testing.T) {
+	gitRoot, err := ioutil.TempDir("", "pgit-export")
+	assert.NoError(t, err, "failed to create temp directory")
+	defer os.RemoveAll(gitRoot)
+
+	root := filepath.Join(gitRoot, "schema")
+	writeMigrations(t, gitRoot, "schema", map[string]string{
+		"users.sql": `-- pgit type=changeset
+
+-- change
+CREATE TABLE users (id integer);
+
+-- rollback
+DROP TABLE users;
+
+-- change
+ALTER TABLE users ADD COLUMN email text;
+UPDATE users SET email = 'unknown';
+
+-- rollback
+ALTER TABLE users DROP COLUMN email;
+
+-- change notransaction
+CREATE INDEX CONCURRENTLY users_email ON users (email);
+
+-- rollback
+DROP INDEX users_email;
+`,
+		"set_role.sql": "-- pgit type=hook phase=before-migrate\nSET ROLE owner;\n",
+	})
+
+	s := &schemaDirectory{gitRoot: gitRoot, root: root, files: make(map[string]schemaFile), state: &migrationState{}}
+
+	state := newMigrationState()
+	state.fileStates["schema/users.sql"] = &fileMigrationState{path: "schema/users.sql", version: "1"}
+
+	script, err := s.exportScript(nil, state, "")
+
+	assert.NoError(t, err, "should export the script")
+	assert.Equal(t, `-- pgit deploy script, run it with psql -f
+\set ON_ERROR_STOP on
+
+BEGIN;
+CREATE TABLE IF NOT EXISTS pgit_migrations (
+	id serial PRIMARY KEY,
+	completed boolean DEFAULT false NOT NULL
+);
+ALTER TABLE pgit_migrations
+	ADD COLUMN IF NOT EXISTS started_at timestamptz,
+	ADD COLUMN IF NOT EXISTS finished_at timestamptz,
+	ADD COLUMN IF NOT EXISTS adopted boolean DEFAULT false NOT NULL;
+CREATE TABLE IF NOT EXISTS pgit (
+	file text NOT NULL,
+	version text NOT NULL,
+	migration integer NOT NULL REFERENCES pgit_migrations (id),
+	PRIMARY KEY (file, migration)
+);
+DO $pgit$
+DECLARE
+	key name;
+BEGIN
+	SELECT conname INTO key FROM pg_constraint c
+	WHERE c.conrelid = 'pgit'::regclass AND c.contype = 'p' AND c.conkey = ARRAY(
+		SELECT attnum FROM pg_attribute WHERE attrelid = c.conrelid AND attname IN ('file', 'version') ORDER BY attnum
+	);
+	IF key IS NOT NULL THEN
+		EXECUTE format('ALTER TABLE %s DROP CONSTRAINT %I, ADD PRIMARY KEY (file, migration)', 'pgit', key);
+	END IF;
+END
+$pgit$;
+
+DO $pgit$
+BEGIN
+	IF EXISTS (
+		SELECT 1 FROM (VALUES ('schema/users.sql', '1')) AS expected (file, version)
+		WHERE CASE WHEN expected.version = '' THEN EXISTS (SELECT 1 FROM pgit f WHERE f.file = expected.file)
+		ELSE NOT EXISTS (
+			SELECT 1 FROM pgit f WHERE f.file = expected.file AND f.version = expected.version
+			AND f.migration = (SELECT max(l.migration) FROM pgit l WHERE l.file = expected.file)
+		) END
+	) THEN
+		RAISE EXCEPTION 'the pgit state of the database is not the state the script was exported from';
+	END IF;
+END
+$pgit$;
+
+-- before-migrate hook schema/set_role.sql
+SET ROLE owner;
+
+INSERT INTO pgit_migrations (completed, started_at) VALUES (false, now());
+
+-- schema/users.sql: "1" -> "2"
+ALTER TABLE users ADD COLUMN email text;
+UPDATE users SET email = 'unknown';
+INSERT INTO pgit (file, version, migration) VALUES ('schema/users.sql', '2', currval(pg_get_serial_sequence('pgit_migrations', 'id')))
+ON CONFLICT (file, migration) DO UPDATE SET version = EXCLUDED.version;
+
+-- schema/users.sql: "2" -> "3"
+COMMIT;
+
+CREATE INDEX CONCURRENTLY users_email ON users (email);
+
+BEGIN;
+INSERT INTO pgit (file, version, migration) VALUES ('schema/users.sql', '3', currval(pg_get_serial_sequence('pgit_migrations', 'id')))
+ON CONFLICT (file, migration) DO UPDATE SET version = EXCLUDED.version;
+
+UPDATE pgit_migrations SET completed = true, finished_at = now() WHERE id = currval(pg_get_serial_sequence('pgit_migrations', 'id'));
+
+COMMIT;
+`, script, "should apply the pending changes and record their versions")
+
+	state.fileStates["schema/users.sql"].version = "3"
+	script, err = s.exportScript(nil, state, "")
+	assert.NoError(t, err, "should export the script")
+	assert.Equal(t, "", script, "should export nothing when the database is up to date")
+
+	writeMigrations(t, gitRoot, "schema", map[string]string{
+		"grants.sql": "-- pgit type=grants\nGRANT SELECT ON users TO reader;\n",
+	})
+	s.files = make(map[string]schemaFile)
+
+	_, err = s.exportScript(nil, state, "")
+	assert.EqualError(
+		t,
+		err,
+		"schema/grants.sql reads the database catalog, export the script from the database instead",
+		"should need the database for grants files",
+	)
+}
@@ -0,0 +1,309 @@
+package pgit
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// extensionFile represents a file listing the Postgres extensions that should
+// be installed, one per line with an optional pinned version and schema:
+//
+//	pgcrypto
+//	pg_trgm 1.6 schema=ext
+//
+// The version recorded in the state table lists the extensions along with the
+// version and schema they are installed with, read from the catalog for those
+// the file does not pin, so applying the file only needs to compare the
+// recorded list with the current one and rolling back restores the list
+// recorded before the migration.
+type extensionFile struct {
+	definitionFile
+	extensions []extension
+	db         DatabaseConnection
+}
+
+// extension is a single extension declared in an extension file
+type extension struct {
+	name    string
+	version string
+	schema  string
+}
+
+var (
+	extensionNameRegexp    = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	extensionVersionRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	extensionSchemaRegexp  = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+)
+
+func newExtensionFile(path, gitRoot string, content []byte) *extensionFile {
+	return &extensionFile{definitionFile: definitionFile{path: path, gitRoot: gitRoot, content: content}}
+}
+
+// parse returns the extensions listed in the file. Blank lines and comments
+// are ignored.
+func (e *extensionFile) parse(fileContent []byte) ([]extension, error) {
+	extensions := make([]extension, 0)
+	seen := make(map[string]bool)
+
+	for i, line := range strings.Split(string(fileContent), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if comment := strings.Index(line, "--"); comment != -1 {
+			line = line[:comment]
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		lineError := func(field, message, hint string) error {
+			return &ParseError{
+				Path:    e.path,
+				Line:    i + 1,
+				Column:  strings.Index(line, field) + 1,
+				Message: message,
+				Hint:    hint,
+			}
+		}
+
+		ext := extension{name: fields[0]}
+
+		if !extensionNameRegexp.MatchString(ext.name) {
+			return nil, lineError(ext.name, fmt.Sprintf("invalid extension name %q", ext.name), "")
+		}
+
+		if seen[ext.name] {
+			return nil, lineError(ext.name, fmt.Sprintf("extension %v is listed more than once", ext.name), "")
+		}
+		seen[ext.name] = true
+
+		for _, field := range fields[1:] {
+			switch {
+			case strings.HasPrefix(field, "schema="):
+				ext.schema = strings.TrimPrefix(field, "schema=")
+				if !extensionSchemaRegexp.MatchString(ext.schema) {
+					return nil, lineError(field, fmt.Sprintf("invalid schema %q", ext.schema), "")
+				}
+			case !strings.Contains(field, "=") && ext.version == "" && ext.schema == "":
+				ext.version = field
+				if !extensionVersionRegexp.MatchString(ext.version) {
+					return nil, lineError(field, fmt.Sprintf("invalid version %q", ext.version), "")
+				}
+			default:
+				return nil, lineError(field, fmt.Sprintf("unexpected %q", field), "expected <name> [version] [schema=<schema>]")
+			}
+		}
+
+		extensions = append(extensions, ext)
+	}
+
+	return extensions, nil
+}
+
+// setDatabase provides the connection used to read the installed extensions
+func (e *extensionFile) setDatabase(db DatabaseConnection) {
+	e.db = db
+}
+
+func (e *extensionFile) getApplySQL(currentVersion string) (string, string, error) {
+	applied, err := decodeExtensions(currentVersion)
+
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to read installed extensions")
+	}
+
+	installed, err := e.installed()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	newVersion := encodeExtensions(installed)
+
+	if newVersion == currentVersion {
+		return "", currentVersion, nil
+	}
+
+	return extensionTransitionSQL(applied, e.extensions), newVersion, nil
+}
+
+// installed returns the declared extensions with the version and schema they
+// are installed with once the file is applied. Extensions that are already
+// installed keep the version and schema that the file does not pin, and new
+// ones get the defaults of their control file. Without a database the
+// declared values are used.
+func (e *extensionFile) installed() ([]extension, error) {
+	if e.db == nil {
+		return e.extensions, nil
+	}
+
+	names := make([]string, len(e.extensions))
+	for i, ext := range e.extensions {
+		names[i] = ext.name
+	}
+
+	catalog, err := e.db.readExtensions(names)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read installed extensions from the database")
+	}
+
+	available := make(map[string]catalogExtension)
+	for _, c := range catalog {
+		available[c.name] = c
+	}
+
+	installed := make([]extension, len(e.extensions))
+
+	for i, ext := range e.extensions {
+		c, ok := available[ext.name]
+		if ok && ext.version == "" {
+			ext.version = c.defaultVersion
+			if c.version != "" {
+				ext.version = c.version
+			}
+		}
+		if ok && ext.schema == "" {
+			ext.schema = c.defaultSchema
+			if c.schema != "" {
+				ext.schema = c.schema
+			}
+		}
+		installed[i] = ext
+	}
+
+	return installed, nil
+}
+
+// getRollbackSteps returns the step that restores the extensions, with the
+// versions and schemas, recorded before the migration being rolled back
+func (e *extensionFile) getRollbackSteps(currentVersion, previousVersion string) ([]applyStep, error) {
+	applied, err := decodeExtensions(currentVersion)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read installed extensions")
+	}
+
+	previous, err := decodeExtensions(previousVersion)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read previously installed extensions")
+	}
+
+	sql := extensionTransitionSQL(applied, previous)
+	destructive, err := destructiveOperations(sql)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to classify rollback SQL")
+	}
+
+	return []applyStep{{sql: sql, version: previousVersion, destructive: destructive}}, nil
+}
+
+// getRollbackSQL returns an error because extension files are rolled back to
+// the extensions recorded before the migration, by getRollbackSteps
+func (e *extensionFile) getRollbackSQL(currentVersion string) (string, string, error) {
+	return "", "", errors.New("extension files are rolled back to the extensions recorded before the migration")
+}
+
+// extensionTransitionSQL returns the statements that change the installed
+// extensions from one list to another. Extensions that are no longer listed
+// are dropped in reverse order, then new extensions are created and existing
+// ones are moved or updated in the order they are listed.
+func extensionTransitionSQL(from, to []extension) string {
+	statements := make([]string, 0)
+	installed, wanted := make(map[string]extension), make(map[string]bool)
+
+	for _, ext := range from {
+		installed[ext.name] = ext
+	}
+
+	for _, ext := range to {
+		wanted[ext.name] = true
+	}
+
+	for i := len(from) - 1; i >= 0; i-- {
+		if !wanted[from[i].name] {
+			statements = append(statements, fmt.Sprintf("DROP EXTENSION IF EXISTS %v;", quoteIdentifier(from[i].name)))
+		}
+	}
+
+	for _, ext := range to {
+		name := quoteIdentifier(ext.name)
+		previous, ok := installed[ext.name]
+
+		if !ok {
+			create := "CREATE EXTENSION IF NOT EXISTS " + name
+			if ext.schema != "" {
+				create += " SCHEMA " + ext.schema
+			}
+			if ext.version != "" {
+				create += " VERSION '" + ext.version + "'"
+			}
+			statements = append(statements, create+";")
+			continue
+		}
+
+		if ext.schema != "" && ext.schema != previous.schema {
+			statements = append(statements, fmt.Sprintf("ALTER EXTENSION %v SET SCHEMA %v;", name, ext.schema))
+		}
+
+		if ext.version != "" && ext.version != previous.version {
+			statements = append(statements, fmt.Sprintf("ALTER EXTENSION %v UPDATE TO '%v';", name, ext.version))
+		}
+	}
+
+	return strings.Join(statements, "\n")
+}
+
+// encodeExtensions returns the version recorded for a list of extensions,
+// such as "pgcrypto,pg_trgm@1.6:ext"
+func encodeExtensions(extensions []extension) string {
+	entries := make([]string, len(extensions))
+
+	for i, ext := range extensions {
+		entries[i] = ext.name
+		if ext.version != "" {
+			entries[i] += "@" + ext.version
+		}
+		if ext.schema != "" {
+			entries[i] += ":" + ext.schema
+		}
+	}
+
+	return strings.Join(entries, ",")
+}
+
+func decodeExtensions(version string) ([]extension, error) {
+	extensions := make([]extension, 0)
+
+	if version == "" {
+		return extensions, nil
+	}
+
+	for _, entry := range strings.Split(version, ",") {
+		ext := extension{}
+
+		if i := strings.Index(entry, ":"); i != -1 {
+			entry, ext.schema = entry[:i], entry[i+1:]
+		}
+
+		if i := strings.Index(entry, "@"); i != -1 {
+			entry, ext.version = entry[:i], entry[i+1:]
+		}
+
+		ext.name = entry
+
+		if !extensionNameRegexp.MatchString(ext.name) {
+			return nil, errors.Errorf("invalid extension version %q", version)
+		}
+
+		extensions = append(extensions, ext)
+	}
+
+	return extensions, nil
+}
@@ -0,0 +1,141 @@
+package pgit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtensionFileParse(t *testing.T) {
+	e := newExtensionFile("extensions.sql", "", nil)
+
+	extensions, err := e.parse([]byte("-- pgit type=extension\npgcrypto\n\npg_trgm 1.6 schema=ext -- used for search\nuuid-ossp schema=ext\n"))
+
+	assert.NoError(t, err, "should parse extensions")
+	assert.Equal(t, []extension{
+		{name: "pgcrypto"},
+		{name: "pg_trgm", version: "1.6", schema: "ext"},
+		{name: "uuid-ossp", schema: "ext"},
+	}, extensions, "should read the name, version and schema of each extension")
+
+	_, err = e.parse([]byte("\npgcrypto\npgcrypto 1.3\n"))
+	assert.Equal(t, &ParseError{
+		Path:    "extensions.sql",
+		Line:    3,
+		Column:  1,
+		Message: "extension pgcrypto is listed more than once",
+	}, err, "should reject duplicate extensions")
+
+	_, err = e.parse([]byte("\npg_trgm schema=ext 1.6\n"))
+	assert.EqualError(t, err, `extensions.sql:2:20: unexpected "1.6" (hint: expected <name> [version] [schema=<schema>])`, "should require the version before the schema")
+
+	_, err = e.parse([]byte("\npg_trgm cascade=true\n"))
+	assert.Error(t, err, "should reject unknown options")
+}
+
+func TestExtensionFileApply(t *testing.T) {
+	e := newExtensionFile("extensions.sql", "", nil)
+	e.extensions = []extension{
+		{name: "pgcrypto"},
+		{name: "pg_trgm", version: "1.6", schema: "ext"},
+		{name: "uuid-ossp"},
+	}
+
+	sql, version, err := e.getApplySQL("")
+
+	assert.NoError(t, err, "should return apply SQL")
+	assert.Equal(
+		t,
+		"CREATE EXTENSION IF NOT EXISTS pgcrypto;\n"+
+			"CREATE EXTENSION IF NOT EXISTS pg_trgm SCHEMA ext VERSION '1.6';\n"+
+			`CREATE EXTENSION IF NOT EXISTS "uuid-ossp";`,
+		sql,
+		"should create every extension",
+	)
+	assert.Equal(t, "pgcrypto,pg_trgm@1.6:ext,uuid-ossp", version, "should record the declared extensions")
+
+	sql, version, err = e.getApplySQL("pgcrypto,pg_trgm@1.6:ext,uuid-ossp")
+
+	assert.NoError(t, err, "should return apply SQL")
+	assert.Equal(t, "", sql, "should do nothing when unchanged")
+	assert.Equal(t, "pgcrypto,pg_trgm@1.6:ext,uuid-ossp", version, "should keep the version")
+
+	sql, _, err = e.getApplySQL("hstore,pg_trgm@1.5,pgcrypto,citext")
+
+	assert.NoError(t, err, "should return apply SQL")
+	assert.Equal(
+		t,
+		"DROP EXTENSION IF EXISTS citext;\n"+
+			"DROP EXTENSION IF EXISTS hstore;\n"+
+			"ALTER EXTENSION pg_trgm SET SCHEMA ext;\n"+
+			"ALTER EXTENSION pg_trgm UPDATE TO '1.6';\n"+
+			`CREATE EXTENSION IF NOT EXISTS "uuid-ossp";`,
+		sql,
+		"should drop, move, update and create extensions as needed",
+	)
+
+	_, _, err = e.getApplySQL("pg_trgm@1.5,bad name")
+	assert.Error(t, err, "should reject an invalid recorded version")
+}
+
+func TestExtensionFileInstalled(t *testing.T) {
+	e := newExtensionFile("extensions.sql", "", nil)
+	e.extensions = []extension{
+		{name: "pgcrypto"},
+		{name: "pg_trgm", version: "1.6"},
+		{name: "hstore"},
+	}
+
+	db := &MockDatabaseConnection{}
+	db.On("readExtensions", []string{"pgcrypto", "pg_trgm", "hstore"}).Return([]catalogExtension{
+		{name: "pgcrypto", version: "1.2", schema: "public", defaultVersion: "1.3", defaultSchema: "public"},
+		{name: "pg_trgm", version: "1.5", schema: "ext", defaultVersion: "1.6", defaultSchema: "public"},
+		{name: "hstore", defaultVersion: "1.8", defaultSchema: "public"},
+	}, nil)
+	e.setDatabase(db)
+
+	sql, version, err := e.getApplySQL("pgcrypto@1.2:public,pg_trgm@1.5:ext")
+
+	assert.NoError(t, err, "should return apply SQL")
+	assert.Equal(
+		t,
+		"ALTER EXTENSION pg_trgm UPDATE TO '1.6';\nCREATE EXTENSION IF NOT EXISTS hstore;",
+		sql,
+		"should only change what the file declares",
+	)
+	assert.Equal(
+		t,
+		"pgcrypto@1.2:public,pg_trgm@1.6:ext,hstore@1.8:public",
+		version,
+		"should record the installed versions and schemas",
+	)
+
+	sql, _, err = e.getApplySQL(version)
+
+	assert.NoError(t, err, "should return apply SQL")
+	assert.Equal(t, "", sql, "should do nothing when the recorded extensions are installed")
+
+	db.AssertExpectations(t)
+}
+
+func TestExtensionFileRollback(t *testing.T) {
+	e := newExtensionFile("extensions.sql", "", nil)
+
+	steps, err := e.getRollbackSteps("pgcrypto@1.3:public,pg_trgm@1.6:ext", "pgcrypto@1.2:public")
+
+	assert.NoError(t, err, "should return rollback steps")
+	assert.Equal(t, []applyStep{{
+		sql:         "DROP EXTENSION IF EXISTS pg_trgm;\nALTER EXTENSION pgcrypto UPDATE TO '1.2';",
+		version:     "pgcrypto@1.2:public",
+		destructive: []string{"DROP EXTENSION"},
+	}}, steps, "should restore the recorded versions")
+
+	steps, err = e.getRollbackSteps("pgcrypto@1.3:public", "")
+
+	assert.NoError(t, err, "should return rollback steps")
+	assert.Equal(t, "DROP EXTENSION IF EXISTS pgcrypto;", steps[0].sql, "should drop every extension of the first migration")
+	assert.Equal(t, "", steps[0].version, "should clear the version")
+
+	_, err = e.getRollbackSteps("pgcrypto", "bad name")
+	assert.Error(t, err, "should fail for an invalid recorded version")
+}
@@ -0,0 +1,432 @@
+package pgit
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// grantsFile represents a file declaring the privileges that roles should
+// have on schemas, tables, sequences and functions. pgit compares the
+// declared privileges with the database catalog and issues the GRANT and
+// REVOKE statements needed to make them match. The git history of the file is
+// used to roll back to the previously declared privileges.
+//
+// Privileges are managed for every role named in the file, on the schemas
+// named in the file and the objects inside of them. Privileges those roles
+// hold elsewhere are left alone.
+type grantsFile struct {
+	definitionFile
+	db DatabaseConnection
+}
+
+// grant is a single privilege held by a role on a database object
+type grant struct {
+	role       string
+	objectType string
+	object     string
+	privilege  string
+}
+
+// target returns the role and object of a grant without its privilege
+func (g grant) target() grant {
+	return grant{role: g.role, objectType: g.objectType, object: g.object}
+}
+
+var allPrivileges = map[string][]string{
+	"TABLE":    {"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"},
+	"SEQUENCE": {"USAGE", "SELECT", "UPDATE"},
+	"FUNCTION": {"EXECUTE"},
+	"SCHEMA":   {"USAGE", "CREATE"},
+}
+
+var grantRegexp = regexp.MustCompile(
+	`(?is)^GRANT\s+(.+?)\s+ON\s+(?:(TABLE|SEQUENCE|FUNCTION|SCHEMA)\s+)?(.+?)\s+TO\s+(.+?)(\s+WITH\s+GRANT\s+OPTION)?$`,
+)
+
+func newGrantsFile(path, gitRoot string, content []byte) *grantsFile {
+	g := &grantsFile{definitionFile: definitionFile{path: path, gitRoot: gitRoot, content: content}}
+	g.scripts = g
+	return g
+}
+
+// setDatabase provides the connection used to read the privileges currently
+// granted in the database
+func (g *grantsFile) setDatabase(db DatabaseConnection) {
+	g.db = db
+}
+
+// parse returns the privileges declared by the GRANT statements in the file
+func (g *grantsFile) parse(fileContent []byte) ([]grant, error) {
+	statements, err := splitStatements(string(fileContent))
+
+	if err != nil {
+		return nil, inFile(err, g.path)
+	}
+
+	grants := make([]grant, 0)
+
+	for _, s := range statements {
+		statementError := func(message string) error {
+			return &ParseError{
+				Path:    g.path,
+				Line:    s.line,
+				Column:  s.column,
+				Message: message,
+				Hint:    "expected GRANT <privileges> ON [TABLE|SEQUENCE|FUNCTION|SCHEMA] <objects> TO <roles>",
+			}
+		}
+
+		tokens := grantRegexp.FindStringSubmatch(s.sql)
+
+		if len(tokens) != 6 {
+			return nil, statementError("expected a GRANT statement")
+		}
+
+		if tokens[5] != "" {
+			return nil, statementError("WITH GRANT OPTION is not supported")
+		}
+
+		objectType := strings.ToUpper(tokens[2])
+		if objectType == "" {
+			objectType = "TABLE"
+		}
+
+		if strings.HasPrefix(strings.ToUpper(tokens[3]), "ALL ") {
+			return nil, statementError("grants on ALL objects in a schema are not supported")
+		}
+
+		privileges := make([]string, 0)
+		for _, p := range strings.Split(tokens[1], ",") {
+			p = strings.ToUpper(strings.Join(strings.Fields(p), " "))
+			if p == "ALL" || p == "ALL PRIVILEGES" {
+				privileges = append(privileges, allPrivileges[objectType]...)
+				continue
+			}
+			if !containsString(allPrivileges[objectType], p) {
+				return nil, statementError(fmt.Sprintf("privilege %q is not supported on %v", p, strings.ToLower(objectType)))
+			}
+			privileges = append(privileges, p)
+		}
+
+		for _, object := range splitTopLevel(tokens[3]) {
+			object, err := normalizeObjectName(objectType, object)
+			if err != nil {
+				return nil, statementError(err.Error())
+			}
+			for _, role := range strings.Split(tokens[4], ",") {
+				for _, privilege := range privileges {
+					grants = append(grants, grant{
+						role:       normalizeRoleName(role),
+						objectType: objectType,
+						object:     object,
+						privilege:  privilege,
+					})
+				}
+			}
+		}
+	}
+
+	return grants, nil
+}
+
+// getApplySteps returns a step that makes the privileges in the database
+// match the file. The privileges are compared on every migration, so those
+// changed by hand are corrected even when the file has not changed, in which
+// case the version stays the same.
+func (g *grantsFile) getApplySteps(currentVersion string) ([]applyStep, error) {
+	sql, version, err := g.getApplySQL(currentVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if version == currentVersion && currentVersion != "" {
+		if sql, err = g.transitionSQL(g.content, g.content); err != nil {
+			return nil, err
+		}
+	}
+
+	if sql == "" && version == currentVersion {
+		return nil, nil
+	}
+
+	return []applyStep{{sql: sql, version: version}}, nil
+}
+
+// transitionSQL returns the GRANT and REVOKE statements that change the
+// privileges in the database from those declared by from to those declared by
+// to
+func (g *grantsFile) transitionSQL(from, to []byte) (string, error) {
+	previous, desired := make([]grant, 0), make([]grant, 0)
+	var err error
+
+	if len(from) > 0 {
+		if previous, err = g.parse(from); err != nil {
+			return "", errors.Wrap(err, "unable to parse previous version of grants")
+		}
+	}
+
+	if len(to) > 0 {
+		if desired, err = g.parse(to); err != nil {
+			return "", errors.Wrap(err, "unable to parse grants")
+		}
+	}
+
+	roles, schemas := grantScope(append(append([]grant{}, previous...), desired...))
+
+	if len(roles) == 0 {
+		return "", nil
+	}
+
+	if g.db == nil {
+		return "", errors.New("a database connection is required to compare grants")
+	}
+
+	current, err := g.db.readGrants(roles, schemas)
+
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read current grants from the database")
+	}
+
+	return diffGrants(current, desired), nil
+}
+
+// grantScope returns the roles and schemas whose privileges are managed by a
+// set of grants
+func grantScope(grants []grant) ([]string, []string) {
+	roles, schemas := make(map[string]bool), make(map[string]bool)
+
+	for _, g := range grants {
+		roles[g.role] = true
+		if g.objectType == "SCHEMA" {
+			schemas[unquoteIdentifier(g.object)] = true
+		} else {
+			schemas[unquoteIdentifier(splitQualifiedName(g.object)[0])] = true
+		}
+	}
+
+	return sortedKeys(roles), sortedKeys(schemas)
+}
+
+// ownerPrivilege is the privilege readGrants reports for the owner of an
+// object, whose privileges are implicit
+const ownerPrivilege = "OWNER"
+
+// diffGrants returns the REVOKE statements for privileges that are held but
+// not desired followed by the GRANT statements for privileges that are
+// desired but not held. The privileges of the owner of an object are left
+// alone.
+func diffGrants(current, desired []grant) string {
+	held, wanted, owned := make(map[grant]bool), make(map[grant]bool), make(map[grant]bool)
+
+	for _, g := range current {
+		if g.privilege == ownerPrivilege {
+			owned[g.target()] = true
+		}
+	}
+
+	for _, g := range current {
+		if !owned[g.target()] {
+			held[g] = true
+		}
+	}
+
+	for _, g := range desired {
+		if !owned[g.target()] {
+			wanted[g] = true
+		}
+	}
+
+	revokes, grants := make([]grant, 0), make([]grant, 0)
+
+	for g := range held {
+		if !wanted[g] {
+			revokes = append(revokes, g)
+		}
+	}
+
+	for g := range wanted {
+		if !held[g] {
+			grants = append(grants, g)
+		}
+	}
+
+	statements := formatGrants("REVOKE %v ON %v %v FROM %v;", revokes)
+	statements = append(statements, formatGrants("GRANT %v ON %v %v TO %v;", grants)...)
+
+	return strings.Join(statements, "\n")
+}
+
+// formatGrants returns one statement per role and object, listing all of the
+// privileges for that role and object together
+func formatGrants(format string, grants []grant) []string {
+	type target struct{ role, objectType, object string }
+
+	privileges := make(map[target][]string)
+	for _, g := range grants {
+		t := target{g.role, g.objectType, g.object}
+		privileges[t] = append(privileges[t], g.privilege)
+	}
+
+	statements := make([]string, 0, len(privileges))
+	for t, p := range privileges {
+		sort.Strings(p)
+		role := t.role
+		if role != "PUBLIC" {
+			role = quoteIdentifier(role)
+		}
+		statements = append(statements, fmt.Sprintf(format, strings.Join(p, ", "), t.objectType, t.object, role))
+	}
+
+	sort.Strings(statements)
+
+	return statements
+}
+
+// splitTopLevel splits a comma separated list, ignoring commas inside of
+// parentheses such as those in function signatures
+func splitTopLevel(list string) []string {
+	parts := make([]string, 0)
+	depth, start := 0, 0
+
+	for i, c := range list {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(list[start:i]))
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, strings.TrimSpace(list[start:]))
+}
+
+// normalizeObjectName returns the name of an object the way the catalog
+// query formats it: schema qualified, with identifiers quoted only where
+// needed and function arguments listed by type
+func normalizeObjectName(objectType, name string) (string, error) {
+	arguments := ""
+
+	if objectType == "FUNCTION" {
+		open := strings.Index(name, "(")
+		if open == -1 || !strings.HasSuffix(name, ")") {
+			return "", errors.Errorf("function %v must include its argument types", name)
+		}
+		types := make([]string, 0)
+		for _, t := range splitTopLevel(name[open+1 : len(name)-1]) {
+			if t != "" {
+				types = append(types, strings.ToLower(strings.Join(strings.Fields(t), " ")))
+			}
+		}
+		arguments = "(" + strings.Join(types, ", ") + ")"
+		name = strings.TrimSpace(name[:open])
+	}
+
+	parts := splitQualifiedName(name)
+
+	if objectType == "SCHEMA" {
+		if len(parts) != 1 {
+			return "", errors.Errorf("invalid schema name %v", name)
+		}
+		return parts[0], nil
+	}
+
+	if len(parts) == 1 {
+		parts = []string{"public", parts[0]}
+	}
+
+	if len(parts) != 2 {
+		return "", errors.Errorf("invalid object name %v", name)
+	}
+
+	return parts[0] + "." + parts[1] + arguments, nil
+}
+
+// splitQualifiedName splits a possibly schema qualified name into its
+// identifiers, normalizing each of them
+func splitQualifiedName(name string) []string {
+	parts := make([]string, 0)
+	current, quoted := "", false
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '"' && quoted && i+1 < len(name) && name[i+1] == '"':
+			current += `"`
+			i++
+		case c == '"':
+			quoted = !quoted
+			if !quoted {
+				// quoted identifiers keep their case
+				current = "\x00" + current
+			}
+		case c == '.' && !quoted:
+			parts = append(parts, normalizeIdentifier(current))
+			current = ""
+		default:
+			current += string(c)
+		}
+	}
+
+	return append(parts, normalizeIdentifier(current))
+}
+
+func normalizeIdentifier(identifier string) string {
+	if strings.HasPrefix(identifier, "\x00") {
+		return quoteIdentifier(identifier[1:])
+	}
+	return quoteIdentifier(strings.ToLower(strings.TrimSpace(identifier)))
+}
+
+func normalizeRoleName(role string) string {
+	role = strings.TrimSpace(role)
+	if strings.EqualFold(role, "PUBLIC") {
+		return "PUBLIC"
+	}
+	return unquoteIdentifier(strings.Join(splitQualifiedName(role), "."))
+}
+
+var simpleIdentifierRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// quoteIdentifier quotes an identifier if it would not otherwise be read back
+// unchanged, like Postgres' quote_ident
+func quoteIdentifier(identifier string) string {
+	if simpleIdentifierRegexp.MatchString(identifier) {
+		return identifier
+	}
+	return `"` + strings.Replace(identifier, `"`, `""`, -1) + `"`
+}
+
+func unquoteIdentifier(identifier string) string {
+	if strings.HasPrefix(identifier, `"`) && strings.HasSuffix(identifier, `"`) && len(identifier) > 1 {
+		return strings.Replace(identifier[1:len(identifier)-1], `""`, `"`, -1)
+	}
+	return identifier
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,136 @@
+package pgit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrantsFileParse(t *testing.T) {
+	g := newGrantsFile("grants/app.sql", "", nil)
+
+	grants, err := g.parse([]byte(`
+GRANT USAGE ON SCHEMA app TO app_rw;
+GRANT SELECT, insert ON app.Orders, "Audit Log" TO app_rw, "Reporting";
+GRANT EXECUTE ON FUNCTION app.calc_tax(NUMERIC,  text) TO PUBLIC;
+GRANT ALL ON SEQUENCE app.orders_id_seq TO app_rw;
+`))
+
+	assert.NoError(t, err, "should parse grants")
+	assert.Equal(t, []grant{
+		{role: "app_rw", objectType: "SCHEMA", object: "app", privilege: "USAGE"},
+		{role: "app_rw", objectType: "TABLE", object: "app.orders", privilege: "SELECT"},
+		{role: "app_rw", objectType: "TABLE", object: "app.orders", privilege: "INSERT"},
+		{role: "Reporting", objectType: "TABLE", object: "app.orders", privilege: "SELECT"},
+		{role: "Reporting", objectType: "TABLE", object: "app.orders", privilege: "INSERT"},
+		{role: "app_rw", objectType: "TABLE", object: `public."Audit Log"`, privilege: "SELECT"},
+		{role: "app_rw", objectType: "TABLE", object: `public."Audit Log"`, privilege: "INSERT"},
+		{role: "Reporting", objectType: "TABLE", object: `public."Audit Log"`, privilege: "SELECT"},
+		{role: "Reporting", objectType: "TABLE", object: `public."Audit Log"`, privilege: "INSERT"},
+		{role: "PUBLIC", objectType: "FUNCTION", object: "app.calc_tax(numeric, text)", privilege: "EXECUTE"},
+		{role: "app_rw", objectType: "SEQUENCE", object: "app.orders_id_seq", privilege: "USAGE"},
+		{role: "app_rw", objectType: "SEQUENCE", object: "app.orders_id_seq", privilege: "SELECT"},
+		{role: "app_rw", objectType: "SEQUENCE", object: "app.orders_id_seq", privilege: "UPDATE"},
+	}, grants, "should expand every privilege, object and role")
+
+	_, err = g.parse([]byte("\nGRANT SELECT ON app.orders TO app_rw WITH GRANT OPTION;\n"))
+	assert.Equal(t, &ParseError{
+		Path:    "grants/app.sql",
+		Line:    2,
+		Column:  1,
+		Message: "WITH GRANT OPTION is not supported",
+		Hint:    "expected GRANT <privileges> ON [TABLE|SEQUENCE|FUNCTION|SCHEMA] <objects> TO <roles>",
+	}, err, "should reject grant options")
+
+	_, err = g.parse([]byte("\nGRANT EXECUTE ON app.orders TO app_rw;\n"))
+	assert.EqualError(t, err, `grants/app.sql:2:1: privilege "EXECUTE" is not supported on table (hint: expected GRANT <privileges> ON [TABLE|SEQUENCE|FUNCTION|SCHEMA] <objects> TO <roles>)`, "should reject privileges that do not apply to the object")
+
+	_, err = g.parse([]byte("\nGRANT SELECT ON ALL TABLES IN SCHEMA app TO app_rw;\n"))
+	assert.Error(t, err, "should reject grants on all objects in a schema")
+
+	_, err = g.parse([]byte("\nREVOKE SELECT ON app.orders FROM app_rw;\n"))
+	assert.Error(t, err, "should only allow GRANT statements")
+}
+
+func TestGrantsFileTransition(t *testing.T) {
+	g := newGrantsFile("grants/app.sql", "", nil)
+	db := &MockDatabaseConnection{}
+	g.setDatabase(db)
+
+	db.On("readGrants", []string{"app_ro", "app_rw"}, []string{"app"}).Return([]grant{
+		{role: "app_rw", objectType: "TABLE", object: "app.orders", privilege: "SELECT"},
+		{role: "app_rw", objectType: "TABLE", object: "app.orders", privilege: "DELETE"},
+		{role: "app_ro", objectType: "TABLE", object: "app.orders", privilege: "SELECT"},
+	}, nil)
+
+	sql, err := g.transitionSQL(
+		[]byte("\nGRANT SELECT ON app.orders TO app_rw, app_ro;\n"),
+		[]byte("\nGRANT SELECT, INSERT ON app.orders TO app_rw;\n"),
+	)
+
+	assert.NoError(t, err, "should compare grants")
+	assert.Equal(
+		t,
+		"REVOKE DELETE ON TABLE app.orders FROM app_rw;\n"+
+			"REVOKE SELECT ON TABLE app.orders FROM app_ro;\n"+
+			"GRANT INSERT ON TABLE app.orders TO app_rw;",
+		sql,
+		"should revoke undeclared privileges of managed roles and grant missing ones",
+	)
+
+	db.AssertExpectations(t)
+
+	sql = diffGrants([]grant{
+		{role: "app_rw", objectType: "TABLE", object: "app.orders", privilege: "OWNER"},
+		{role: "app_rw", objectType: "TABLE", object: "app.orders", privilege: "TRUNCATE"},
+		{role: "app_ro", objectType: "TABLE", object: "app.orders", privilege: "SELECT"},
+	}, []grant{
+		{role: "app_rw", objectType: "TABLE", object: "app.orders", privilege: "SELECT"},
+		{role: "app_ro", objectType: "TABLE", object: "app.orders", privilege: "SELECT"},
+	})
+	assert.Equal(t, "", sql, "should leave the privileges of the owner alone")
+
+	sql, err = newGrantsFile("grants/app.sql", "", nil).transitionSQL(nil, nil)
+	assert.NoError(t, err, "should not need the database when nothing is declared")
+	assert.Equal(t, "", sql, "should not change anything")
+
+	_, err = newGrantsFile("grants/app.sql", "", nil).transitionSQL(nil, []byte("\nGRANT SELECT ON t TO r;\n"))
+	assert.EqualError(t, err, "a database connection is required to compare grants", "should require a database connection")
+}
+
+func TestGrantsFileDrift(t *testing.T) {
+	gitRoot, err := ioutil.TempDir("", "pgit-grants")
+	assert.NoError(t, err, "failed to create temp directory")
+	defer os.RemoveAll(gitRoot)
+
+	runCommand(t, gitRoot, "git", "init")
+	runCommand(t, gitRoot, "git", "config", "user.email", "test@test.com")
+	runCommand(t, gitRoot, "git", "config", "user.name", "Test Name")
+
+	content := []byte("\nGRANT SELECT ON app.orders TO app_ro;\n")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(gitRoot, "grants.sql"), append([]byte("-- pgit type=grants"), content...), 0644), "failed to write grants file")
+	runCommand(t, gitRoot, "git", "add", "-A")
+	runCommand(t, gitRoot, "git", "commit", "-m", "grants")
+
+	g := newGrantsFile("grants.sql", gitRoot, content)
+	db := &MockDatabaseConnection{}
+	g.setDatabase(db)
+
+	version, err := g.getCurrentSHA()
+	assert.NoError(t, err, "should get the commit of the file")
+
+	db.On("readGrants", []string{"app_ro"}, []string{"app"}).Return([]grant{
+		{role: "app_ro", objectType: "TABLE", object: "app.orders", privilege: "SELECT"},
+		{role: "app_ro", objectType: "TABLE", object: "app.orders", privilege: "DELETE"},
+	}, nil)
+
+	steps, err := g.getApplySteps(version)
+
+	assert.NoError(t, err, "should compare the grants")
+	assert.Equal(t, []applyStep{
+		{sql: "REVOKE DELETE ON TABLE app.orders FROM app_ro;", version: version},
+	}, steps, "should correct privileges changed by hand without changing the version")
+}
@@ -0,0 +1,71 @@
+package pgit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HookPhase is a point in a migration or rollback at which hooks run
+type HookPhase string
+
+// Phases at which hooks run. AfterEachFile hooks run once for every file
+// that was changed by a migration.
+const (
+	BeforeMigrate  HookPhase = "before-migrate"
+	AfterEachFile  HookPhase = "after-each-file"
+	AfterMigrate   HookPhase = "after-migrate"
+	BeforeRollback HookPhase = "before-rollback"
+	AfterRollback  HookPhase = "after-rollback"
+)
+
+var hookPhases = []HookPhase{BeforeMigrate, AfterEachFile, AfterMigrate, BeforeRollback, AfterRollback}
+
+// HookEvent describes the migration, and for AfterEachFile hooks the file,
+// that a hook is running for
+type HookEvent struct {
+	Phase       HookPhase
+	MigrationID int
+	Path        string
+	FromVersion string
+	ToVersion   string
+}
+
+// hookFile represents a file of SQL that is executed every time its phase is
+// reached rather than being applied once. The SET and RESET statements of a
+// hook are applied to every connection the migration uses, so a
+// before-migrate hook can SET ROLE.
+type hookFile struct {
+	path  string
+	phase HookPhase
+	sql   string
+}
+
+func (f *hookFile) getPath() string {
+	return f.path
+}
+
+// getApplySQL returns no SQL because hook files are executed by their phase
+func (f *hookFile) getApplySQL(currentVersion string) (string, string, error) {
+	return "", currentVersion, nil
+}
+
+// getRollbackSQL returns no SQL because hook files are never applied
+func (f *hookFile) getRollbackSQL(currentVersion string) (string, string, error) {
+	return "", currentVersion, nil
+}
+
+// parseHookPhase returns the phase named by the phase option of a hook file
+func parseHookPhase(name string) (HookPhase, error) {
+	for _, phase := range hookPhases {
+		if string(phase) == name {
+			return phase, nil
+		}
+	}
+
+	names := make([]string, len(hookPhases))
+	for i, phase := range hookPhases {
+		names[i] = string(phase)
+	}
+
+	return "", fmt.Errorf("unknown hook phase %q, expected one of %v", name, strings.Join(names, ", "))
+}
@@ -0,0 +1,24 @@
+package pgit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHookPhase(t *testing.T) {
+	phase, err := parseHookPhase("after-each-file")
+
+	assert.NoError(t, err, "should parse a known phase")
+	assert.Equal(t, AfterEachFile, phase, "should return the phase")
+
+	_, err = parseHookPhase("")
+	assert.EqualError(t, err, `unknown hook phase "", expected one of before-migrate, after-each-file, after-migrate, before-rollback, after-rollback`, "should require a phase")
+}
+
+func TestSessionSettings(t *testing.T) {
+	settings, err := sessionSettings("SET ROLE owner;\nSET LOCAL lock_timeout = '1s';\nRESET search_path;\nSET TRANSACTION ISOLATION LEVEL SERIALIZABLE;\nANALYZE;\n")
+
+	assert.NoError(t, err, "should read the settings")
+	assert.Equal(t, []string{"SET ROLE owner", "RESET search_path"}, settings, "should keep the settings that last for the session")
+}
@@ -0,0 +1,504 @@
+package pgit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MigrationTool is another migration tool whose migrations pgit can import
+type MigrationTool string
+
+// The migration tools pgit can import from
+const (
+	GolangMigrate MigrationTool = "golang-migrate"
+	Goose         MigrationTool = "goose"
+	Flyway        MigrationTool = "flyway"
+)
+
+// importedMigration is a migration of another tool converted to a changeset
+type importedMigration struct {
+	// key identifies the migration in the version table of the tool, "V"
+	// followed by its normalized version or, for repeatable migrations,
+	// "R" followed by its description
+	key  string
+	id   string
+	file string
+	up   string
+	down string
+
+	noTransaction bool
+	runOnChange   bool
+}
+
+var (
+	golangMigrateFileRegexp = regexp.MustCompile(`^(\d+)_(.*)\.(up|down)\.sql$`)
+	gooseFileRegexp         = regexp.MustCompile(`^(\d+)_(.*)\.(sql|go)$`)
+	flywayFileRegexp        = regexp.MustCompile(`^([VU])(.+?)__(.*)\.sql$`)
+	flywayRepeatableRegexp  = regexp.MustCompile(`^R__(.*)\.sql$`)
+	invalidIDCharRegexp     = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+// importMigrations converts the migrations of another tool in each of the
+// directories into a changeset file named after the directory in the schema
+// root, with a change for each migration. When db is not nil the migrations
+// that the version table of the tool, or s.versionTable when set, records as
+// applied are recorded as applied in a new adopted migration, so that they do
+// not run again and rolling it back runs no SQL. Nothing is
+// written if any of the files already exists. It returns the paths of the
+// files, relative to the schema root.
+func (s *schemaDirectory) importMigrations(db DatabaseConnection, tool MigrationTool, dirs []string) ([]string, error) {
+	if _, ok := versionTables[tool]; !ok {
+		return nil, errors.Errorf("unknown migration tool %q, expected golang-migrate, goose or flyway", tool)
+	}
+
+	// can't use filepath.Rel because it annoyingly prefixes the relative
+	// path with "../" which git doesn't like
+	relativeRoot := s.root[len(s.gitRoot)+1:]
+
+	paths := make([]string, 0, len(dirs))
+	contents := make(map[string][]byte)
+	files := make(map[string]*changesetFile)
+	sources := make(map[string][]importedMigration)
+	all := make([]importedMigration, 0)
+
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		migrations, err := readMigrations(tool, abs)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(migrations) == 0 {
+			return nil, errors.Errorf("no %v migrations found in %v", tool, dir)
+		}
+
+		path := filepath.Base(abs) + ".sql"
+
+		if _, ok := contents[path]; ok {
+			return nil, errors.Errorf("more than one directory would be imported to %v", path)
+		}
+
+		if _, err := os.Stat(filepath.Join(s.root, path)); err == nil {
+			return nil, errors.Errorf("%v already exists", path)
+		}
+
+		content := importedChangesets(migrations)
+
+		if isTemplate(content) {
+			return nil, errors.Errorf("the migrations in %v contain {{, which pgit would read as a template placeholder", dir)
+		}
+
+		c := &changesetFile{path: filepath.Join(relativeRoot, path)}
+
+		if err := c.parse(withoutHeader(content)); err != nil {
+			return nil, errors.Wrapf(err, "unable to convert the migrations in %v", dir)
+		}
+
+		if len(c.changesets) != len(migrations) {
+			return nil, errors.Errorf(
+				"a migration in %v has a line starting with %v or %v, which pgit would read as the start of a change",
+				dir, changesetAnnotation, rollbackAnnotation,
+			)
+		}
+
+		paths = append(paths, path)
+		contents[path] = content
+		files[path] = c
+		sources[path] = migrations
+		all = append(all, migrations...)
+	}
+
+	versions := make([]FileVersion, 0)
+
+	if db != nil {
+		rows, err := db.readVersionTable(tool, s.versionTable)
+
+		if err != nil {
+			return nil, err
+		}
+
+		applied, err := appliedMigrations(tool, rows, all)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.readMigrationState(db); err != nil {
+			return nil, errors.Wrap(err, "failed to read migration state")
+		}
+
+		for _, path := range paths {
+			c := files[path]
+
+			if _, ok := s.state.fileStates[c.path]; ok {
+				return nil, errors.Errorf("the database already has a version of %v", c.path)
+			}
+
+			// migrations the tool skipped, such as those applied out
+			// of order, are recorded as skipped so that pgit applies
+			// them on the next migration
+			entries := make([]string, 0)
+			for i, m := range sources[path] {
+				if applied[m.key] {
+					entries = append(entries, c.entry(i))
+				} else {
+					entries = append(entries, c.key(i)+skippedMarker)
+				}
+			}
+			for len(entries) > 0 && entrySkipped(entries[len(entries)-1]) {
+				entries = entries[:len(entries)-1]
+			}
+
+			if len(entries) > 0 {
+				versions = append(versions, FileVersion{Path: c.path, Version: encodeChangesetVersion(entries)})
+			}
+		}
+	}
+
+	if len(versions) > 0 {
+		// the tool created the objects of the imported migrations, so
+		// rolling back their migration only removes the recorded versions
+		migration, err := db.createAdoptedMigration()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range versions {
+			fileState := &fileMigrationState{path: v.Path}
+
+			if err := db.applyAndUpdateStateForFile(fileState, "", v.Version, migration); err != nil {
+				return nil, removeImported(db, migration, errors.Wrapf(err, "unable to record the version of %v", v.Path))
+			}
+
+			fileState.version = v.Version
+			s.state.fileStates[v.Path] = fileState
+		}
+
+		if err := db.finishMigration(migration); err != nil {
+			return nil, removeImported(db, migration, err)
+		}
+
+		// the versions are recorded before the files are written so that a
+		// failure leaves neither behind
+		for i, path := range paths {
+			if err := ioutil.WriteFile(filepath.Join(s.root, path), contents[path], 0644); err != nil {
+				for _, written := range paths[:i] {
+					os.Remove(filepath.Join(s.root, written))
+				}
+				for _, v := range versions {
+					delete(s.state.fileStates, v.Path)
+				}
+				return nil, removeImported(db, migration, errors.Wrapf(err, "failed to write file %v", path))
+			}
+		}
+
+		return paths, nil
+	}
+
+	for _, path := range paths {
+		if err := ioutil.WriteFile(filepath.Join(s.root, path), contents[path], 0644); err != nil {
+			return nil, errors.Wrapf(err, "failed to write file %v", path)
+		}
+	}
+
+	return paths, nil
+}
+
+// removeImported removes the migration recording the versions of imported
+// files after err stopped the import
+func removeImported(db DatabaseConnection, m *migration, err error) error {
+	if removeErr := db.removeMigration(m); removeErr != nil {
+		return errors.Wrapf(err, "unable to remove migration %v (%v)", m.id, removeErr)
+	}
+	return err
+}
+
+// readMigrations reads the migrations of the tool in the directory, in the
+// order the tool applies them
+func readMigrations(tool MigrationTool, dir string) ([]importedMigration, error) {
+	entries, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read directory "+dir)
+	}
+
+	byKey := make(map[string]*importedMigration)
+	versions := make(map[string]string)
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		name := entry.Name()
+		var version, title, direction string
+
+		switch tool {
+		case GolangMigrate:
+			match := golangMigrateFileRegexp.FindStringSubmatch(name)
+			if match == nil {
+				continue
+			}
+			version, title, direction = match[1], match[2], match[3]
+		case Goose:
+			match := gooseFileRegexp.FindStringSubmatch(name)
+			if match == nil {
+				continue
+			}
+			if match[3] == "go" {
+				return nil, errors.Errorf("%v is a Go migration, which cannot be imported", name)
+			}
+			version, title, direction = match[1], match[2], "up"
+		case Flyway:
+			if match := flywayRepeatableRegexp.FindStringSubmatch(name); match != nil {
+				title, direction = match[1], "up"
+				break
+			}
+			match := flywayFileRegexp.FindStringSubmatch(name)
+			if match == nil {
+				continue
+			}
+			version, title, direction = strings.Replace(match[2], "_", ".", -1), match[3], "up"
+			if match[1] == "U" {
+				direction = "down"
+			}
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read file "+name)
+		}
+
+		key, id := "R"+strings.Replace(title, "_", " ", -1), "r_"+title
+		if version != "" {
+			version = normalizeVersion(version)
+			key, id = "V"+version, "v"+version+"_"+title
+		}
+
+		m, ok := byKey[key]
+		if !ok {
+			m = &importedMigration{key: key, id: invalidIDCharRegexp.ReplaceAllString(id, "_"), runOnChange: version == ""}
+			byKey[key] = m
+			versions[key] = version
+		}
+
+		sql := string(content)
+
+		if tool == Goose {
+			if sql, m.down, m.noTransaction, err = parseGooseMigration(sql); err != nil {
+				return nil, errors.Wrapf(err, "unable to read %v", name)
+			}
+		}
+
+		if direction == "down" {
+			m.down = sql
+		} else {
+			m.up, m.file = sql, name
+		}
+	}
+
+	migrations := make([]importedMigration, 0, len(byKey))
+
+	for _, m := range byKey {
+		if m.file == "" {
+			return nil, errors.Errorf("migration %v in %v only has a rollback", m.key[1:], dir)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	// repeatable migrations have no version and are applied after the
+	// others, ordered by description
+	sort.Slice(migrations, func(i, j int) bool {
+		vi, vj := versions[migrations[i].key], versions[migrations[j].key]
+		if (vi == "") != (vj == "") {
+			return vj == ""
+		}
+		if c := compareVersions(vi, vj); c != 0 {
+			return c < 0
+		}
+		return migrations[i].key < migrations[j].key
+	})
+
+	return migrations, nil
+}
+
+// parseGooseMigration splits a goose migration into its up and down SQL at
+// its -- +goose annotations
+func parseGooseMigration(content string) (string, string, bool, error) {
+	var up, down []string
+	var section *[]string
+	noTransaction := false
+
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if !strings.HasPrefix(trimmed, "-- +goose ") {
+			if section != nil {
+				*section = append(*section, line)
+			}
+			continue
+		}
+
+		switch strings.ToUpper(strings.TrimSpace(trimmed[len("-- +goose "):])) {
+		case "UP":
+			section = &up
+		case "DOWN":
+			section = &down
+		case "NO TRANSACTION":
+			noTransaction = true
+		}
+	}
+
+	if up == nil {
+		return "", "", false, errors.New("missing -- +goose Up")
+	}
+
+	return strings.Join(up, "\n"), strings.Join(down, "\n"), noTransaction, nil
+}
+
+// importedChangesets returns the content of a changeset file with a change for
+// each migration
+func importedChangesets(migrations []importedMigration) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("-- pgit type=changeset\n")
+
+	for _, m := range migrations {
+		options := " id=" + m.id
+		if m.noTransaction {
+			options += " notransaction"
+		}
+		if m.runOnChange {
+			options += " runOnChange"
+		}
+
+		fmt.Fprintf(&b, "\n%v%v\n%v\n\n%v\n", changesetAnnotation, options, strings.TrimSpace(m.up), rollbackAnnotation)
+
+		if down := strings.TrimSpace(m.down); down != "" {
+			b.WriteString(down + "\n")
+		}
+	}
+
+	return []byte(b.String())
+}
+
+// appliedMigrations returns the keys of the migrations that the rows of the
+// version table of the tool record as applied
+func appliedMigrations(tool MigrationTool, rows []string, migrations []importedMigration) (map[string]bool, error) {
+	applied := make(map[string]bool)
+
+	// a baseline applies every migration up to its version
+	applyThrough := func(version string) {
+		for _, m := range migrations {
+			if m.key[0] == 'V' && compareVersions(m.key[1:], version) <= 0 {
+				applied[m.key] = true
+			}
+		}
+	}
+
+	for _, row := range rows {
+		switch tool {
+		case GolangMigrate:
+			if strings.HasSuffix(row, " dirty") {
+				return nil, errors.Errorf("the database is dirty at version %v, fix it with golang-migrate before importing", strings.TrimSuffix(row, " dirty"))
+			}
+			applyThrough(normalizeVersion(row))
+			applied["V"+normalizeVersion(row)] = true
+		case Goose:
+			applied["V"+normalizeVersion(row)] = true
+		case Flyway:
+			fields := strings.SplitN(row, " ", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			key := fields[1]
+			if key[0] == 'V' {
+				key = "V" + normalizeVersion(key[1:])
+			}
+			switch fields[0] {
+			case "BASELINE":
+				applyThrough(key[1:])
+			case "UNDO_SQL":
+				delete(applied, key)
+			default:
+				applied[key] = true
+			}
+		}
+	}
+
+	known := make(map[string]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.key] = true
+	}
+
+	missing := make([]string, 0)
+	for key := range applied {
+		if !known[key] {
+			missing = append(missing, key[1:])
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, errors.Errorf(
+			"%v records %v as applied but there are no migration files for them",
+			tool, strings.Join(missing, ", "),
+		)
+	}
+
+	return applied, nil
+}
+
+// normalizeVersion removes the leading zeros from each part of a version, so
+// that 0001 and 1 or 1.01 and 1.1 are the same version
+func normalizeVersion(version string) string {
+	parts := strings.Split(version, ".")
+	for i, part := range parts {
+		parts[i] = strings.TrimLeft(part, "0")
+		if parts[i] == "" {
+			parts[i] = "0"
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// compareVersions compares two normalized versions part by part, returning a
+// negative number when a comes first, zero when they are the same and a
+// positive number when b comes first
+func compareVersions(a, b string) int {
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		x, y := "0", "0"
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if len(x) != len(y) {
+			return len(x) - len(y)
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,96 @@
+package pgit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// importDefinitions writes a file for every function, procedure and view in
+// the given schema of db, under <schema>/functions and <schema>/views in the
+// schema root. Views are written as view files, and functions, procedures and
+// materialized views as definition files rolled back by dropping them. Nothing
+// is written if any of the files already exists. It returns the paths of the
+// files, relative to the schema root.
+func (s *schemaDirectory) importDefinitions(db DatabaseConnection, schema string) ([]string, error) {
+	objects, err := db.dumpSchema()
+
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	contents := make(map[string][]byte)
+
+	for _, o := range objects {
+		kind, name, ok := importedObject(o.identity, schema)
+
+		if !ok {
+			continue
+		}
+
+		var content string
+
+		if kind == "view" && !strings.HasPrefix(o.create, "CREATE MATERIALIZED VIEW") {
+			content = "-- pgit type=view\n\n" + o.create + "\n"
+		} else {
+			content = "-- pgit type=definition\n\n" + definitionAnnotation + "\n" + o.create + "\n\n" +
+				rollbackAnnotation + "\n" + o.drop + "\n"
+		}
+
+		// overloaded functions share a name, so later ones are numbered
+		dir := filepath.Join(schema, kind+"s")
+		path := filepath.Join(dir, name+".sql")
+		for i := 2; contents[path] != nil; i++ {
+			path = filepath.Join(dir, name+"_"+strconv.Itoa(i)+".sql")
+		}
+
+		if isTemplate([]byte(content)) {
+			return nil, errors.Errorf("%v contains {{, which pgit would read as a template placeholder", o.identity)
+		}
+
+		paths = append(paths, path)
+		contents[path] = []byte(content)
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(filepath.Join(s.root, path)); err == nil {
+			return nil, errors.Errorf("%v already exists", path)
+		}
+	}
+
+	for _, path := range paths {
+		filePath := filepath.Join(s.root, path)
+
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return nil, errors.Wrapf(err, "failed to create the directory of %v", path)
+		}
+
+		if err := ioutil.WriteFile(filePath, contents[path], 0644); err != nil {
+			return nil, errors.Wrapf(err, "failed to write file %v", path)
+		}
+	}
+
+	return paths, nil
+}
+
+// importedObject returns the kind, function or view, and the name of an object
+// of the schema dump if it is in the given schema
+func importedObject(identity, schema string) (string, string, bool) {
+	for _, kind := range []string{"function", "view"} {
+		prefix := kind + " " + schema + "."
+		if !strings.HasPrefix(identity, prefix) {
+			continue
+		}
+		name := identity[len(prefix):]
+		if i := strings.Index(name, "("); i != -1 {
+			name = name[:i]
+		}
+		return kind, strings.Replace(name, string(filepath.Separator), "_", -1), true
+	}
+	return "", "", false
+}
@@ -0,0 +1,71 @@
+package pgit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportDefinitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgit-import")
+	assert.NoError(t, err, "failed to create temp directory")
+	defer os.RemoveAll(dir)
+
+	s := &schemaDirectory{root: dir, files: make(map[string]schemaFile)}
+
+	db := &MockDatabaseConnection{}
+	db.On("dumpSchema").Return([]schemaObject{
+		{identity: "table public.orders", create: "CREATE TABLE public.orders ();", drop: "DROP TABLE IF EXISTS public.orders;"},
+		{
+			identity: "function public.calc_tax(numeric)",
+			create:   "CREATE OR REPLACE FUNCTION public.calc_tax(amount numeric)\n RETURNS numeric\n LANGUAGE sql\nAS $function$ SELECT amount * 0.2 $function$;",
+			drop:     "DROP FUNCTION IF EXISTS public.calc_tax(numeric);",
+		},
+		{
+			identity: "function public.calc_tax(numeric, text)",
+			create:   "CREATE OR REPLACE FUNCTION public.calc_tax(amount numeric, region text)\n RETURNS numeric\n LANGUAGE sql\nAS $function$ SELECT amount * 0.2 $function$;",
+			drop:     "DROP FUNCTION IF EXISTS public.calc_tax(numeric, text);",
+		},
+		{identity: "function audit.log_change()", create: "CREATE OR REPLACE FUNCTION audit.log_change() ...;", drop: "DROP FUNCTION IF EXISTS audit.log_change();"},
+		{identity: "view public.open_orders", create: "CREATE VIEW public.open_orders AS\n SELECT 1;", drop: "DROP VIEW IF EXISTS public.open_orders;"},
+		{identity: "view public.order_totals", create: "CREATE MATERIALIZED VIEW public.order_totals AS\n SELECT 1;", drop: "DROP MATERIALIZED VIEW IF EXISTS public.order_totals;"},
+	}, nil)
+
+	paths, err := s.importDefinitions(db, "public")
+
+	assert.NoError(t, err, "should import the definitions")
+	assert.Equal(t, []string{
+		filepath.Join("public", "functions", "calc_tax.sql"),
+		filepath.Join("public", "functions", "calc_tax_2.sql"),
+		filepath.Join("public", "views", "open_orders.sql"),
+		filepath.Join("public", "views", "order_totals.sql"),
+	}, paths, "should write a file for every function and view in the schema")
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "public", "functions", "calc_tax_2.sql"))
+	assert.NoError(t, err, "failed to read file")
+	assert.Equal(t, `-- pgit type=definition
+
+-- definition
+CREATE OR REPLACE FUNCTION public.calc_tax(amount numeric, region text)
+ RETURNS numeric
+ LANGUAGE sql
+AS $function$ SELECT amount * 0.2 $function$;
+
+-- rollback
+DROP FUNCTION IF EXISTS public.calc_tax(numeric, text);
+`, string(content), "should write a definition dropping the function with its signature")
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "public", "views", "open_orders.sql"))
+	assert.NoError(t, err, "failed to read file")
+	assert.Equal(t, "-- pgit type=view\n\nCREATE VIEW public.open_orders AS\n SELECT 1;\n", string(content), "should write a view file")
+
+	for _, path := range paths {
+		assert.NoError(t, s.readFile(filepath.Join(dir, path), path), "should write a valid file")
+	}
+
+	_, err = s.importDefinitions(db, "public")
+	assert.EqualError(t, err, filepath.Join("public", "functions", "calc_tax.sql")+" already exists", "should not overwrite files")
+}
@@ -0,0 +1,178 @@
+package pgit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// writeMigrations writes migration files to a new directory named name in
+// dir
+func writeMigrations(t *testing.T, dir, name string, files map[string]string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, os.MkdirAll(path, 0755), "failed to create directory")
+	for file, content := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(path, file), []byte(content), 0644), "failed to write migration")
+	}
+	return path
+}
+
+func TestImportMigrations(t *testing.T) {
+	gitRoot, err := ioutil.TempDir("", "pgit-import")
+	assert.NoError(t, err, "failed to create temp directory")
+	defer os.RemoveAll(gitRoot)
+
+	root := filepath.Join(gitRoot, "schema")
+	assert.NoError(t, os.MkdirAll(root, 0755), "failed to create schema root")
+
+	s := &schemaDirectory{gitRoot: gitRoot, root: root, files: make(map[string]schemaFile), state: &migrationState{}}
+
+	t.Run("goose", func(t *testing.T) {
+		dir := writeMigrations(t, gitRoot, "goose", map[string]string{
+			"00001_create_users.sql": "-- +goose Up\n-- +goose StatementBegin\nCREATE TABLE users (id integer);\n-- +goose StatementEnd\n\n-- +goose Down\nDROP TABLE users;\n",
+			"00002_users_email.sql":  "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE INDEX CONCURRENTLY users_id ON users (id);\n\n-- +goose Down\nDROP INDEX CONCURRENTLY users_id;\n",
+			"00003_orders.sql":       "-- +goose Up\nCREATE TABLE orders (id integer);\n",
+			"README.md":              "not a migration",
+		})
+
+		expectedMigration := &migration{id: 7}
+		db := &MockDatabaseConnection{}
+		db.On("readVersionTable", Goose, "").Return([]string{"1", "3"}, nil)
+		db.On("readMigrationState").Return(newMigrationState(), nil)
+		db.On("createAdoptedMigration").Return(expectedMigration, nil)
+		db.On("applyAndUpdateStateForFile", mock.Anything, "", "v1_create_users,v2_users_email!,v3_orders", expectedMigration).Return(nil)
+		db.On("finishMigration", expectedMigration).Return(nil)
+
+		paths, err := s.importMigrations(db, Goose, []string{dir})
+
+		assert.NoError(t, err, "should import the migrations")
+		assert.Equal(t, []string{"goose.sql"}, paths, "should write a changeset file named after the directory")
+
+		content, err := ioutil.ReadFile(filepath.Join(root, "goose.sql"))
+		assert.NoError(t, err, "failed to read file")
+		assert.Equal(t, `-- pgit type=changeset
+
+-- change id=v1_create_users
+CREATE TABLE users (id integer);
+
+-- rollback
+DROP TABLE users;
+
+-- change id=v2_users_email notransaction
+CREATE INDEX CONCURRENTLY users_id ON users (id);
+
+-- rollback
+DROP INDEX CONCURRENTLY users_id;
+
+-- change id=v3_orders
+CREATE TABLE orders (id integer);
+
+-- rollback
+`, string(content), "should write a change for every migration")
+
+		db.AssertExpectations(t)
+
+		_, err = s.importMigrations(nil, Goose, []string{dir})
+		assert.EqualError(t, err, "goose.sql already exists", "should not overwrite files")
+	})
+
+	t.Run("failing to record the versions", func(t *testing.T) {
+		dir := writeMigrations(t, gitRoot, "goose_renamed", map[string]string{
+			"00001_create_users.sql": "-- +goose Up\nCREATE TABLE users (id integer);\n",
+		})
+
+		expectedMigration := &migration{id: 8}
+		db := &MockDatabaseConnection{}
+		db.On("readVersionTable", Goose, "public.goose_versions").Return([]string{"1"}, nil)
+		db.On("readMigrationState").Return(newMigrationState(), nil)
+		db.On("createAdoptedMigration").Return(expectedMigration, nil)
+		db.On("applyAndUpdateStateForFile", mock.Anything, "", "v1_create_users", expectedMigration).Return(errors.New("connection reset"))
+		db.On("removeMigration", expectedMigration).Return(nil)
+
+		s.versionTable = "public.goose_versions"
+		defer func() { s.versionTable = "" }()
+
+		_, err := s.importMigrations(db, Goose, []string{dir})
+
+		assert.EqualError(t, err, "unable to record the version of schema/goose_renamed.sql: connection reset", "should return the error")
+		db.AssertExpectations(t)
+
+		_, err = os.Stat(filepath.Join(root, "goose_renamed.sql"))
+		assert.True(t, os.IsNotExist(err), "should not write the files")
+	})
+
+	t.Run("golang-migrate", func(t *testing.T) {
+		dir := writeMigrations(t, gitRoot, "migrate", map[string]string{
+			"1_create_users.up.sql":   "CREATE TABLE users (id integer);",
+			"1_create_users.down.sql": "DROP TABLE users;",
+			"2_orders.up.sql":         "CREATE TABLE orders (id integer);",
+			"3_items.up.sql":          "CREATE TABLE items (id integer);",
+		})
+
+		applied, err := appliedMigrations(GolangMigrate, []string{"2"}, mustReadMigrations(t, GolangMigrate, dir))
+		assert.NoError(t, err, "should read the version table")
+		assert.Equal(t, map[string]bool{"V1": true, "V2": true}, applied, "should apply every migration up to the current version")
+
+		_, err = appliedMigrations(GolangMigrate, []string{"2 dirty"}, nil)
+		assert.EqualError(t, err, "the database is dirty at version 2, fix it with golang-migrate before importing", "should refuse a dirty database")
+
+		paths, err := s.importMigrations(nil, GolangMigrate, []string{dir})
+		assert.NoError(t, err, "should import the migrations without a database")
+		assert.Equal(t, []string{"migrate.sql"}, paths, "should write a changeset file")
+		assert.NoError(t, s.readFile(filepath.Join(root, "migrate.sql"), "schema/migrate.sql"), "should write a valid changeset file")
+		assert.Len(t, s.files["schema/migrate.sql"].(*changesetFile).changesets, 3, "should have a change for every migration")
+	})
+
+	t.Run("flyway", func(t *testing.T) {
+		dir := writeMigrations(t, gitRoot, "flyway", map[string]string{
+			"V1__Create_users.sql":  "CREATE TABLE users (id integer);",
+			"V1_1__Add_email.sql":   "ALTER TABLE users ADD COLUMN email text;",
+			"U1_1__Add_email.sql":   "ALTER TABLE users DROP COLUMN email;",
+			"V2__Orders.sql":        "CREATE TABLE orders (id integer);",
+			"V10__Items.sql":        "CREATE TABLE items (id integer);",
+			"R__Refresh_views.sql":  "CREATE OR REPLACE VIEW user_emails AS SELECT email FROM users;",
+			"V3__Not_run_yet.sql.x": "SELECT 1;",
+		})
+
+		migrations := mustReadMigrations(t, Flyway, dir)
+		ids := make([]string, len(migrations))
+		for i, m := range migrations {
+			ids[i] = m.id
+		}
+		assert.Equal(t, []string{"v1_Create_users", "v1.1_Add_email", "v2_Orders", "v10_Items", "r_Refresh_views"}, ids, "should order the migrations by version")
+		assert.Equal(t, "ALTER TABLE users DROP COLUMN email;", migrations[1].down, "should roll back with the undo migration")
+		assert.True(t, migrations[4].runOnChange, "should run repeatable migrations when they change")
+
+		applied, err := appliedMigrations(Flyway, []string{"BASELINE V1.1", "SQL V10", "UNDO_SQL V10", "SQL V2", "SQL RRefresh views"}, migrations)
+		assert.NoError(t, err, "should read the version table")
+		assert.Equal(t, map[string]bool{"V1": true, "V1.1": true, "V2": true, "RRefresh views": true}, applied, "should follow baselines and undos")
+
+		_, err = appliedMigrations(Flyway, []string{"SQL V4"}, migrations)
+		assert.EqualError(t, err, "flyway records 4 as applied but there are no migration files for them", "should refuse versions without files")
+	})
+
+	t.Run("unknown tool", func(t *testing.T) {
+		_, err := s.importMigrations(nil, MigrationTool("liquibase"), []string{gitRoot})
+		assert.EqualError(t, err, `unknown migration tool "liquibase", expected golang-migrate, goose or flyway`, "should refuse other tools")
+	})
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.True(t, compareVersions("1.1", "1.10") < 0, "should compare parts as numbers")
+	assert.True(t, compareVersions("10", "9") > 0, "should compare parts as numbers")
+	assert.Equal(t, 0, compareVersions("1", "1.0"), "should treat missing parts as zero")
+	assert.Equal(t, "1.1", normalizeVersion("001.01"), "should remove leading zeros")
+}
+
+func mustReadMigrations(t *testing.T, tool MigrationTool, dir string) []importedMigration {
+	migrations, err := readMigrations(tool, dir)
+	if err != nil {
+		assert.FailNowf(t, "should read the migrations", "got error: %v", err)
+	}
+	return migrations
+}
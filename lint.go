@@ -0,0 +1,391 @@
+package pgit
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Severity is how serious a lint finding is
+type Severity string
+
+// Severities of lint rules. Rules that are off are not run.
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityOff     Severity = "off"
+)
+
+// LintRule checks the SQL of a change for a hazard, such as a statement that
+// takes a long lock on a busy table
+type LintRule interface {
+	// Name identifies the rule in -- pgit:ignore comments and severity
+	// settings
+	Name() string
+	// DefaultSeverity is the severity of the rule's findings unless another
+	// is configured
+	DefaultSeverity() Severity
+	// Check returns the problems found in the change. Path, Change, Rule and
+	// Severity are filled in by the caller.
+	Check(change *LintChange) []LintFinding
+}
+
+// LintChange is the SQL of a changeset, or of the definition in a definition
+// file, that is checked by the lint rules
+type LintChange struct {
+	Path string
+	// Change is the key of the changeset, and empty for definition files
+	Change string
+
+	Statements []LintStatement
+	Rollback   []LintStatement
+	// RollbackLine is the line of the rollback annotation
+	RollbackLine int
+
+	// NewTables are the tables, as schema.table, created by this change,
+	// or by an earlier pending change when the changes are known to be
+	// pending. Locks taken on them are harmless because nothing else uses
+	// them yet.
+	NewTables map[string]bool
+
+	// ignored maps a line to the rules suppressed on it, and on the next
+	// line when the comment is the only thing on it
+	ignored map[int][]string
+	// commentLines are the lines that hold nothing but a comment
+	commentLines map[int]bool
+}
+
+// LintStatement is a single statement of a change
+type LintStatement struct {
+	SQL  string
+	Line int
+}
+
+// LintFinding is a problem found by a lint rule
+type LintFinding struct {
+	Path     string
+	Change   string
+	Line     int
+	Rule     string
+	Severity Severity
+	Message  string
+}
+
+// String formats the finding in the style "path:line: severity: message (rule)"
+func (f LintFinding) String() string {
+	return fmt.Sprintf("%v:%v: %v: %v (%v)", f.Path, f.Line, f.Severity, f.Message, f.Rule)
+}
+
+// lintRule is a built in LintRule
+type lintRule struct {
+	name     string
+	severity Severity
+	check    func(change *LintChange) []LintFinding
+}
+
+func (r *lintRule) Name() string {
+	return r.name
+}
+
+func (r *lintRule) DefaultSeverity() Severity {
+	return r.severity
+}
+
+func (r *lintRule) Check(change *LintChange) []LintFinding {
+	return r.check(change)
+}
+
+// defaultLintRules are the rules run by Lint in addition to those added with
+// the LintRules option
+var defaultLintRules = []LintRule{
+	&lintRule{name: "add-column-not-null", severity: SeverityError, check: checkAddColumnNotNull},
+	&lintRule{name: "create-index-concurrently", severity: SeverityWarning, check: checkCreateIndexConcurrently},
+	&lintRule{name: "alter-column-type", severity: SeverityWarning, check: checkAlterColumnType},
+	&lintRule{name: "foreign-key-not-valid", severity: SeverityWarning, check: checkForeignKeyNotValid},
+	&lintRule{name: "rollback-if-exists", severity: SeverityWarning, check: checkRollbackIfExists},
+	&lintRule{name: "empty-rollback", severity: SeverityWarning, check: checkEmptyRollback},
+}
+
+var (
+	createTableRegexp        = regexp.MustCompile(`(?is)^CREATE\s+(?:(?:GLOBAL|LOCAL)\s+)?(?:(?:TEMP|TEMPORARY|UNLOGGED)\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?([\w."$]+)`)
+	alterTableRegexp         = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+(?:IF\s+EXISTS\s+)?(?:ONLY\s+)?([\w."$]+)\s*(.*)$`)
+	indexTableRegexp         = regexp.MustCompile(`(?is)\sON\s+(?:ONLY\s+)?([\w."$]+)`)
+	addColumnRegexp          = regexp.MustCompile(`(?is)^ADD\s+(?:COLUMN\s+)?(?:IF\s+NOT\s+EXISTS\s+)?[\w"$]+\s`)
+	addTableConstraintRegexp = regexp.MustCompile(`(?is)^ADD\s+(?:CONSTRAINT|PRIMARY\s+KEY|UNIQUE|CHECK|FOREIGN\s+KEY|EXCLUDE)\b`)
+	notNullRegexp            = regexp.MustCompile(`(?is)\bNOT\s+NULL\b`)
+	defaultRegexp            = regexp.MustCompile(`(?is)\b(?:DEFAULT|GENERATED)\b`)
+	notValidRegexp           = regexp.MustCompile(`(?is)\bNOT\s+VALID\b`)
+	ignoreRegexp             = regexp.MustCompile(`--\s*pgit:ignore\s+([\w, -]+)`)
+)
+
+// tableName returns a table name as schema.table
+func tableName(name string) string {
+	normalized, err := normalizeObjectName("TABLE", name)
+	if err != nil {
+		return name
+	}
+	return normalized
+}
+
+// alteredTable returns the table and the actions of an ALTER TABLE statement,
+// or false if the statement alters something else
+func alteredTable(statement string) (string, []string, bool) {
+	tokens := alterTableRegexp.FindStringSubmatch(statement)
+	if len(tokens) != 3 {
+		return "", nil, false
+	}
+	return tableName(tokens[1]), splitTopLevel(tokens[2]), true
+}
+
+func checkAddColumnNotNull(change *LintChange) []LintFinding {
+	findings := make([]LintFinding, 0)
+
+	for _, statement := range change.Statements {
+		table, actions, ok := alteredTable(statement.SQL)
+		if !ok || change.NewTables[table] {
+			continue
+		}
+		for _, action := range actions {
+			// a constraint such as CHECK (email IS NOT NULL) adds no column
+			if addTableConstraintRegexp.MatchString(action) {
+				continue
+			}
+			if addColumnRegexp.MatchString(action) && notNullRegexp.MatchString(action) && !defaultRegexp.MatchString(action) {
+				findings = append(findings, LintFinding{
+					Line:    statement.Line,
+					Message: fmt.Sprintf("adding a NOT NULL column without a default to %v fails if the table has rows", table),
+				})
+			}
+		}
+	}
+
+	return findings
+}
+
+func checkCreateIndexConcurrently(change *LintChange) []LintFinding {
+	findings := make([]LintFinding, 0)
+
+	for _, statement := range change.Statements {
+		words, err := statementWords(statement.SQL)
+		if err != nil || len(words) < 3 || words[0] != "CREATE" {
+			continue
+		}
+		i := 1
+		if words[i] == "UNIQUE" {
+			i++
+		}
+		if words[i] != "INDEX" || (i+1 < len(words) && words[i+1] == "CONCURRENTLY") {
+			continue
+		}
+		tokens := indexTableRegexp.FindStringSubmatch(statement.SQL)
+		if len(tokens) == 2 && change.NewTables[tableName(tokens[1])] {
+			continue
+		}
+		findings = append(findings, LintFinding{
+			Line:    statement.Line,
+			Message: "CREATE INDEX blocks writes to the table while it builds, use CREATE INDEX CONCURRENTLY in a notransaction change",
+		})
+	}
+
+	return findings
+}
+
+func checkAlterColumnType(change *LintChange) []LintFinding {
+	findings := make([]LintFinding, 0)
+
+	for _, statement := range change.Statements {
+		table, _, ok := alteredTable(statement.SQL)
+		if !ok || change.NewTables[table] {
+			continue
+		}
+		words, err := statementWords(statement.SQL)
+		if err != nil || !containsString(classifyStatement(words), "ALTER COLUMN TYPE") {
+			continue
+		}
+		findings = append(findings, LintFinding{
+			Line:    statement.Line,
+			Message: fmt.Sprintf("changing the type of a column may rewrite %v while holding an exclusive lock", table),
+		})
+	}
+
+	return findings
+}
+
+func checkForeignKeyNotValid(change *LintChange) []LintFinding {
+	findings := make([]LintFinding, 0)
+
+	for _, statement := range change.Statements {
+		table, actions, ok := alteredTable(statement.SQL)
+		if !ok || change.NewTables[table] {
+			continue
+		}
+		for _, action := range actions {
+			words, err := statementWords(action)
+			if err != nil || len(words) == 0 || words[0] != "ADD" {
+				continue
+			}
+			if !containsString(words, "FOREIGN") && containsString(words, "REFERENCES") {
+				// a column constraint cannot be NOT VALID
+				findings = append(findings, LintFinding{
+					Line:    statement.Line,
+					Message: fmt.Sprintf("adding a column that references another table to %v locks both tables, add the column and then the foreign key NOT VALID", table),
+				})
+				continue
+			}
+			if containsString(words, "FOREIGN") && !notValidRegexp.MatchString(action) {
+				findings = append(findings, LintFinding{
+					Line:    statement.Line,
+					Message: fmt.Sprintf("adding a foreign key to %v checks every row while locking both tables, add it NOT VALID and VALIDATE CONSTRAINT separately", table),
+				})
+			}
+		}
+	}
+
+	return findings
+}
+
+func checkRollbackIfExists(change *LintChange) []LintFinding {
+	findings := make([]LintFinding, 0)
+
+	for _, statement := range change.Rollback {
+		words, err := statementWords(statement.SQL)
+		if err != nil || len(words) < 2 || words[0] != "DROP" {
+			continue
+		}
+		exists := false
+		for i := 1; i+1 < len(words) && i < 5; i++ {
+			if words[i] == "IF" && words[i+1] == "EXISTS" {
+				exists = true
+			}
+		}
+		if !exists {
+			findings = append(findings, LintFinding{
+				Line:    statement.Line,
+				Message: "DROP without IF EXISTS fails if the rollback runs after the object is already gone",
+			})
+		}
+	}
+
+	return findings
+}
+
+func checkEmptyRollback(change *LintChange) []LintFinding {
+	if len(change.Rollback) > 0 {
+		return nil
+	}
+	return []LintFinding{{
+		Line:    change.RollbackLine,
+		Message: "the rollback is empty, so rolling back leaves the change in place",
+	}}
+}
+
+// newLintChange returns the change for a block of apply SQL and a block of
+// rollback SQL that begin on the given lines of the file
+func newLintChange(path, change, sql string, line int, rollback string, rollbackLine int) (*LintChange, error) {
+	c := &LintChange{Path: path, Change: change, RollbackLine: rollbackLine - 1, ignored: make(map[int][]string), commentLines: make(map[int]bool)}
+
+	var err error
+
+	if c.Statements, err = lintStatements(c, sql, line); err != nil {
+		return nil, inFile(err, path)
+	}
+
+	if c.Rollback, err = lintStatements(c, rollback, rollbackLine); err != nil {
+		return nil, inFile(err, path)
+	}
+
+	return c, nil
+}
+
+// lintStatements splits a block of SQL beginning on the given line into
+// statements and records the -- pgit:ignore comments in it
+func lintStatements(c *LintChange, sql string, line int) ([]LintStatement, error) {
+	for i, text := range strings.Split(sql, "\n") {
+		if tokens := ignoreRegexp.FindStringSubmatch(text); len(tokens) == 2 {
+			c.ignored[line+i] = strings.FieldsFunc(tokens[1], func(r rune) bool {
+				return r == ',' || r == ' '
+			})
+			c.commentLines[line+i] = strings.HasPrefix(strings.TrimSpace(text), "--")
+		}
+	}
+
+	split, err := splitStatements(sql)
+
+	if err != nil {
+		return nil, err
+	}
+
+	statements := make([]LintStatement, len(split))
+	for i, statement := range split {
+		statements[i] = LintStatement{SQL: statement.sql, Line: line + statement.line - 1}
+	}
+
+	return statements, nil
+}
+
+// isIgnored reports whether a -- pgit:ignore comment on the line, or alone
+// on the line before it, suppresses the rule
+func (c *LintChange) isIgnored(rule string, line int) bool {
+	return containsString(c.ignored[line], rule) || (c.commentLines[line-1] && containsString(c.ignored[line-1], rule))
+}
+
+// createdTables returns the tables created by a change
+func createdTables(c *LintChange) []string {
+	tables := make([]string, 0)
+	for _, statement := range c.Statements {
+		if tokens := createTableRegexp.FindStringSubmatch(statement.SQL); len(tokens) == 2 {
+			tables = append(tables, tableName(tokens[1]))
+		}
+	}
+	return tables
+}
+
+// lintChanges runs the rules over the changes, in order, and returns their
+// findings sorted by path and line. When pending is false the changes may
+// have been applied long ago, so a table is only new in the change that
+// creates it.
+func lintChanges(changes []*LintChange, pending bool, rules []LintRule, severities map[string]Severity) []LintFinding {
+	findings := make([]LintFinding, 0)
+	newTables := make(map[string]bool)
+
+	for _, change := range changes {
+		if !pending {
+			newTables = make(map[string]bool)
+		}
+		for _, table := range createdTables(change) {
+			newTables[table] = true
+		}
+		change.NewTables = make(map[string]bool, len(newTables))
+		for table := range newTables {
+			change.NewTables[table] = true
+		}
+
+		for _, rule := range rules {
+			severity, ok := severities[rule.Name()]
+			if !ok {
+				severity = rule.DefaultSeverity()
+			}
+			if severity == SeverityOff {
+				continue
+			}
+
+			for _, finding := range rule.Check(change) {
+				if change.isIgnored(rule.Name(), finding.Line) {
+					continue
+				}
+				finding.Path, finding.Change, finding.Rule, finding.Severity = change.Path, change.Change, rule.Name(), severity
+				findings = append(findings, finding)
+			}
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Path != findings[j].Path {
+			return findings[i].Path < findings[j].Path
+		}
+		return findings[i].Line < findings[j].Line
+	})
+
+	return findings
+}
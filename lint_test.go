@@ -0,0 +1,89 @@
+package pgit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLint(t *testing.T) {
+	lintSQL := func(t *testing.T, sql, rollback string, severities map[string]Severity) []LintFinding {
+		change, err := newLintChange("changes.sql", "a", sql, 3, rollback, 10)
+		assert.NoError(t, err, "should split the change into statements")
+		return lintChanges([]*LintChange{change}, false, defaultLintRules, severities)
+	}
+
+	t.Run("hazards", func(t *testing.T) {
+		findings := lintSQL(t, `ALTER TABLE users ADD COLUMN email text NOT NULL, ADD COLUMN name text NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX users_email ON users (email);
+ALTER TABLE users ALTER COLUMN age TYPE bigint;
+ALTER TABLE orders ADD CONSTRAINT orders_user FOREIGN KEY (user_id) REFERENCES users (id);
+ALTER TABLE orders ADD CONSTRAINT orders_item FOREIGN KEY (item_id) REFERENCES items (id) NOT VALID;
+CREATE INDEX CONCURRENTLY users_name ON users (name);
+ALTER TABLE orders ADD COLUMN shop_id int REFERENCES shops (id);`, `DROP INDEX users_email;
+DROP INDEX IF EXISTS users_name;`, nil)
+
+		assert.Equal(t, []LintFinding{
+			{Path: "changes.sql", Change: "a", Line: 3, Rule: "add-column-not-null", Severity: SeverityError, Message: "adding a NOT NULL column without a default to public.users fails if the table has rows"},
+			{Path: "changes.sql", Change: "a", Line: 4, Rule: "create-index-concurrently", Severity: SeverityWarning, Message: "CREATE INDEX blocks writes to the table while it builds, use CREATE INDEX CONCURRENTLY in a notransaction change"},
+			{Path: "changes.sql", Change: "a", Line: 5, Rule: "alter-column-type", Severity: SeverityWarning, Message: "changing the type of a column may rewrite public.users while holding an exclusive lock"},
+			{Path: "changes.sql", Change: "a", Line: 6, Rule: "foreign-key-not-valid", Severity: SeverityWarning, Message: "adding a foreign key to public.orders checks every row while locking both tables, add it NOT VALID and VALIDATE CONSTRAINT separately"},
+			{Path: "changes.sql", Change: "a", Line: 9, Rule: "foreign-key-not-valid", Severity: SeverityWarning, Message: "adding a column that references another table to public.orders locks both tables, add the column and then the foreign key NOT VALID"},
+			{Path: "changes.sql", Change: "a", Line: 10, Rule: "rollback-if-exists", Severity: SeverityWarning, Message: "DROP without IF EXISTS fails if the rollback runs after the object is already gone"},
+		}, findings, "should find each hazard")
+	})
+
+	t.Run("new tables", func(t *testing.T) {
+		findings := lintSQL(t, `CREATE TABLE public.users (id int);
+ALTER TABLE users ADD COLUMN email text NOT NULL;
+CREATE INDEX users_email ON users (email);`, "DROP TABLE IF EXISTS users;", nil)
+
+		assert.Empty(t, findings, "should allow locking tables created by the changes")
+	})
+
+	t.Run("not null constraints", func(t *testing.T) {
+		findings := lintSQL(t, `ALTER TABLE users ADD CONSTRAINT email_nn CHECK (email IS NOT NULL) NOT VALID;
+ALTER TABLE users ADD CHECK (name IS NOT NULL);`, "ALTER TABLE users DROP CONSTRAINT IF EXISTS email_nn;", nil)
+
+		assert.Empty(t, findings, "should not report constraints as NOT NULL columns")
+	})
+
+	t.Run("tables created by earlier changes", func(t *testing.T) {
+		create, err := newLintChange("changes.sql", "a", "CREATE TABLE users (id int);", 3, "DROP TABLE IF EXISTS users;", 6)
+		assert.NoError(t, err, "should split the change into statements")
+		index, err := newLintChange("changes.sql", "b", "CREATE INDEX users_id ON users (id);", 9, "DROP INDEX IF EXISTS users_id;", 12)
+		assert.NoError(t, err, "should split the change into statements")
+
+		assert.Equal(t, []LintFinding{
+			{Path: "changes.sql", Change: "b", Line: 9, Rule: "create-index-concurrently", Severity: SeverityWarning, Message: "CREATE INDEX blocks writes to the table while it builds, use CREATE INDEX CONCURRENTLY in a notransaction change"},
+		}, lintChanges([]*LintChange{create, index}, false, defaultLintRules, nil), "should not treat tables created by applied changes as new")
+
+		assert.Empty(
+			t,
+			lintChanges([]*LintChange{create, index}, true, defaultLintRules, nil),
+			"should treat tables created by pending changes as new",
+		)
+	})
+
+	t.Run("empty rollback", func(t *testing.T) {
+		findings := lintSQL(t, "SELECT 1;", "-- nothing to do\n", nil)
+
+		assert.Equal(t, []LintFinding{
+			{Path: "changes.sql", Change: "a", Line: 9, Rule: "empty-rollback", Severity: SeverityWarning, Message: "the rollback is empty, so rolling back leaves the change in place"},
+		}, findings, "should report the rollback annotation")
+	})
+
+	t.Run("suppressions and severities", func(t *testing.T) {
+		findings := lintSQL(t, `-- pgit:ignore create-index-concurrently
+CREATE INDEX users_email ON users (email);
+ALTER TABLE users ALTER COLUMN age TYPE bigint; -- pgit:ignore alter-column-type,create-index-concurrently
+CREATE INDEX users_name ON users (name);`, "DROP INDEX users_email;", map[string]Severity{
+			"create-index-concurrently": SeverityError,
+			"rollback-if-exists":        SeverityOff,
+		})
+
+		assert.Equal(t, []LintFinding{
+			{Path: "changes.sql", Change: "a", Line: 6, Rule: "create-index-concurrently", Severity: SeverityError, Message: "CREATE INDEX blocks writes to the table while it builds, use CREATE INDEX CONCURRENTLY in a notransaction change"},
+		}, findings, "should skip ignored findings and apply configured severities")
+	})
+}
@@ -1,22 +1,49 @@
 package pgit
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/chriscasola/sqlgo"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
+// ErrLocked is the cause of the error returned when another migration holds
+// the advisory lock for longer than the lock wait
+var ErrLocked = errors.New("another migration holds the advisory lock")
+
+// locker is implemented by connections that can prevent migrations from
+// running concurrently
+type locker interface {
+	lock() (unlock func() error, err error)
+}
+
 // DatabaseConnection defines the interface to connections to various
 // types of databases.
 type DatabaseConnection interface {
 	readMigrationState() (*migrationState, error)
+	readRecordedState() (*migrationState, error)
 	applyAndUpdateStateForFile(f *fileMigrationState, updateSQL string, newVersion string, migration *migration) error
+	applyWithoutTransaction(f *fileMigrationState, updateSQL string, newVersion string, migration *migration) error
 	createNewMigration() (*migration, error)
+	createAdoptedMigration() (*migration, error)
 	finishMigration(m *migration) error
 	rollbackFile(f *fileMigrationState, rollbackSQL string, newVersion string, lastMigration *migration) error
 	removeMigration(m *migration) error
 	getFilesInMigration(m *migration) ([]fileMigrationState, error)
+	runInRolledBackTransaction(statements []string) ([]statementResult, error)
+	readGrants(roles []string, schemas []string) ([]grant, error)
+	readExtensions(names []string) ([]catalogExtension, error)
+	executeHook(sql string) error
+	readHistory() ([]MigrationRecord, error)
+	snapshotCatalog() ([]string, error)
+	dumpSchema() ([]schemaObject, error)
+	readVersionTable(tool MigrationTool, table string) ([]string, error)
 }
 
 // SQLDatabaseConnection contains pointers to the data about what migration state
@@ -26,26 +53,185 @@ type SQLDatabaseConnection struct {
 	dbURL     string
 	tableName string
 	executor  *sqlgo.Executor
+	db        *sql.DB
+
+	lockEnabled bool
+	lockKey     int64
+	lockWait    time.Duration
+	parameters  map[string]string
+
+	// settings are the SET and RESET statements run by hook files, which
+	// are run again on every connection taken from the pool so that they
+	// apply to the whole migration
+	settings []string
 }
 
+// ConnectionOption configures optional behavior of a SQLDatabaseConnection
+type ConnectionOption func(d *SQLDatabaseConnection)
+
+// AdvisoryLock makes migrations and rollbacks hold the Postgres advisory lock
+// with the given key, so that only one can run against the database at a
+// time. If the lock is held elsewhere pgit waits up to wait for it.
+func AdvisoryLock(key int64, wait time.Duration) ConnectionOption {
+	return func(d *SQLDatabaseConnection) {
+		d.lockEnabled = true
+		d.lockKey = key
+		d.lockWait = wait
+	}
+}
+
+// StatementTimeout sets the statement_timeout for the connections used to
+// migrate the database
+func StatementTimeout(timeout time.Duration) ConnectionOption {
+	return func(d *SQLDatabaseConnection) {
+		d.parameters["statement_timeout"] = fmt.Sprint(int64(timeout / time.Millisecond))
+	}
+}
+
+// LockTimeout sets the lock_timeout for the connections used to migrate the
+// database
+func LockTimeout(timeout time.Duration) ConnectionOption {
+	return func(d *SQLDatabaseConnection) {
+		d.parameters["lock_timeout"] = fmt.Sprint(int64(timeout / time.Millisecond))
+	}
+}
+
+// defaultLockKey is the advisory lock key used when none is configured
+const defaultLockKey = 7361526870
+
 // NewSQLDatabaseConnection returns a new DatabaseConnection using the given database
 // URL and table name to track the migration state. If tableName is the empty
 // string then the default table name of "pgit" will be used.
-func NewSQLDatabaseConnection(dbURL, tableName string) (*SQLDatabaseConnection, error) {
+func NewSQLDatabaseConnection(dbURL, tableName string, options ...ConnectionOption) (*SQLDatabaseConnection, error) {
+	d := &SQLDatabaseConnection{parameters: make(map[string]string)}
+	for _, option := range options {
+		option(d)
+	}
+
+	if d.lockEnabled && d.lockKey == 0 {
+		d.lockKey = defaultLockKey
+	}
+
+	dbURL, err := withParameters(dbURL, d.parameters)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid database URL")
+	}
+
 	executor, err := sqlgo.NewExecutor(dbURL)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to connect to database")
 	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to database")
+	}
 	if tableName == "" {
 		tableName = "pgit"
 	}
-	return &SQLDatabaseConnection{dbURL: dbURL, tableName: tableName, executor: executor}, nil
+	d.dbURL, d.tableName, d.executor, d.db = dbURL, tableName, executor, db
+	return d, nil
+}
+
+// withParameters adds run-time parameters such as statement_timeout to a
+// database URL or key=value connection string
+func withParameters(dbURL string, parameters map[string]string) (string, error) {
+	if len(parameters) == 0 {
+		return dbURL, nil
+	}
+
+	if strings.HasPrefix(dbURL, "postgres://") || strings.HasPrefix(dbURL, "postgresql://") {
+		u, err := url.Parse(dbURL)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		for name, value := range parameters {
+			query.Set(name, value)
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	for _, name := range sortedKeys(stringSet(parameters)) {
+		dbURL += fmt.Sprintf(" %v=%v", name, parameters[name])
+	}
+
+	return strings.TrimSpace(dbURL), nil
+}
+
+func stringSet(m map[string]string) map[string]bool {
+	set := make(map[string]bool, len(m))
+	for k := range m {
+		set[k] = true
+	}
+	return set
+}
+
+// lock takes the advisory lock, if enabled, and returns a function that
+// releases it. Session level advisory locks belong to a connection, so a
+// connection is reserved until the lock is released.
+func (d *SQLDatabaseConnection) lock() (func() error, error) {
+	if !d.lockEnabled {
+		return func() error { return nil }, nil
+	}
+
+	// the lock is held on a connection of its own, which is closed rather
+	// than returned to the pool so that the lock is never left behind
+	lockDB, err := sql.Open("postgres", d.dbURL)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to database for the advisory lock")
+	}
+
+	ctx := context.Background()
+	conn, err := lockDB.Conn(ctx)
+
+	if err != nil {
+		lockDB.Close()
+		return nil, errors.Wrap(err, "unable to reserve a connection for the advisory lock")
+	}
+
+	closeLock := func() {
+		conn.Close()
+		lockDB.Close()
+	}
+
+	deadline := time.Now().Add(d.lockWait)
+
+	for {
+		var acquired bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", d.lockKey).Scan(&acquired); err != nil {
+			closeLock()
+			return nil, errors.Wrap(err, "unable to take advisory lock")
+		}
+
+		if acquired {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			closeLock()
+			return nil, errors.Wrapf(ErrLocked, "unable to take advisory lock %v", d.lockKey)
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	return func() error {
+		defer closeLock()
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", d.lockKey)
+		return errors.Wrap(err, "unable to release advisory lock")
+	}, nil
 }
 
 type fileMigrationState struct {
 	version   string
 	path      string
 	migration int
+
+	// previous is the version of the file before the migration, for the
+	// files returned by getFilesInMigration
+	previous string
 }
 
 func (f *fileMigrationState) FromRow(s sqlgo.ScannerFunction) error {
@@ -55,10 +241,14 @@ func (f *fileMigrationState) FromRow(s sqlgo.ScannerFunction) error {
 type migration struct {
 	id        int
 	completed bool
+
+	// adopted is set for migrations that recorded versions without running
+	// any SQL, such as a baseline, so rolling them back only removes them
+	adopted bool
 }
 
 func (m *migration) FromRow(s sqlgo.ScannerFunction) error {
-	return s(&m.id, &m.completed)
+	return s(&m.id, &m.completed, &m.adopted)
 }
 
 type migrationState struct {
@@ -70,13 +260,54 @@ func newMigrationState() *migrationState {
 	return &migrationState{fileStates: make(map[string]*fileMigrationState), lastMigration: &migration{}}
 }
 
-func (d *SQLDatabaseConnection) readMigrationState() (*migrationState, error) {
-	result, err := d.executor.Query(`
-		CREATE TABLE IF NOT EXISTS ` + d.tableName + `_migrations (
+// migrationsTableSQL creates the table of migrations, and the columns added
+// to it since it was first created, if they do not exist
+func migrationsTableSQL(tableName string) string {
+	return `
+		CREATE TABLE IF NOT EXISTS ` + tableName + `_migrations (
 			id serial PRIMARY KEY,
 			completed boolean DEFAULT false NOT NULL
 		);
-		SELECT id, completed FROM ` + d.tableName + `_migrations ORDER BY id DESC LIMIT 1;`,
+		ALTER TABLE ` + tableName + `_migrations
+			ADD COLUMN IF NOT EXISTS started_at timestamptz,
+			ADD COLUMN IF NOT EXISTS finished_at timestamptz,
+			ADD COLUMN IF NOT EXISTS adopted boolean DEFAULT false NOT NULL;`
+}
+
+// filesTableSQL creates the table of file versions if it does not exist. It
+// holds the version of each file changed by a migration as of the end of that
+// migration. Tables created by earlier versions of pgit were keyed by file and
+// version, and are rekeyed by file and migration.
+func filesTableSQL(tableName string) string {
+	return `
+		CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+			file text NOT NULL,
+			version text NOT NULL,
+			migration integer NOT NULL REFERENCES ` + tableName + `_migrations (id),
+			PRIMARY KEY (file, migration)
+		);
+		DO $pgit$
+		DECLARE
+			key name;
+		BEGIN
+			SELECT conname INTO key FROM pg_constraint c
+			WHERE c.conrelid = '` + tableName + `'::regclass AND c.contype = 'p' AND c.conkey = ARRAY(
+				SELECT attnum FROM pg_attribute WHERE attrelid = c.conrelid AND attname IN ('file', 'version') ORDER BY attnum
+			);
+			IF key IS NOT NULL THEN
+				EXECUTE format('ALTER TABLE %s DROP CONSTRAINT %I, ADD PRIMARY KEY (file, migration)', '` + tableName + `', key);
+			END IF;
+		END
+		$pgit$;`
+}
+
+// readMigrationState creates the tables that track the migration state, or
+// upgrades them, and reads the last migration and the version of every file.
+// It is only used by commands that change the database.
+func (d *SQLDatabaseConnection) readMigrationState() (*migrationState, error) {
+	result, err := d.executor.Query(
+		migrationsTableSQL(d.tableName) + `
+		SELECT id, completed, adopted FROM ` + d.tableName + `_migrations ORDER BY id DESC LIMIT 1;`,
 	)
 
 	if err != nil {
@@ -97,14 +328,9 @@ func (d *SQLDatabaseConnection) readMigrationState() (*migrationState, error) {
 		return nil, errors.Wrap(err, "error reading result from migrations table")
 	}
 
-	filesResult, err := d.executor.Query(`
-		CREATE TABLE IF NOT EXISTS ` + d.tableName + ` (
-			file text NOT NULL,
-			version text NOT NULL,
-			migration integer NOT NULL REFERENCES ` + d.tableName + `_migrations (id),
-			PRIMARY KEY (file, version)
-		);
-		SELECT file, version, migration FROM ` + d.tableName + `;`,
+	filesResult, err := d.executor.Query(
+		filesTableSQL(d.tableName) + `
+		SELECT DISTINCT ON (file) file, version, migration FROM ` + d.tableName + ` ORDER BY file, migration DESC;`,
 	)
 
 	if err != nil {
@@ -128,134 +354,1014 @@ func (d *SQLDatabaseConnection) readMigrationState() (*migrationState, error) {
 	return m, nil
 }
 
-func (d *SQLDatabaseConnection) createNewMigration() (*migration, error) {
-	result, err := d.executor.Query(`
-		INSERT INTO ` + d.tableName + `_migrations (completed) VALUES (false) RETURNING id, completed;
-	`)
+// readRecordedState reads the version of every file without creating the
+// tables that track the migration state, so that it can be used with a
+// read-only connection. A file has a row for each migration that changed it,
+// the latest of which holds its version. A database without the tables has no
+// files applied.
+func (d *SQLDatabaseConnection) readRecordedState() (*migrationState, error) {
+	var exists bool
+
+	err := d.db.QueryRow(
+		`SELECT to_regclass($1) IS NOT NULL AND to_regclass($2) IS NOT NULL`,
+		d.tableName, d.tableName+"_migrations",
+	).Scan(&exists)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to create new migration in database")
+		return nil, errors.Wrap(err, "unable to find the migration state tables")
 	}
 
-	defer result.Close()
+	m := newMigrationState()
 
-	if !result.Next() {
-		return nil, errors.New("no migration created in database")
+	if !exists {
+		return m, nil
 	}
 
-	m := &migration{}
+	rows, err := d.db.Query(`SELECT DISTINCT ON (file) file, version, migration FROM ` + d.tableName + ` ORDER BY file, migration DESC`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read migration state from database")
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		f := &fileMigrationState{}
+		if err := rows.Scan(&f.path, &f.version, &f.migration); err != nil {
+			return nil, errors.Wrap(err, "error reading file migration state")
+		}
+		m.fileStates[f.path] = f
+	}
 
-	if err = result.Read(m); err != nil {
-		return nil, errors.Wrap(err, "failed to read new migration from database")
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading file migration states")
 	}
 
 	return m, nil
 }
 
+// begin starts a transaction on a connection from the pool with the settings
+// made by hook files applied
+func (d *SQLDatabaseConnection) begin() (*sql.Tx, error) {
+	tx, err := d.db.Begin()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to start transaction")
+	}
+
+	for _, setting := range d.settings {
+		if _, err := tx.Exec(setting); err != nil {
+			tx.Rollback()
+			return nil, errors.Wrapf(err, "unable to apply hook setting (%v)", firstLine(setting))
+		}
+	}
+
+	return tx, nil
+}
+
+func (d *SQLDatabaseConnection) createNewMigration() (*migration, error) {
+	return d.insertMigration(false)
+}
+
+// createAdoptedMigration creates a migration that records versions without
+// running any SQL, which rolling back only removes
+func (d *SQLDatabaseConnection) createAdoptedMigration() (*migration, error) {
+	return d.insertMigration(true)
+}
+
+func (d *SQLDatabaseConnection) insertMigration(adopted bool) (*migration, error) {
+	tx, err := d.begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := &migration{}
+
+	err = tx.QueryRow(`
+		INSERT INTO `+d.tableName+`_migrations (completed, started_at, adopted) VALUES (false, now(), $1)
+		RETURNING id, completed, adopted;
+	`, adopted).Scan(&m.id, &m.completed, &m.adopted)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(err, "unable to create new migration in database")
+	}
+
+	return m, tx.Commit()
+}
+
 func (d *SQLDatabaseConnection) applyAndUpdateStateForFile(
 	f *fileMigrationState,
 	updateSQL string,
 	newFileVersion string,
 	migration *migration,
 ) error {
-	sql := fmt.Sprintf(`
-		BEGIN;
-		%v	
-		INSERT INTO %v (file, version, migration)
-		VALUES ('%v', '%v', %v);
-		COMMIT;
-	`, updateSQL, d.tableName, f.path, newFileVersion, migration.id)
+	tx, err := d.begin()
+
+	if err != nil {
+		return err
+	}
+
+	if err = execStatements(tx, updateSQL); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = d.recordFileVersion(tx, f, newFileVersion, migration); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// applyWithoutTransaction executes each statement on its own, outside of a
+// transaction, for statements such as CREATE INDEX CONCURRENTLY that
+// Postgres refuses to run inside of one. The previous version of the file has
+// already been recorded by the time this runs, and the new version is only
+// recorded once every statement has succeeded.
+func (d *SQLDatabaseConnection) applyWithoutTransaction(
+	f *fileMigrationState,
+	updateSQL string,
+	newFileVersion string,
+	migration *migration,
+) error {
+	statements, err := splitStatements(updateSQL)
+
+	if err != nil {
+		return errors.Wrap(err, "unable to split SQL into statements")
+	}
+
+	ctx := context.Background()
+	conn, err := d.db.Conn(ctx)
+
+	if err != nil {
+		return errors.Wrap(err, "unable to reserve a connection")
+	}
+
+	defer conn.Close()
+
+	for _, setting := range d.settings {
+		if _, err := conn.ExecContext(ctx, setting); err != nil {
+			return errors.Wrapf(err, "unable to apply hook setting (%v)", firstLine(setting))
+		}
+	}
 
-	result, err := d.executor.Query(sql)
+	for i, s := range statements {
+		if _, err := conn.ExecContext(ctx, s.sql); err != nil {
+			return errors.Wrapf(err, "statement %v of %v failed (line %v: %v)", i+1, len(statements), s.line, firstLine(s.sql))
+		}
+	}
+
+	tx, err := d.begin()
 
 	if err != nil {
 		return err
 	}
 
-	defer result.Close()
+	if err = d.recordFileVersion(tx, f, newFileVersion, migration); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// recordFileVersion records that the file is at the new version as of the
+// given migration, replacing the version the migration recorded for it
+// earlier. Nothing is recorded when the version is unchanged, which happens
+// when only runAlways changesets were executed, and an empty version removes
+// the file from the migration.
+func (d *SQLDatabaseConnection) recordFileVersion(tx *sql.Tx, f *fileMigrationState, newFileVersion string, migration *migration) error {
+	if newFileVersion == f.version {
+		return nil
+	}
+
+	var err error
+
+	if newFileVersion == "" {
+		_, err = tx.Exec(`
+			DELETE FROM `+d.tableName+` WHERE file = $1 AND migration = $2;
+		`, f.path, migration.id)
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO `+d.tableName+` (file, version, migration) VALUES ($1, $2, $3)
+			ON CONFLICT (file, migration) DO UPDATE SET version = EXCLUDED.version;
+		`, f.path, newFileVersion, migration.id)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "unable to record new version of file")
+	}
 
 	return nil
 }
 
+// rollbackFile executes the rollback SQL and records the version the file
+// is rolled back to in a single transaction
 func (d *SQLDatabaseConnection) rollbackFile(f *fileMigrationState, rollbackSQL string, newVersion string, m *migration) error {
-	sql := fmt.Sprintf(`
-		BEGIN;
-		%v
-		DELETE FROM %v WHERE file = '%v'AND migration = '%v';
-		COMMIT;
-	`, rollbackSQL, d.tableName, f.path, m.id)
+	return d.applyAndUpdateStateForFile(f, rollbackSQL, newVersion, m)
+}
 
-	result, err := d.executor.Query(sql)
+// execStatements splits the SQL into individual statements and executes them
+// one at a time so that failures identify the statement that caused them.
+func execStatements(tx *sql.Tx, script string) error {
+	statements, err := splitStatements(script)
 
 	if err != nil {
-		return err
+		return errors.Wrap(err, "unable to split SQL into statements")
 	}
 
-	defer result.Close()
+	for i, s := range statements {
+		if _, err := tx.Exec(s.sql); err != nil {
+			return errors.Wrapf(err, "statement %v of %v failed (line %v: %v)", i+1, len(statements), s.line, firstLine(s.sql))
+		}
+	}
 
 	return nil
 }
 
+// firstLine returns the first line of a statement for use in error messages
+func firstLine(statement string) string {
+	if i := strings.IndexAny(statement, "\r\n"); i != -1 {
+		return statement[:i] + " ..."
+	}
+	return statement
+}
+
+// removeMigration removes a migration along with the file versions it
+// recorded
 func (d *SQLDatabaseConnection) removeMigration(m *migration) error {
-	result, err := d.executor.Query(`
-		DELETE FROM `+d.tableName+`_migrations WHERE id = $1;
-	`, m.id)
+	tx, err := d.begin()
 
 	if err != nil {
 		return err
 	}
 
-	defer result.Close()
+	_, err = tx.Exec(`
+		WITH files AS (DELETE FROM `+d.tableName+` WHERE migration = $1)
+		DELETE FROM `+d.tableName+`_migrations WHERE id = $1;
+	`, m.id)
 
-	return nil
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to remove migration from the database")
+	}
+
+	return tx.Commit()
 }
 
 func (d *SQLDatabaseConnection) finishMigration(m *migration) error {
-	result, err := d.executor.Query(`
-		UPDATE `+d.tableName+`_migrations SET completed = true WHERE id = $1 RETURNING id, completed;
-	`, m.id)
+	tx, err := d.begin()
 
 	if err != nil {
-		return errors.Wrap(err, "unable to mark migration as finished in the database")
+		return err
 	}
 
-	defer result.Close()
+	err = tx.QueryRow(`
+		UPDATE `+d.tableName+`_migrations SET completed = true, finished_at = now() WHERE id = $1 RETURNING id, completed;
+	`, m.id).Scan(&m.id, &m.completed)
 
-	if !result.Next() {
+	if err == sql.ErrNoRows {
+		tx.Rollback()
 		return errors.New("unable to finish migration because the migration does not exist in the database")
 	}
 
-	if err = result.Read(m); err != nil {
-		return errors.Wrap(err, "unable to udpate migration state in database")
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to mark migration as finished in the database")
 	}
 
-	return nil
+	return tx.Commit()
 }
 
+// getFilesInMigration returns the files changed by a migration along with the
+// version each was at before it
 func (d *SQLDatabaseConnection) getFilesInMigration(m *migration) ([]fileMigrationState, error) {
-	result, err := d.executor.Query(`
-		SELECT file, version, migration FROM `+d.tableName+` WHERE migration = $1;
+	rows, err := d.db.Query(`
+		SELECT f.file, f.version, f.migration, coalesce((
+			SELECT p.version FROM `+d.tableName+` p WHERE p.file = f.file AND p.migration < f.migration
+			ORDER BY p.migration DESC LIMIT 1
+		), '')
+		FROM `+d.tableName+` f WHERE f.migration = $1 ORDER BY f.file;
 	`, m.id)
 
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to determine files in migration %v", m.id)
 	}
 
-	defer result.Close()
+	defer rows.Close()
 
 	files := make([]fileMigrationState, 0)
 
-	for result.Next() {
+	for rows.Next() {
 		file := fileMigrationState{}
-		if err := result.Read(&file); err != nil {
+		if err := rows.Scan(&file.path, &file.version, &file.migration, &file.previous); err != nil {
 			return nil, errors.Wrapf(err, "unable to deserialize file migration state for migration %v", m.id)
 		}
 		files = append(files, file)
 	}
 
-	if result.Err() != nil {
+	if err := rows.Err(); err != nil {
 		return nil, errors.Wrapf(err, "unable to deserialize file migration state for migration %v", m.id)
 	}
 
 	return files, nil
 }
+
+// historyRow is a file version applied by a migration, or a migration that
+// applied no files, as read by readHistory
+type historyRow struct {
+	id         int
+	completed  bool
+	startedAt  pq.NullTime
+	finishedAt pq.NullTime
+	file       sql.NullString
+	version    sql.NullString
+}
+
+// readHistory returns every migration recorded in the database, oldest first,
+// with the versions of the files it applied. The tables are not created or
+// upgraded, so the times of migrations are read through to_jsonb, which does
+// not fail for tables created before they were recorded.
+func (d *SQLDatabaseConnection) readHistory() ([]MigrationRecord, error) {
+	var exists bool
+
+	err := d.db.QueryRow(
+		`SELECT to_regclass($1) IS NOT NULL AND to_regclass($2) IS NOT NULL`,
+		d.tableName, d.tableName+"_migrations",
+	).Scan(&exists)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find the migration state tables")
+	}
+
+	if !exists {
+		return make([]MigrationRecord, 0), nil
+	}
+
+	rows, err := d.db.Query(`
+		SELECT m.id, m.completed, (to_jsonb(m) ->> 'started_at')::timestamptz,
+			(to_jsonb(m) ->> 'finished_at')::timestamptz, f.file, f.version
+		FROM ` + d.tableName + `_migrations m
+		LEFT JOIN ` + d.tableName + ` f ON f.migration = m.id
+		ORDER BY m.id, f.file;
+	`)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read migration history")
+	}
+
+	defer rows.Close()
+
+	historyRows := make([]historyRow, 0)
+
+	for rows.Next() {
+		row := historyRow{}
+		if err := rows.Scan(&row.id, &row.completed, &row.startedAt, &row.finishedAt, &row.file, &row.version); err != nil {
+			return nil, errors.Wrap(err, "error reading migration history")
+		}
+		historyRows = append(historyRows, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading migration history")
+	}
+
+	return migrationRecords(historyRows), nil
+}
+
+// migrationRecords groups the rows read by readHistory, which are ordered by
+// migration, into a record for each migration
+func migrationRecords(rows []historyRow) []MigrationRecord {
+	history := make([]MigrationRecord, 0)
+
+	for _, row := range rows {
+		if len(history) == 0 || history[len(history)-1].ID != row.id {
+			history = append(history, MigrationRecord{
+				ID:         row.id,
+				Completed:  row.completed,
+				StartedAt:  row.startedAt.Time,
+				FinishedAt: row.finishedAt.Time,
+				Files:      make([]FileVersion, 0),
+			})
+		}
+
+		if row.file.Valid {
+			m := &history[len(history)-1]
+			m.Files = append(m.Files, FileVersion{Path: row.file.String, Version: row.version.String})
+		}
+	}
+
+	return history
+}
+
+// catalogQuery describes every schema, relation, column, index, constraint,
+// view, function, trigger, type, extension and grant in the database as one
+// line of text each, leaving out the system schemas and the tables pgit uses
+// to track migrations. Functions are described by a hash of their source and
+// the privileges owners hold implicitly are left out.
+const catalogQuery = `
+	WITH namespaces AS (
+		SELECT oid, nspname, nspowner, nspacl FROM pg_namespace
+		WHERE nspname NOT IN ('pg_catalog', 'information_schema') AND nspname NOT LIKE 'pg\_toast%' AND nspname NOT LIKE 'pg\_temp%'
+	), relations AS (
+		SELECT c.oid, n.nspname, c.relname, c.relkind, c.relowner, c.relacl FROM pg_class c JOIN namespaces n ON n.oid = c.relnamespace
+		WHERE c.relname::text NOT IN ($1::text, $2::text, $2::text || '_id_seq', $1::text || '_pkey', $2::text || '_pkey')
+	)
+	SELECT 'schema ' || nspname FROM namespaces
+	UNION ALL
+	SELECT 'relation ' || nspname || '.' || relname || ' ' || relkind::text FROM relations WHERE relkind IN ('r', 'p', 'v', 'm', 'S', 'f', 'c')
+	UNION ALL
+	SELECT 'column ' || r.nspname || '.' || r.relname || '.' || a.attname || ' ' || format_type(a.atttypid, a.atttypmod) ||
+		CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END || COALESCE(' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid), '')
+	FROM relations r JOIN pg_attribute a ON a.attrelid = r.oid
+	LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+	WHERE r.relkind IN ('r', 'p', 'v', 'm', 'f', 'c') AND a.attnum > 0 AND NOT a.attisdropped
+	UNION ALL
+	SELECT 'index ' || r.nspname || '.' || r.relname || ' ' || pg_get_indexdef(r.oid) FROM relations r WHERE r.relkind IN ('i', 'I')
+	UNION ALL
+	SELECT 'constraint ' || r.nspname || '.' || r.relname || '.' || con.conname || ' ' || pg_get_constraintdef(con.oid)
+	FROM pg_constraint con JOIN relations r ON r.oid = con.conrelid
+	UNION ALL
+	SELECT 'view ' || r.nspname || '.' || r.relname || ' ' || pg_get_viewdef(r.oid) FROM relations r WHERE r.relkind IN ('v', 'm')
+	UNION ALL
+	SELECT 'function ' || n.nspname || '.' || p.proname || '(' || pg_get_function_identity_arguments(p.oid) || ') ' || md5(COALESCE(p.prosrc, ''))
+	FROM pg_proc p JOIN namespaces n ON n.oid = p.pronamespace
+	WHERE NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = p.oid AND d.deptype = 'e')
+	UNION ALL
+	SELECT 'trigger ' || r.nspname || '.' || r.relname || ' ' || pg_get_triggerdef(t.oid)
+	FROM pg_trigger t JOIN relations r ON r.oid = t.tgrelid WHERE NOT t.tgisinternal
+	UNION ALL
+	SELECT 'type ' || n.nspname || '.' || t.typname || ' ' || t.typtype::text || COALESCE(' ' || (
+		SELECT string_agg(e.enumlabel, ',' ORDER BY e.enumsortorder) FROM pg_enum e WHERE e.enumtypid = t.oid
+	), '')
+	FROM pg_type t JOIN namespaces n ON n.oid = t.typnamespace
+	WHERE t.typtype IN ('e', 'd') AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = t.oid AND d.deptype = 'e')
+	UNION ALL
+	SELECT 'grant schema ' || n.nspname || ' ' || CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE pg_get_userbyid(a.grantee)::text END || ' ' || a.privilege_type
+	FROM namespaces n, aclexplode(n.nspacl) a WHERE a.grantee <> n.nspowner
+	UNION ALL
+	SELECT 'grant ' || r.nspname || '.' || r.relname || ' ' || CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE pg_get_userbyid(a.grantee)::text END || ' ' || a.privilege_type
+	FROM relations r, aclexplode(r.relacl) a WHERE a.grantee <> r.relowner
+	UNION ALL
+	SELECT 'extension ' || extname || ' ' || extversion FROM pg_extension
+	ORDER BY 1;
+`
+
+// snapshotCatalog returns a description of every object in the database
+// that a schema file can create, one object per line, in order
+func (d *SQLDatabaseConnection) snapshotCatalog() ([]string, error) {
+	rows, err := d.db.Query(catalogQuery, d.tableName, d.tableName+"_migrations")
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read the database catalog")
+	}
+
+	defer rows.Close()
+
+	objects := make([]string, 0)
+
+	for rows.Next() {
+		var object string
+		if err := rows.Scan(&object); err != nil {
+			return nil, errors.Wrap(err, "unable to read the database catalog")
+		}
+		objects = append(objects, object)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read the database catalog")
+	}
+
+	return objects, nil
+}
+
+// schemaObject is an object in the database described by the SQL that
+// creates it and, for objects that do not belong to a table, the SQL that
+// drops it
+type schemaObject struct {
+	identity string
+	create   string
+	drop     string
+}
+
+// dumpQuery returns the SQL that recreates every object in the database
+// outside of the system schemas and the tables pgit uses to track migrations,
+// in an order in which it can be run, in the style of pg_dump --schema-only.
+// Partitions are created after the tables they belong to, and it reads
+// catalog columns added in Postgres 12, such as attgenerated.
+const dumpQuery = `
+	WITH namespaces AS (
+		SELECT oid, nspname, nspowner, nspacl FROM pg_namespace
+		WHERE nspname NOT IN ('pg_catalog', 'information_schema') AND nspname NOT LIKE 'pg\_toast%' AND nspname NOT LIKE 'pg\_temp%'
+	), relations AS (
+		SELECT c.oid, n.nspname, c.relname, c.relkind, c.relpersistence, c.relispartition, c.relpartbound, c.relowner, c.relacl,
+			quote_ident(n.nspname) || '.' || quote_ident(c.relname) AS qualified
+		FROM pg_class c JOIN namespaces n ON n.oid = c.relnamespace
+		WHERE c.relname::text NOT IN ($1::text, $2::text, $2::text || '_id_seq', $1::text || '_pkey', $2::text || '_pkey')
+		AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = c.oid AND d.deptype = 'e')
+	), objects AS (
+		SELECT 0 AS position, e.oid, 'extension ' || e.extname AS identity,
+			'CREATE EXTENSION IF NOT EXISTS ' || quote_ident(e.extname) || ';' AS create_sql,
+			'DROP EXTENSION IF EXISTS ' || quote_ident(e.extname) || ';' AS drop_sql
+		FROM pg_extension e WHERE e.extname <> 'plpgsql'
+		UNION ALL
+		SELECT 1, n.oid, 'schema ' || n.nspname,
+			'CREATE SCHEMA ' || quote_ident(n.nspname) || ';',
+			'DROP SCHEMA IF EXISTS ' || quote_ident(n.nspname) || ';'
+		FROM namespaces n WHERE n.nspname <> 'public'
+		UNION ALL
+		SELECT 2, t.oid, 'type ' || n.nspname || '.' || t.typname,
+			CASE WHEN t.typtype = 'e' THEN
+				'CREATE TYPE ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) || ' AS ENUM (' ||
+				COALESCE((SELECT string_agg(quote_literal(e.enumlabel), ', ' ORDER BY e.enumsortorder) FROM pg_enum e WHERE e.enumtypid = t.oid), '') || ');'
+			ELSE
+				'CREATE DOMAIN ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) || ' AS ' || format_type(t.typbasetype, t.typtypmod) ||
+				COALESCE(' DEFAULT ' || t.typdefault, '') || CASE WHEN t.typnotnull THEN ' NOT NULL' ELSE '' END ||
+				COALESCE((
+					SELECT string_agg(' CONSTRAINT ' || quote_ident(con.conname) || ' ' || pg_get_constraintdef(con.oid), '' ORDER BY con.conname)
+					FROM pg_constraint con WHERE con.contypid = t.oid AND con.contype = 'c'
+				), '') || ';'
+			END,
+			'DROP ' || CASE WHEN t.typtype = 'e' THEN 'TYPE' ELSE 'DOMAIN' END || ' IF EXISTS ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) || ';'
+		FROM pg_type t JOIN namespaces n ON n.oid = t.typnamespace
+		WHERE t.typtype IN ('e', 'd') AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = t.oid AND d.deptype = 'e')
+		UNION ALL
+		SELECT 3, r.oid, 'sequence ' || r.nspname || '.' || r.relname,
+			'CREATE SEQUENCE ' || r.qualified || ' AS ' || format_type(s.seqtypid, NULL) || ' INCREMENT BY ' || s.seqincrement ||
+			' MINVALUE ' || s.seqmin || ' MAXVALUE ' || s.seqmax || ' START WITH ' || s.seqstart || ' CACHE ' || s.seqcache ||
+			CASE WHEN s.seqcycle THEN ' CYCLE' ELSE '' END || ';',
+			'DROP SEQUENCE IF EXISTS ' || r.qualified || ';'
+		FROM relations r JOIN pg_sequence s ON s.seqrelid = r.oid
+		WHERE r.relkind = 'S' AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = r.oid AND d.deptype = 'i')
+		UNION ALL
+		SELECT 4, p.oid, 'function ' || n.nspname || '.' || p.proname || '(' || pg_get_function_identity_arguments(p.oid) || ')',
+			rtrim(pg_get_functiondef(p.oid), E'\n') || ';',
+			'DROP ' || CASE WHEN p.prokind = 'p' THEN 'PROCEDURE' ELSE 'FUNCTION' END || ' IF EXISTS ' ||
+			quote_ident(n.nspname) || '.' || quote_ident(p.proname) || '(' || pg_get_function_identity_arguments(p.oid) || ');'
+		FROM pg_proc p JOIN namespaces n ON n.oid = p.pronamespace
+		WHERE p.prokind IN ('f', 'p') AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = p.oid AND d.deptype = 'e')
+		UNION ALL
+		SELECT CASE WHEN r.relispartition THEN 6 ELSE 5 END, r.oid, 'table ' || r.nspname || '.' || r.relname,
+			'CREATE ' || CASE WHEN r.relpersistence = 'u' THEN 'UNLOGGED ' ELSE '' END || 'TABLE ' || r.qualified ||
+			CASE WHEN r.relispartition THEN
+				' PARTITION OF ' || (SELECT p.qualified FROM pg_inherits i JOIN relations p ON p.oid = i.inhparent WHERE i.inhrelid = r.oid) ||
+				' ' || pg_get_expr(r.relpartbound, r.oid)
+			ELSE ' (' || COALESCE((
+				SELECT string_agg(
+					E'\n    ' || quote_ident(a.attname) || ' ' || format_type(a.atttypid, a.atttypmod) ||
+					CASE WHEN a.attgenerated = 's' THEN ' GENERATED ALWAYS AS (' || pg_get_expr(d.adbin, d.adrelid) || ') STORED'
+						ELSE COALESCE(' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid), '') END ||
+					CASE a.attidentity WHEN 'a' THEN ' GENERATED ALWAYS AS IDENTITY' WHEN 'd' THEN ' GENERATED BY DEFAULT AS IDENTITY' ELSE '' END ||
+					CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END,
+					',' ORDER BY a.attnum
+				)
+				FROM pg_attribute a LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+				WHERE a.attrelid = r.oid AND a.attnum > 0 AND NOT a.attisdropped
+			), '') || E'\n)' END ||
+			CASE WHEN r.relkind = 'p' THEN ' PARTITION BY ' || pg_get_partkeydef(r.oid) ELSE '' END || ';',
+			'DROP TABLE IF EXISTS ' || r.qualified || ';'
+		FROM relations r WHERE r.relkind IN ('r', 'p')
+		UNION ALL
+		SELECT 6, r.oid, 'sequence owner ' || r.nspname || '.' || r.relname,
+			'ALTER SEQUENCE ' || r.qualified || ' OWNED BY ' || t.qualified || '.' || quote_ident(a.attname) || ';', ''
+		FROM relations r
+		JOIN pg_depend d ON d.objid = r.oid AND d.deptype = 'a' AND d.classid = 'pg_class'::regclass AND d.refclassid = 'pg_class'::regclass
+		JOIN relations t ON t.oid = d.refobjid
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = d.refobjsubid
+		WHERE r.relkind = 'S'
+		UNION ALL
+		SELECT CASE WHEN con.contype = 'f' THEN 8 ELSE 7 END, con.oid, 'constraint ' || r.nspname || '.' || r.relname || '.' || con.conname,
+			'ALTER TABLE ' || r.qualified || ' ADD CONSTRAINT ' || quote_ident(con.conname) || ' ' || pg_get_constraintdef(con.oid) || ';',
+			'ALTER TABLE IF EXISTS ' || r.qualified || ' DROP CONSTRAINT IF EXISTS ' || quote_ident(con.conname) || ';'
+		FROM pg_constraint con JOIN relations r ON r.oid = con.conrelid
+		WHERE con.contype IN ('p', 'u', 'c', 'f', 'x') AND r.relkind IN ('r', 'p') AND con.conislocal
+		UNION ALL
+		SELECT 9, r.oid, 'index ' || r.nspname || '.' || r.relname,
+			replace(pg_get_indexdef(r.oid), ' ON ONLY ', ' ON ') || ';',
+			'DROP INDEX IF EXISTS ' || r.qualified || ';'
+		FROM relations r
+		WHERE r.relkind IN ('i', 'I') AND NOT r.relispartition AND NOT EXISTS (
+			SELECT 1 FROM pg_constraint con WHERE con.conindid = r.oid AND con.contype IN ('p', 'u', 'x')
+		)
+		UNION ALL
+		SELECT 10, r.oid, 'view ' || r.nspname || '.' || r.relname,
+			'CREATE ' || CASE WHEN r.relkind = 'm' THEN 'MATERIALIZED ' ELSE '' END || 'VIEW ' || r.qualified || ' AS' || E'\n' ||
+			rtrim(pg_get_viewdef(r.oid), ';') || ';',
+			'DROP ' || CASE WHEN r.relkind = 'm' THEN 'MATERIALIZED ' ELSE '' END || 'VIEW IF EXISTS ' || r.qualified || ';'
+		FROM relations r WHERE r.relkind IN ('v', 'm')
+		UNION ALL
+		SELECT 11, t.oid, 'trigger ' || r.nspname || '.' || r.relname || '.' || t.tgname,
+			pg_get_triggerdef(t.oid) || ';',
+			'DROP TRIGGER IF EXISTS ' || quote_ident(t.tgname) || ' ON ' || r.qualified || ';'
+		FROM pg_trigger t JOIN relations r ON r.oid = t.tgrelid
+		WHERE NOT t.tgisinternal AND COALESCE((to_jsonb(t) ->> 'tgparentid')::oid, 0) = 0
+		UNION ALL
+		SELECT 12, r.oid, 'comment ' || r.nspname || '.' || r.relname || COALESCE('.' || a.attname, ''),
+			'COMMENT ON ' || CASE
+				WHEN a.attname IS NOT NULL THEN 'COLUMN ' || r.qualified || '.' || quote_ident(a.attname)
+				WHEN r.relkind = 'v' THEN 'VIEW ' || r.qualified
+				WHEN r.relkind = 'm' THEN 'MATERIALIZED VIEW ' || r.qualified
+				WHEN r.relkind = 'S' THEN 'SEQUENCE ' || r.qualified
+				WHEN r.relkind IN ('i', 'I') THEN 'INDEX ' || r.qualified
+				ELSE 'TABLE ' || r.qualified
+			END || ' IS ' || quote_literal(d.description) || ';', ''
+		FROM pg_description d JOIN relations r ON r.oid = d.objoid AND d.classoid = 'pg_class'::regclass
+		LEFT JOIN pg_attribute a ON a.attrelid = r.oid AND a.attnum = d.objsubid AND d.objsubid > 0
+		UNION ALL
+		SELECT 13, n.oid, 'grant schema ' || n.nspname || ' ' || CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE pg_get_userbyid(a.grantee)::text END || ' ' || a.privilege_type,
+			'GRANT ' || a.privilege_type || ' ON SCHEMA ' || quote_ident(n.nspname) || ' TO ' ||
+			CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE quote_ident(pg_get_userbyid(a.grantee)) END ||
+			CASE WHEN a.is_grantable THEN ' WITH GRANT OPTION' ELSE '' END || ';', ''
+		FROM namespaces n, aclexplode(n.nspacl) a WHERE a.grantee <> n.nspowner
+		UNION ALL
+		SELECT 13, r.oid, 'grant ' || r.nspname || '.' || r.relname || ' ' || CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE pg_get_userbyid(a.grantee)::text END || ' ' || a.privilege_type,
+			'GRANT ' || a.privilege_type || ' ON ' || CASE WHEN r.relkind = 'S' THEN 'SEQUENCE ' ELSE 'TABLE ' END || r.qualified || ' TO ' ||
+			CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE quote_ident(pg_get_userbyid(a.grantee)) END ||
+			CASE WHEN a.is_grantable THEN ' WITH GRANT OPTION' ELSE '' END || ';', ''
+		FROM relations r, aclexplode(r.relacl) a WHERE a.grantee <> r.relowner
+	)
+	SELECT identity, create_sql, drop_sql FROM objects ORDER BY position, oid, identity;
+`
+
+// dumpSchema returns every object in the database, in the order in which it
+// can be created
+func (d *SQLDatabaseConnection) dumpSchema() ([]schemaObject, error) {
+	rows, err := d.db.Query(dumpQuery, d.tableName, d.tableName+"_migrations")
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to dump the database schema")
+	}
+
+	defer rows.Close()
+
+	objects := make([]schemaObject, 0)
+
+	for rows.Next() {
+		var o schemaObject
+		if err := rows.Scan(&o.identity, &o.create, &o.drop); err != nil {
+			return nil, errors.Wrap(err, "unable to dump the database schema")
+		}
+		objects = append(objects, o)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to dump the database schema")
+	}
+
+	return objects, nil
+}
+
+// versionTables are the default names of the version tables of the migration
+// tools pgit imports from
+var versionTables = map[MigrationTool]string{
+	GolangMigrate: "schema_migrations",
+	Goose:         "goose_db_version",
+	Flyway:        "flyway_schema_history",
+}
+
+// versionTableQueries read the version table of each migration tool pgit
+// imports from, whose name replaces the %[1]v placeholders. golang-migrate
+// records only its current version, marked when the database is dirty, goose
+// the versions that are applied, and Flyway the type and version, or
+// description for repeatable migrations, of each successful migration in
+// order.
+var versionTableQueries = map[MigrationTool]string{
+	GolangMigrate: `SELECT version::text || CASE WHEN dirty THEN ' dirty' ELSE '' END FROM %[1]v`,
+	Goose: `
+		SELECT g.version_id::text FROM %[1]v g
+		WHERE g.is_applied AND g.version_id > 0 AND g.id = (SELECT max(id) FROM %[1]v WHERE version_id = g.version_id)
+		ORDER BY g.id`,
+	Flyway: `
+		SELECT type || ' ' || COALESCE('V' || version, 'R' || description) FROM %[1]v
+		WHERE success AND type IN ('SQL', 'BASELINE', 'UNDO_SQL')
+		ORDER BY installed_rank`,
+}
+
+// readVersionTable returns the rows of the version table of another migration
+// tool, as described by versionTableQueries, named table or the default name
+// of the tool's table when table is empty
+func (d *SQLDatabaseConnection) readVersionTable(tool MigrationTool, table string) ([]string, error) {
+	if table == "" {
+		table = versionTables[tool]
+	}
+
+	rows, err := d.db.Query(fmt.Sprintf(versionTableQueries[tool], table))
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the version table of %v", tool)
+	}
+
+	defer rows.Close()
+
+	versions := make([]string, 0)
+
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, errors.Wrapf(err, "unable to read the version table of %v", tool)
+		}
+		versions = append(versions, version)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "unable to read the version table of %v", tool)
+	}
+
+	return versions, nil
+}
+
+// runInRolledBackTransaction executes the statements inside of a transaction
+// that is always rolled back, recording the outcome of each one. Each
+// statement runs inside of a savepoint so that a failing statement does not
+// prevent the following statements from running.
+func (d *SQLDatabaseConnection) runInRolledBackTransaction(statements []string) ([]statementResult, error) {
+	tx, err := d.db.Begin()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to start transaction")
+	}
+
+	defer tx.Rollback()
+
+	results := make([]statementResult, len(statements))
+
+	for i, statement := range statements {
+		if _, err := tx.Exec("SAVEPOINT pgit_test"); err != nil {
+			return nil, errors.Wrap(err, "unable to create savepoint")
+		}
+
+		results[i] = queryResult(tx, statement)
+
+		if results[i].err != nil {
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT pgit_test"); err != nil {
+				return nil, errors.Wrap(err, "unable to roll back to savepoint")
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// queryResult executes the statement and returns the number of rows along with
+// the first column of the first row formatted the way Postgres displays it
+func queryResult(tx *sql.Tx, statement string) statementResult {
+	rows, err := tx.Query(statement)
+
+	if err != nil {
+		return statementResult{err: err}
+	}
+
+	defer rows.Close()
+
+	result := statementResult{}
+	columns, err := rows.ColumnTypes()
+
+	if err != nil {
+		return statementResult{err: err}
+	}
+
+	var first interface{}
+
+	for rows.Next() {
+		result.rows++
+
+		if result.rows > 1 || len(columns) == 0 {
+			continue
+		}
+
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return statementResult{err: err}
+		}
+
+		first = values[0]
+	}
+
+	if err := rows.Err(); err != nil {
+		return statementResult{err: err}
+	}
+
+	if result.rows > 0 && len(columns) > 0 {
+		// the rows must be closed before the value can be formatted by the
+		// server
+		rows.Close()
+
+		value, err := formatValue(tx, first, columns[0].DatabaseTypeName())
+		if err != nil {
+			return statementResult{err: errors.Wrap(err, "unable to format value")}
+		}
+		result.value = &value
+	}
+
+	return result
+}
+
+// formatValue formats a value the way Postgres displays it. Dates and times
+// are converted back to their column type and formatted by the server, so
+// that they follow the DateStyle and TimeZone of the session.
+func formatValue(tx *sql.Tx, value interface{}, columnType string) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case bool:
+		if v {
+			return "t", nil
+		}
+		return "f", nil
+	case []byte:
+		return string(v), nil
+	case time.Time:
+		var text string
+		err := tx.QueryRow("SELECT $1::"+strings.ToLower(columnType)+"::text", v).Scan(&text)
+		return text, err
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// grantsQuery lists the privileges held by the given roles on the given
+// schemas and on the tables, sequences and functions inside of them. Object
+// names are formatted the same way normalizeObjectName formats them. The
+// privileges of the owner of an object are implicit, so the owner is listed
+// once with the OWNER privilege instead. Aggregates and window functions are
+// told apart through to_jsonb, since Postgres 11 replaced proisagg and
+// proiswindow with prokind.
+const grantsQuery = `
+SELECT COALESCE(r.rolname, 'PUBLIC'), 'SCHEMA', quote_ident(n.nspname),
+    CASE WHEN a.grantee = n.nspowner THEN 'OWNER' ELSE a.privilege_type END
+FROM pg_namespace n
+CROSS JOIN LATERAL aclexplode(n.nspacl) a
+LEFT JOIN pg_roles r ON r.oid = a.grantee
+WHERE n.nspname = ANY($2) AND COALESCE(r.rolname, 'PUBLIC') = ANY($1)
+UNION
+SELECT COALESCE(r.rolname, 'PUBLIC'), CASE WHEN c.relkind = 'S' THEN 'SEQUENCE' ELSE 'TABLE' END,
+    quote_ident(n.nspname) || '.' || quote_ident(c.relname),
+    CASE WHEN a.grantee = c.relowner THEN 'OWNER' ELSE a.privilege_type END
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+CROSS JOIN LATERAL aclexplode(c.relacl) a
+LEFT JOIN pg_roles r ON r.oid = a.grantee
+WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f', 'S')
+  AND n.nspname = ANY($2) AND COALESCE(r.rolname, 'PUBLIC') = ANY($1)
+UNION
+SELECT COALESCE(r.rolname, 'PUBLIC'), 'FUNCTION',
+    quote_ident(n.nspname) || '.' || quote_ident(p.proname) || '(' || oidvectortypes(p.proargtypes) || ')',
+    CASE WHEN a.grantee = p.proowner THEN 'OWNER' ELSE a.privilege_type END
+FROM pg_proc p
+JOIN pg_namespace n ON n.oid = p.pronamespace
+CROSS JOIN LATERAL aclexplode(p.proacl) a
+LEFT JOIN pg_roles r ON r.oid = a.grantee
+WHERE COALESCE(to_jsonb(p) ->> 'prokind', 'f') = 'f'
+  AND NOT COALESCE((to_jsonb(p) ->> 'proisagg')::boolean, false)
+  AND NOT COALESCE((to_jsonb(p) ->> 'proiswindow')::boolean, false)
+  AND n.nspname = ANY($2) AND COALESCE(r.rolname, 'PUBLIC') = ANY($1)`
+
+// readGrants returns the privileges currently held by the roles on the
+// schemas and the objects inside of them, and the objects they own with the
+// OWNER privilege
+func (d *SQLDatabaseConnection) readGrants(roles []string, schemas []string) ([]grant, error) {
+	rows, err := d.db.Query(grantsQuery, pq.Array(roles), pq.Array(schemas))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query grants")
+	}
+
+	defer rows.Close()
+
+	grants := make([]grant, 0)
+
+	for rows.Next() {
+		var g grant
+		if err := rows.Scan(&g.role, &g.objectType, &g.object, &g.privilege); err != nil {
+			return nil, errors.Wrap(err, "unable to read grant")
+		}
+		grants = append(grants, g)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read grants")
+	}
+
+	return grants, nil
+}
+
+// catalogExtension is an extension that can be installed in the database,
+// with the version and schema it is installed with, which are empty if it is
+// not installed, and the version and schema a new installation would use
+type catalogExtension struct {
+	name           string
+	version        string
+	schema         string
+	defaultVersion string
+	defaultSchema  string
+}
+
+// extensionsQuery lists the given extensions that are available to the
+// database. New installations go in the schema named by the control file of
+// the extension, or the current schema when it does not name one.
+const extensionsQuery = `
+SELECT a.name, COALESCE(e.extversion, ''), COALESCE(n.nspname, ''), a.default_version,
+    COALESCE(v.schema, current_schema(), '')
+FROM pg_available_extensions a
+LEFT JOIN pg_extension e ON e.extname = a.name
+LEFT JOIN pg_namespace n ON n.oid = e.extnamespace
+LEFT JOIN pg_available_extension_versions v ON v.name = a.name AND v.version = a.default_version
+WHERE a.name = ANY($1)`
+
+// readExtensions returns the given extensions that are available to the
+// database
+func (d *SQLDatabaseConnection) readExtensions(names []string) ([]catalogExtension, error) {
+	rows, err := d.db.Query(extensionsQuery, pq.Array(names))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query extensions")
+	}
+
+	defer rows.Close()
+
+	extensions := make([]catalogExtension, 0)
+
+	for rows.Next() {
+		var e catalogExtension
+		if err := rows.Scan(&e.name, &e.version, &e.schema, &e.defaultVersion, &e.defaultSchema); err != nil {
+			return nil, errors.Wrap(err, "unable to read extension")
+		}
+		extensions = append(extensions, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read extensions")
+	}
+
+	return extensions, nil
+}
+
+// executeHook executes the SQL of a hook file inside of a transaction and
+// keeps the session settings it makes to apply them to every connection
+func (d *SQLDatabaseConnection) executeHook(sql string) error {
+	tx, err := d.begin()
+
+	if err != nil {
+		return err
+	}
+
+	if err = execStatements(tx, sql); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	settings, err := sessionSettings(sql)
+
+	if err != nil {
+		return err
+	}
+
+	d.settings = append(d.settings, settings...)
+
+	return nil
+}
+
+// sessionSettings returns the statements of a hook that change the settings
+// of the session, such as SET ROLE or RESET search_path, leaving out those
+// that only last for the transaction
+func sessionSettings(sql string) ([]string, error) {
+	statements, err := splitStatements(sql)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to split SQL into statements")
+	}
+
+	settings := make([]string, 0)
+
+	for _, s := range statements {
+		words, err := statementWords(s.sql)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(words) < 2 || (words[0] != "SET" && words[0] != "RESET") {
+			continue
+		}
+
+		if words[0] == "SET" && (words[1] == "LOCAL" || words[1] == "TRANSACTION" || words[1] == "CONSTRAINTS") {
+			continue
+		}
+
+		settings = append(settings, s.sql)
+	}
+
+	return settings, nil
+}
@@ -0,0 +1,30 @@
+package pgit
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationRecords(t *testing.T) {
+	started := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	finished := started.Add(time.Minute)
+
+	history := migrationRecords([]historyRow{
+		{id: 1, completed: true, file: sql.NullString{String: "orders.sql", Valid: true}, version: sql.NullString{String: "abc123", Valid: true}},
+		{id: 1, completed: true, file: sql.NullString{String: "users.sql", Valid: true}, version: sql.NullString{String: "2", Valid: true}},
+		{id: 2, completed: true, startedAt: pq.NullTime{Time: started, Valid: true}, finishedAt: pq.NullTime{Time: finished, Valid: true}},
+		{id: 3, startedAt: pq.NullTime{Time: started, Valid: true}, file: sql.NullString{String: "users.sql", Valid: true}, version: sql.NullString{String: "3", Valid: true}},
+	})
+
+	assert.Equal(t, []MigrationRecord{
+		{ID: 1, Completed: true, Files: []FileVersion{{Path: "orders.sql", Version: "abc123"}, {Path: "users.sql", Version: "2"}}},
+		{ID: 2, Completed: true, StartedAt: started, FinishedAt: finished, Files: []FileVersion{}},
+		{ID: 3, StartedAt: started, Files: []FileVersion{{Path: "users.sql", Version: "3"}}},
+	}, history, "should group the files of each migration")
+
+	assert.Equal(t, []MigrationRecord{}, migrationRecords(nil), "should return no migrations for an empty table")
+}
@@ -0,0 +1,172 @@
+package pgit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// EventType identifies what happened in an Event
+type EventType string
+
+// Types of the events sent to observers while migrating and rolling back
+const (
+	MigrationStarted  EventType = "migration-started"
+	MigrationFinished EventType = "migration-finished"
+	RollbackStarted   EventType = "rollback-started"
+	RollbackFinished  EventType = "rollback-finished"
+	FilePlanned       EventType = "file-planned"
+	FileApplying      EventType = "file-applying"
+	FileApplied       EventType = "file-applied"
+	FileRolledBack    EventType = "file-rolled-back"
+	FileFailed        EventType = "file-failed"
+	FileSkipped       EventType = "file-skipped"
+	Warning           EventType = "warning"
+)
+
+// Event describes something that happened while migrating or rolling back.
+// Fields that do not apply to the type of event are left empty.
+type Event struct {
+	Type        EventType
+	Time        time.Time
+	MigrationID int
+	Path        string
+	FromVersion string
+	ToVersion   string
+	Message     string
+	Err         error
+
+	// Duration is how long applying a file, or the whole migration, took
+	Duration time.Duration
+}
+
+// MarshalJSON encodes the event with snake_case field names, the error as
+// its message and the duration in milliseconds
+func (e Event) MarshalJSON() ([]byte, error) {
+	encoded := struct {
+		Type        EventType `json:"type"`
+		Time        time.Time `json:"time"`
+		MigrationID int       `json:"migration_id,omitempty"`
+		Path        string    `json:"path,omitempty"`
+		FromVersion string    `json:"from_version,omitempty"`
+		ToVersion   string    `json:"to_version,omitempty"`
+		Message     string    `json:"message,omitempty"`
+		Error       string    `json:"error,omitempty"`
+		DurationMS  float64   `json:"duration_ms,omitempty"`
+	}{
+		Type:        e.Type,
+		Time:        e.Time,
+		MigrationID: e.MigrationID,
+		Path:        e.Path,
+		FromVersion: e.FromVersion,
+		ToVersion:   e.ToVersion,
+		Message:     e.Message,
+		DurationMS:  float64(e.Duration) / float64(time.Millisecond),
+	}
+
+	if e.Err != nil {
+		encoded.Error = e.Err.Error()
+	}
+
+	return json.Marshal(encoded)
+}
+
+// Observer receives the events of migrations and rollbacks, for example to
+// route them to an application's logger
+type Observer interface {
+	Notify(event Event)
+}
+
+// ObserverFunc adapts a function to the Observer interface
+type ObserverFunc func(event Event)
+
+// Notify calls f with the event
+func (f ObserverFunc) Notify(event Event) {
+	f(event)
+}
+
+// textObserver writes one line of text for every event
+type textObserver struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewTextObserver returns an Observer that writes every event to w as a line
+// of text
+func NewTextObserver(w io.Writer) Observer {
+	return &textObserver{w: w}
+}
+
+func (o *textObserver) Notify(event Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintln(o.w, formatEvent(event))
+}
+
+// formatEvent returns the text written for an event by the text observer
+func formatEvent(event Event) string {
+	versions := fmt.Sprintf("(%q -> %q)", event.FromVersion, event.ToVersion)
+
+	switch event.Type {
+	case MigrationStarted:
+		return fmt.Sprintf("Started migration %v", event.MigrationID)
+	case MigrationFinished:
+		return fmt.Sprintf("Finished migration %v in %v", event.MigrationID, event.Duration)
+	case RollbackStarted:
+		return fmt.Sprintf("Rolling back migration %v", event.MigrationID)
+	case RollbackFinished:
+		return fmt.Sprintf("Rolled back migration %v in %v", event.MigrationID, event.Duration)
+	case FilePlanned:
+		return fmt.Sprintf("Planned %v %v", event.Path, versions)
+	case FileApplying:
+		return fmt.Sprintf("Applying %v %v", event.Path, versions)
+	case FileApplied:
+		return fmt.Sprintf("Applied %v %v in %v", event.Path, versions, event.Duration)
+	case FileRolledBack:
+		return fmt.Sprintf("Rolled back %v %v", event.Path, versions)
+	case FileFailed:
+		return fmt.Sprintf("WARNING: %v (file=%v version=%v msg=%v)", event.Message, event.Path, event.ToVersion, event.Err)
+	case FileSkipped:
+		return fmt.Sprintf("Skipped %v: %v", event.Path, event.Message)
+	case Warning:
+		if event.Path != "" {
+			return fmt.Sprintf("WARNING: %v (file=%v)", event.Message, event.Path)
+		}
+		return fmt.Sprintf("WARNING: %v", event.Message)
+	}
+
+	return fmt.Sprintf("%v %v %v", event.Type, event.Path, event.Message)
+}
+
+// jsonObserver writes every event as a JSON object on its own line
+type jsonObserver struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSONObserver returns an Observer that writes every event to w as a JSON
+// object on its own line
+func NewJSONObserver(w io.Writer) Observer {
+	return &jsonObserver{encoder: json.NewEncoder(w)}
+}
+
+func (o *jsonObserver) Notify(event Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.encoder.Encode(event)
+}
+
+// warningObserver passes only warnings and failures on to another observer.
+// It is used when no observer is given so that, as before observers existed,
+// nothing but problems is printed.
+type warningObserver struct {
+	next Observer
+}
+
+func (o warningObserver) Notify(event Event) {
+	if event.Type == Warning || event.Type == FileFailed {
+		o.next.Notify(event)
+	}
+}
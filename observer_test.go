@@ -0,0 +1,71 @@
+package pgit
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObservers(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	events := []Event{
+		{Type: MigrationStarted, Time: at, MigrationID: 3},
+		{Type: FileApplied, Time: at, MigrationID: 3, Path: "a.sql", ToVersion: "1", Duration: 1500 * time.Microsecond},
+		{Type: FileFailed, Time: at, MigrationID: 3, Path: "b.sql", ToVersion: "2", Message: "unable to apply update for file", Err: errors.New("syntax error")},
+		{Type: Warning, Time: at, Path: "c.sql", Message: "applying uncommitted file"},
+	}
+
+	t.Run("text", func(t *testing.T) {
+		var out bytes.Buffer
+		o := NewTextObserver(&out)
+		for _, event := range events {
+			o.Notify(event)
+		}
+
+		assert.Equal(
+			t,
+			"Started migration 3\n"+
+				"Applied a.sql (\"\" -> \"1\") in 1.5ms\n"+
+				"WARNING: unable to apply update for file (file=b.sql version=2 msg=syntax error)\n"+
+				"WARNING: applying uncommitted file (file=c.sql)\n",
+			out.String(),
+			"should write a line for every event",
+		)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		o := NewJSONObserver(&out)
+		for _, event := range events[1:3] {
+			o.Notify(event)
+		}
+
+		assert.Equal(
+			t,
+			`{"type":"file-applied","time":"2020-01-02T03:04:05Z","migration_id":3,"path":"a.sql","to_version":"1","duration_ms":1.5}`+"\n"+
+				`{"type":"file-failed","time":"2020-01-02T03:04:05Z","migration_id":3,"path":"b.sql","to_version":"2","message":"unable to apply update for file","error":"syntax error"}`+"\n",
+			out.String(),
+			"should write a JSON object for every event",
+		)
+	})
+
+	t.Run("warnings only", func(t *testing.T) {
+		var out bytes.Buffer
+		o := warningObserver{next: NewTextObserver(&out)}
+		for _, event := range events {
+			o.Notify(event)
+		}
+
+		assert.Equal(
+			t,
+			"WARNING: unable to apply update for file (file=b.sql version=2 msg=syntax error)\n"+
+				"WARNING: applying uncommitted file (file=c.sql)\n",
+			out.String(),
+			"should only pass on warnings and failures",
+		)
+	})
+}
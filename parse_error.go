@@ -0,0 +1,62 @@
+package pgit
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ParseError describes a problem found while parsing a schema file. Line and
+// Column are 1-based positions within the file at Path.
+type ParseError struct {
+	Path    string
+	Line    int
+	Column  int
+	Message string
+	Hint    string
+}
+
+// Error formats the error in the compiler style "path:line:col: message"
+// understood by most editors and CI systems.
+func (e *ParseError) Error() string {
+	location := fmt.Sprintf("%v:%v:%v", e.Path, e.Line, e.Column)
+	if e.Path == "" {
+		location = fmt.Sprintf("line %v, column %v", e.Line, e.Column)
+	}
+
+	if e.Hint != "" {
+		return fmt.Sprintf("%v: %v (hint: %v)", location, e.Message, e.Hint)
+	}
+
+	return fmt.Sprintf("%v: %v", location, e.Message)
+}
+
+// ParseErrors is returned when one or more files in the schema directory could
+// not be parsed. It contains every error found rather than only the first.
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// inFile sets the path of err to path if it is a ParseError that does not
+// already have a path
+func inFile(err error, path string) error {
+	if parseErr, ok := err.(*ParseError); ok && parseErr.Path == "" {
+		parseErr.Path = path
+	}
+	return err
+}
+
+// firstColumn returns the 1-based column of the first non-whitespace
+// character in line
+func firstColumn(line string) int {
+	if i := strings.IndexFunc(line, func(r rune) bool { return !unicode.IsSpace(r) }); i != -1 {
+		return i + 1
+	}
+	return 1
+}
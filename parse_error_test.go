@@ -0,0 +1,32 @@
+package pgit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseErrorFormat(t *testing.T) {
+	err := &ParseError{Path: "schema/users.sql", Line: 4, Column: 2, Message: "unexpected rollback annotation"}
+
+	assert.EqualError(t, err, "schema/users.sql:4:2: unexpected rollback annotation", "should use compiler style")
+
+	err.Hint = "each change may only have one rollback"
+
+	assert.EqualError(
+		t,
+		err,
+		"schema/users.sql:4:2: unexpected rollback annotation (hint: each change may only have one rollback)",
+		"should include the hint",
+	)
+
+	errs := ParseErrors{err, &ParseError{Path: "schema/orders.sql", Line: 1, Column: 1, Message: "empty schema file"}}
+
+	assert.EqualError(
+		t,
+		errs,
+		"schema/users.sql:4:2: unexpected rollback annotation (hint: each change may only have one rollback)\n"+
+			"schema/orders.sql:1:1: empty schema file",
+		"should list every error",
+	)
+}
@@ -0,0 +1,98 @@
+package pgit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// fileTemplates are the contents of new schema files of each type, a view
+// file being given the name of the file for its view
+var fileTemplates = map[string]string{
+	"changeset":  "-- pgit type=changeset\n\n" + changesetAnnotation + "\n\n" + rollbackAnnotation + "\n",
+	"definition": "-- pgit type=definition\n\n" + definitionAnnotation + "\n\n" + rollbackAnnotation + "\n",
+	"view":       "-- pgit type=view\n\nCREATE VIEW %v AS\n    SELECT 1;\n",
+	"seed":       "-- pgit type=seed\n\n",
+	"grants":     "-- pgit type=grants\n\n",
+	"extension":  "-- pgit type=extension\n\n",
+	"test":       "-- pgit type=test\n\n",
+}
+
+// createFile creates a schema file of the given type at path, relative to the
+// schema root, along with any missing directories, and returns its full path
+func (s *schemaDirectory) createFile(fileType, path string) (string, error) {
+	content, ok := fileTemplates[fileType]
+
+	if !ok {
+		return "", errors.Errorf(
+			"unable to create a file of type %q, expected changeset, definition, view, seed, grants, extension or test",
+			fileType,
+		)
+	}
+
+	if fileType == "view" {
+		content = fmt.Sprintf(content, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	}
+
+	filePath := filepath.Join(s.root, path)
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return "", errors.Wrapf(err, "failed to create the directory of %v", path)
+	}
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+
+	if os.IsExist(err) {
+		return "", errors.Errorf("%v already exists", path)
+	} else if err != nil {
+		return "", errors.Wrapf(err, "failed to create file %v", path)
+	}
+
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return "", errors.Wrapf(err, "failed to write file %v", path)
+	}
+
+	return filePath, f.Close()
+}
+
+// addChange appends an empty change to the changeset file at path, relative
+// to the schema root, and returns its full path
+func (s *schemaDirectory) addChange(path string) (string, error) {
+	filePath := filepath.Join(s.root, path)
+	content, err := ioutil.ReadFile(filePath)
+
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read file %v", path)
+	}
+
+	firstLine := string(content)
+	if i := strings.IndexAny(firstLine, "\r\n"); i != -1 {
+		firstLine = firstLine[:i]
+	}
+
+	if tokens := fileTypeCommentRegexp.FindStringSubmatch(firstLine); len(tokens) != 2 || tokens[1] != "changeset" {
+		return "", errors.Errorf("%v is not a changeset file", path)
+	}
+
+	// separate the new change from the last one by a blank line
+	content = bytes.TrimRight(content, "\r\n")
+	content = append(content, fmt.Sprintf("\n\n%v\n\n%v\n", changesetAnnotation, rollbackAnnotation)...)
+
+	info, err := os.Stat(filePath)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(filePath, content, info.Mode()); err != nil {
+		return "", errors.Wrapf(err, "failed to write file %v", path)
+	}
+
+	return filePath, nil
+}
@@ -0,0 +1,64 @@
+package pgit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScaffold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgit-scaffold")
+	assert.NoError(t, err, "failed to create temp directory")
+	defer os.RemoveAll(dir)
+
+	s := &schemaDirectory{root: dir, files: make(map[string]schemaFile)}
+
+	t.Run("create files of every type", func(t *testing.T) {
+		for fileType := range fileTemplates {
+			path := filepath.Join("new", fileType+".sql")
+			filePath, err := s.createFile(fileType, path)
+			assert.NoError(t, err, "should create a %v file", fileType)
+			assert.Equal(t, filepath.Join(dir, path), filePath, "should return the full path")
+			assert.NoError(t, s.readFile(filePath, path), "should create a valid %v file", fileType)
+		}
+	})
+
+	t.Run("refuse to overwrite a file", func(t *testing.T) {
+		_, err := s.createFile("changeset", filepath.Join("new", "changeset.sql"))
+		assert.EqualError(t, err, "new/changeset.sql already exists", "should not overwrite the file")
+	})
+
+	t.Run("refuse unknown types", func(t *testing.T) {
+		_, err := s.createFile("hook", "hook.sql")
+		assert.Error(t, err, "should refuse a type without a template")
+	})
+
+	t.Run("add a change", func(t *testing.T) {
+		path := "orders.sql"
+		filePath := filepath.Join(dir, path)
+		assert.NoError(t, ioutil.WriteFile(filePath, []byte("-- pgit type=changeset\n\n-- change\nCREATE TABLE orders (id integer);\n\n-- rollback\nDROP TABLE orders;"), 0644))
+
+		_, err := s.addChange(path)
+		assert.NoError(t, err, "should add a change")
+
+		content, err := ioutil.ReadFile(filePath)
+		assert.NoError(t, err, "failed to read file")
+		assert.Equal(
+			t,
+			"-- pgit type=changeset\n\n-- change\nCREATE TABLE orders (id integer);\n\n-- rollback\nDROP TABLE orders;\n\n-- change\n\n-- rollback\n",
+			string(content),
+			"should append an empty change",
+		)
+
+		assert.NoError(t, s.readFile(filePath, path), "should leave a valid file")
+		assert.Len(t, s.files[path].(*changesetFile).changesets, 2, "should have the new change")
+	})
+
+	t.Run("refuse to add a change to other files", func(t *testing.T) {
+		_, err := s.addChange(filepath.Join("new", "definition.sql"))
+		assert.EqualError(t, err, "new/definition.sql is not a changeset file", "should only add changes to changeset files")
+	})
+}
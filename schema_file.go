@@ -6,7 +6,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -19,13 +21,122 @@ type schemaFile interface {
 	getPath() string
 }
 
+// applyStep is a unit of work that brings a file to a new version. Files that
+// implement stepFile may need several steps to bring them up to date, for
+// example when some of their SQL cannot run inside of a transaction.
+type applyStep struct {
+	sql           string
+	version       string
+	noTransaction bool
+	// destructive lists the operations in sql that destroy data and have
+	// not been approved
+	destructive []string
+}
+
+// stepFile is implemented by schema files that are applied in more than one
+// step
+type stepFile interface {
+	getApplySteps(currentVersion string) ([]applyStep, error)
+}
+
+// getApplySteps returns the steps needed to bring the file up to date from the
+// given version
+func getApplySteps(file schemaFile, currentVersion string) ([]applyStep, error) {
+	if f, ok := file.(stepFile); ok {
+		return f.getApplySteps(currentVersion)
+	}
+
+	sql, newVersion, err := file.getApplySQL(currentVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if newVersion == currentVersion {
+		return nil, nil
+	}
+
+	destructive, err := destructiveOperations(sql)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to classify SQL")
+	}
+
+	return []applyStep{{sql: sql, version: newVersion, destructive: destructive}}, nil
+}
+
+// rollbackStepFile is implemented by schema files that are rolled back in
+// more than one step
+type rollbackStepFile interface {
+	getRollbackSteps(currentVersion, previousVersion string) ([]applyStep, error)
+}
+
+// getRollbackSteps returns the steps needed to roll the file back from the
+// version recorded by a migration to the version it was at before it. The
+// last step records previousVersion.
+func getRollbackSteps(file schemaFile, currentVersion, previousVersion string) ([]applyStep, error) {
+	if f, ok := file.(rollbackStepFile); ok {
+		return f.getRollbackSteps(currentVersion, previousVersion)
+	}
+
+	sql, _, err := file.getRollbackSQL(currentVersion)
+
+	if err != nil {
+		return nil, err
+	}
+
+	destructive, err := destructiveOperations(sql)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to classify rollback SQL")
+	}
+
+	return []applyStep{{sql: sql, version: previousVersion, destructive: destructive}}, nil
+}
+
+// catalogFile is implemented by schema files that read the database catalog
+// to determine the SQL needed to apply them
+type catalogFile interface {
+	setDatabase(db DatabaseConnection)
+}
+
+// applyOrder returns the position of a file's type in the order files are
+// applied. Extensions are applied before every other file so that the others
+// can use them, and grants after every other file so that the objects they
+// refer to already exist.
+func applyOrder(file schemaFile) int {
+	switch file.(type) {
+	case *extensionFile:
+		return -1
+	case *grantsFile:
+		return 1
+	}
+	return 0
+}
+
 // schemaDirectory represents the directory containing the files
 // that define a database schema.
 type schemaDirectory struct {
-	gitRoot string
-	root    string
-	files   map[string]schemaFile
-	state   *migrationState
+	gitRoot     string
+	root        string
+	files       map[string]schemaFile
+	state       *migrationState
+	parseErrors ParseErrors
+	environment string
+	variables   map[string]string
+	hooks       map[HookPhase][]func(HookEvent) error
+	observer    Observer
+
+	// allowDestructive approves running SQL that destroys data in every
+	// file rather than only in changesets annotated as destructive
+	allowDestructive bool
+
+	lintRules      []LintRule
+	lintSeverities map[string]Severity
+
+	// versionTable is the name of the version table Import reads instead
+	// of the default table of the migration tool
+	versionTable string
 }
 
 func newSchemaDirectory(root string) (*schemaDirectory, error) {
@@ -56,25 +167,110 @@ func (s *schemaDirectory) rollback(db DatabaseConnection) error {
 		return errors.Wrap(err, "unable to determine files involved in last migration")
 	}
 
+	sort.SliceStable(filesInLastMigration, func(i, j int) bool {
+		return applyOrder(s.files[filesInLastMigration[i].path]) > applyOrder(s.files[filesInLastMigration[j].path])
+	})
+
+	s.useDatabase(db)
+
+	// the SQL of every file is determined first so that nothing is rolled
+	// back if any of it is refused
+	rollbacks := make([]fileRollback, 0, len(filesInLastMigration))
+	refused := make([]DestructiveOperation, 0)
+
 	for _, file := range filesInLastMigration {
-		rollbackSQL, newVersion, err := s.files[file.path].getRollbackSQL(file.version)
+		if s.state.lastMigration.adopted {
+			// the objects of an adopted migration, such as a baseline,
+			// were not created by pgit, so only the state is rolled back
+			rollbacks = append(rollbacks, fileRollback{state: file, steps: []applyStep{{version: file.previous}}})
+			continue
+		}
+
+		steps, err := getRollbackSteps(s.files[file.path], file.version, file.previous)
 
 		if err != nil {
-			fmt.Printf("WARNING: failed to get SQL for rolling back update (file=%v version=%v msg=%v)\n", file.path, file.version, err)
+			s.notify(Event{
+				Type:        FileFailed,
+				MigrationID: s.state.lastMigration.id,
+				Path:        file.path,
+				FromVersion: file.version,
+				ToVersion:   file.version,
+				Message:     "failed to get SQL for rolling back update",
+				Err:         err,
+			})
 			continue
 		}
 
-		if err = db.rollbackFile(&file, rollbackSQL, newVersion, s.state.lastMigration); err != nil {
-			fmt.Printf("WARNING: unable to rollback file (file=%v version=%v msg=%v)\n", file.path, newVersion, err)
-			return errors.Wrap(err, "unable to rollback changes to file")
+		if !s.allowDestructive {
+			for _, step := range steps {
+				for _, op := range step.destructive {
+					refused = append(refused, DestructiveOperation{Path: file.path, Operation: op})
+				}
+			}
 		}
+
+		rollbacks = append(rollbacks, fileRollback{state: file, steps: steps})
+	}
+
+	if len(refused) > 0 {
+		return &DestructiveError{Operations: refused}
+	}
+
+	if err := s.runHooks(db, HookEvent{Phase: BeforeRollback, MigrationID: s.state.lastMigration.id}); err != nil {
+		return err
+	}
+
+	started := time.Now()
+	s.notify(Event{Type: RollbackStarted, MigrationID: s.state.lastMigration.id})
+
+	for _, r := range rollbacks {
+		fromVersion := r.state.version
+
+		for _, step := range r.steps {
+			if step.noTransaction {
+				err = db.applyWithoutTransaction(&r.state, step.sql, step.version, s.state.lastMigration)
+			} else {
+				err = db.rollbackFile(&r.state, step.sql, step.version, s.state.lastMigration)
+			}
+
+			if err != nil {
+				s.notify(Event{
+					Type:        FileFailed,
+					MigrationID: s.state.lastMigration.id,
+					Path:        r.state.path,
+					FromVersion: r.state.version,
+					ToVersion:   step.version,
+					Message:     "unable to rollback file",
+					Err:         err,
+				})
+				return errors.Wrap(err, "unable to rollback changes to file")
+			}
+
+			r.state.version = step.version
+		}
+
+		s.notify(Event{
+			Type:        FileRolledBack,
+			MigrationID: s.state.lastMigration.id,
+			Path:        r.state.path,
+			FromVersion: fromVersion,
+			ToVersion:   r.state.version,
+		})
 	}
 
 	if err = db.removeMigration(s.state.lastMigration); err != nil {
 		return errors.Wrap(err, "unable to remove migration after rolling back files")
 	}
 
-	return nil
+	s.notify(Event{Type: RollbackFinished, MigrationID: s.state.lastMigration.id, Duration: time.Since(started)})
+
+	return s.runHooks(db, HookEvent{Phase: AfterRollback, MigrationID: s.state.lastMigration.id})
+}
+
+// fileRollback is the steps that roll back a file in the last migration
+type fileRollback struct {
+	state fileMigrationState
+	steps []applyStep
 }
 
 func (s *schemaDirectory) applyLatest(db DatabaseConnection) error {
@@ -87,8 +283,17 @@ func (s *schemaDirectory) applyLatest(db DatabaseConnection) error {
 	}
 
 	var migration *migration
+	var started time.Time
+	recorded, failed := false, false
+
+	s.useDatabase(db)
+
+	if err := s.checkDestructive(); err != nil {
+		return err
+	}
 
-	for filePath, file := range s.files {
+	for _, filePath := range s.sortedPaths() {
+		file := s.files[filePath]
 		fileState, ok := s.state.fileStates[filePath]
 
 		if !ok {
@@ -96,37 +301,464 @@ func (s *schemaDirectory) applyLatest(db DatabaseConnection) error {
 			fileState = s.state.fileStates[filePath]
 		}
 
-		sql, newVersion, err := file.getApplySQL(fileState.version)
+		if seed, ok := file.(*seedFile); ok && !seed.enabled {
+			s.notify(Event{Type: FileSkipped, Path: filePath, Message: "not enabled for this environment"})
+			continue
+		}
+
+		steps, err := getApplySteps(file, fileState.version)
 
 		if err != nil {
-			fmt.Printf("WARNING: failed to get SQL for applying update (file=%v version=%v msg=%v)\n", file.getPath(), fileState.version, err)
+			s.notify(Event{
+				Type:        FileFailed,
+				Path:        filePath,
+				FromVersion: fileState.version,
+				ToVersion:   fileState.version,
+				Message:     "failed to get SQL for applying update",
+				Err:         err,
+			})
 			continue
 		}
 
-		if newVersion == fileState.version {
-			continue
+		fromVersion := fileState.version
+
+		if len(steps) > 0 {
+			s.notify(Event{Type: FilePlanned, Path: filePath, FromVersion: fromVersion, ToVersion: steps[len(steps)-1].version})
 		}
 
-		if migration == nil {
-			migration, err = db.createNewMigration()
+		for _, step := range steps {
+			if migration == nil {
+				if migration, err = s.startMigration(db); err != nil {
+					return err
+				}
+				started = time.Now()
+			}
+
+			if versionCommit(step.version) == uncommittedVersion {
+				s.notify(Event{
+					Type:        Warning,
+					MigrationID: migration.id,
+					Path:        filePath,
+					Message:     "applying uncommitted file, be sure to rollback before committing",
+				})
+			}
+
+			event := Event{MigrationID: migration.id, Path: filePath, FromVersion: fileState.version, ToVersion: step.version}
+			event.Type = FileApplying
+			s.notify(event)
+			stepStarted := time.Now()
+
+			if step.noTransaction {
+				err = db.applyWithoutTransaction(fileState, step.sql, step.version, migration)
+			} else {
+				err = db.applyAndUpdateStateForFile(fileState, step.sql, step.version, migration)
+			}
+
+			event.Duration = time.Since(stepStarted)
+
 			if err != nil {
+				event.Type, event.Message, event.Err = FileFailed, "unable to apply update for file", err
+				s.notify(event)
+				failed = true
+				break
+			}
+
+			event.Type = FileApplied
+			s.notify(event)
+
+			recorded = recorded || step.version != fileState.version
+			fileState.version = step.version
+		}
+
+		if len(steps) > 0 {
+			event := HookEvent{
+				Phase:       AfterEachFile,
+				MigrationID: migration.id,
+				Path:        filePath,
+				FromVersion: fromVersion,
+				ToVersion:   fileState.version,
+			}
+			if err := s.runHooks(db, event); err != nil {
 				return err
 			}
 		}
+	}
+
+	if migration == nil {
+		return nil
+	}
+
+	if !recorded && !failed {
+		// re-running runAlways changesets leaves every version unchanged,
+		// so the migration is not kept for a rollback to undo
+		if err := db.removeMigration(migration); err != nil {
+			return errors.Wrap(err, "unable to remove migration that changed no versions")
+		}
+	} else if err := db.finishMigration(migration); err != nil {
+		return err
+	}
+
+	s.notify(Event{Type: MigrationFinished, MigrationID: migration.id, Duration: time.Since(started)})
+
+	return s.runHooks(db, HookEvent{Phase: AfterMigrate, MigrationID: migration.id})
+}
+
+// checkDestructive returns a *DestructiveError if applying the latest version
+// of the schema would run SQL that destroys data without approval. Files
+// whose SQL cannot be determined are reported when they are applied.
+func (s *schemaDirectory) checkDestructive() error {
+	if s.allowDestructive {
+		return nil
+	}
+
+	refused := make([]DestructiveOperation, 0)
+
+	for _, filePath := range s.sortedPaths() {
+		currentVersion := ""
+		if fileState, ok := s.state.fileStates[filePath]; ok {
+			currentVersion = fileState.version
+		}
+
+		steps, err := getApplySteps(s.files[filePath], currentVersion)
+
+		if err != nil {
+			continue
+		}
+
+		for _, step := range steps {
+			for _, op := range step.destructive {
+				refused = append(refused, DestructiveOperation{Path: filePath, Operation: op})
+			}
+		}
+	}
+
+	if len(refused) > 0 {
+		return &DestructiveError{Operations: refused}
+	}
+
+	return nil
+}
+
+// notify sends an event to the observer, if there is one
+func (s *schemaDirectory) notify(event Event) {
+	if s.observer == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	s.observer.Notify(event)
+}
+
+// startMigration records a new migration. The before-migrate hook files run
+// first, so that settings they make such as SET ROLE also apply to recording
+// the migration, and the hooks registered with the Hook option run once it
+// has an ID. The migration is removed if they fail.
+func (s *schemaDirectory) startMigration(db DatabaseConnection) (*migration, error) {
+	if err := s.runHookFiles(db, BeforeMigrate); err != nil {
+		return nil, err
+	}
+
+	m, err := db.createNewMigration()
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.notify(Event{Type: MigrationStarted, MigrationID: m.id})
+
+	if err := s.runHookFunctions(HookEvent{Phase: BeforeMigrate, MigrationID: m.id}); err != nil {
+		if removeErr := db.removeMigration(m); removeErr != nil {
+			return nil, errors.Wrapf(err, "unable to remove migration %v (%v)", m.id, removeErr)
+		}
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// runHooks executes the SQL hook files for the event's phase, in path order,
+// followed by the hooks registered with the Hook option
+func (s *schemaDirectory) runHooks(db DatabaseConnection, event HookEvent) error {
+	if err := s.runHookFiles(db, event.Phase); err != nil {
+		return err
+	}
+	return s.runHookFunctions(event)
+}
 
-		if err = db.applyAndUpdateStateForFile(fileState, sql, newVersion, migration); err != nil {
-			fmt.Printf("WARNING: unable to apply update for file (file=%v version=%v msg=%v)\n", file.getPath(), newVersion, err)
+// runHookFiles executes the SQL hook files for a phase, in path order
+func (s *schemaDirectory) runHookFiles(db DatabaseConnection, phase HookPhase) error {
+	for _, path := range s.sortedPaths() {
+		f, ok := s.files[path].(*hookFile)
+		if !ok || f.phase != phase {
 			continue
 		}
+		if err := db.executeHook(f.sql); err != nil {
+			return errors.Wrapf(err, "%v hook %v failed", phase, path)
+		}
 	}
+	return nil
+}
 
-	if migration != nil {
-		return db.finishMigration(migration)
+// runHookFunctions runs the hooks registered with the Hook option for the
+// event's phase
+func (s *schemaDirectory) runHookFunctions(event HookEvent) error {
+	for _, hook := range s.hooks[event.Phase] {
+		if err := hook(event); err != nil {
+			return errors.Wrapf(err, "%v hook failed", event.Phase)
+		}
 	}
 
 	return nil
 }
 
+// sortedPaths returns the paths of the files in the order they are applied:
+// by type and then by path
+func (s *schemaDirectory) sortedPaths() []string {
+	paths := make([]string, 0, len(s.files))
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		orderI, orderJ := applyOrder(s.files[paths[i]]), applyOrder(s.files[paths[j]])
+		if orderI != orderJ {
+			return orderI < orderJ
+		}
+		return paths[i] < paths[j]
+	})
+
+	return paths
+}
+
+// useDatabase provides the database connection to the files that read the
+// database catalog
+func (s *schemaDirectory) useDatabase(db DatabaseConnection) {
+	for _, file := range s.files {
+		if f, ok := file.(catalogFile); ok {
+			f.setDatabase(db)
+		}
+	}
+}
+
+// plan returns the steps that applying the latest version of the schema would
+// run, without running them
+func (s *schemaDirectory) plan(db DatabaseConnection) ([]PlannedStep, error) {
+	if err := s.readFromDisk(); err != nil {
+		return nil, errors.Wrap(err, "failed to populate schema from disk")
+	}
+
+	if err := s.readRecordedState(db); err != nil {
+		return nil, errors.Wrap(err, "failed to read migration state")
+	}
+
+	s.useDatabase(db)
+
+	planned := make([]PlannedStep, 0)
+
+	for _, filePath := range s.sortedPaths() {
+		currentVersion := ""
+		if fileState, ok := s.state.fileStates[filePath]; ok {
+			currentVersion = fileState.version
+		}
+
+		steps, err := getApplySteps(s.files[filePath], currentVersion)
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get SQL for applying update to %v", filePath)
+		}
+
+		for _, step := range steps {
+			planned = append(planned, PlannedStep{
+				Path:          filePath,
+				FromVersion:   currentVersion,
+				ToVersion:     step.version,
+				SQL:           step.sql,
+				NoTransaction: step.noTransaction,
+				Destructive:   step.destructive,
+			})
+			currentVersion = step.version
+		}
+	}
+
+	return planned, nil
+}
+
+// status returns the state of every file, and of every changeset in
+// changeset files, compared with the database
+func (s *schemaDirectory) status(db DatabaseConnection) ([]StatusItem, error) {
+	if err := s.readFromDisk(); err != nil {
+		return nil, errors.Wrap(err, "failed to populate schema from disk")
+	}
+
+	if err := s.readRecordedState(db); err != nil {
+		return nil, errors.Wrap(err, "failed to read migration state")
+	}
+
+	s.useDatabase(db)
+
+	items := make([]StatusItem, 0)
+
+	for _, filePath := range s.sortedPaths() {
+		currentVersion := ""
+		if fileState, ok := s.state.fileStates[filePath]; ok {
+			currentVersion = fileState.version
+		}
+
+		file := s.files[filePath]
+
+		switch file.(type) {
+		case *testFile, *hookFile:
+			continue
+		}
+
+		if c, ok := file.(*changesetFile); ok {
+			changes, err := c.status(currentVersion)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to determine status of %v", filePath)
+			}
+			items = append(items, changes...)
+			continue
+		}
+
+		if seed, ok := file.(*seedFile); ok && !seed.enabled {
+			items = append(items, StatusItem{Path: filePath, State: StateSkipped})
+			continue
+		}
+
+		steps, err := getApplySteps(file, currentVersion)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to determine status of %v", filePath)
+		}
+
+		item := StatusItem{Path: filePath, State: StateApplied}
+		if len(steps) > 0 {
+			item.State = StatePending
+		}
+		for _, step := range steps {
+			item.Destructive = append(item.Destructive, step.destructive...)
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// lint runs the lint rules over the changesets and definitions that are
+// pending in the database, or over all of them when db is nil
+func (s *schemaDirectory) lint(db DatabaseConnection) ([]LintFinding, error) {
+	if err := s.readFromDisk(); err != nil {
+		return nil, errors.Wrap(err, "failed to populate schema from disk")
+	}
+
+	if db != nil {
+		if err := s.readRecordedState(db); err != nil {
+			return nil, errors.Wrap(err, "failed to read migration state")
+		}
+	}
+
+	changes := make([]*LintChange, 0)
+
+	for _, filePath := range s.sortedPaths() {
+		currentVersion := ""
+		if fileState, ok := s.state.fileStates[filePath]; ok {
+			currentVersion = fileState.version
+		}
+
+		switch f := s.files[filePath].(type) {
+		case *changesetFile:
+			items, err := f.status(currentVersion)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to determine status of %v", filePath)
+			}
+			for i, cs := range f.changesets {
+				if db != nil && items[i].State != StatePending {
+					continue
+				}
+				change, err := newLintChange(filePath, f.key(i), cs.applySQL, cs.applyLine, cs.rollbackSQL, cs.rollbackLine)
+				if err != nil {
+					return nil, err
+				}
+				changes = append(changes, change)
+			}
+		case *definitionFile:
+			if db != nil {
+				steps, err := getApplySteps(f, currentVersion)
+				if err != nil {
+					return nil, errors.Wrapf(err, "unable to determine status of %v", filePath)
+				}
+				if len(steps) == 0 {
+					continue
+				}
+			}
+			content, err := renderTemplate(filePath, f.content, s.variables)
+			if err != nil {
+				return nil, err
+			}
+			definition, rollback, err := f.parse(content)
+			if err != nil {
+				return nil, err
+			}
+			definitionLine, rollbackLine, err := f.blockLines(content)
+			if err != nil {
+				return nil, err
+			}
+			change, err := newLintChange(filePath, "", definition, definitionLine, rollback, rollbackLine)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	rules := append(append([]LintRule{}, defaultLintRules...), s.lintRules...)
+
+	// with a database only the pending changes are linted, and they are
+	// applied together
+	return lintChanges(changes, db != nil, rules, s.lintSeverities), nil
+}
+
+// runTests runs the assertions in every test file against the database. Each
+// file runs inside of its own transaction which is always rolled back.
+func (s *schemaDirectory) runTests(db DatabaseConnection) ([]TestResult, error) {
+	if err := s.readFromDisk(); err != nil {
+		return nil, errors.Wrap(err, "failed to populate schema from disk")
+	}
+
+	paths := make([]string, 0)
+	for path, file := range s.files {
+		if _, ok := file.(*testFile); ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	results := make([]TestResult, 0)
+
+	for _, path := range paths {
+		f := s.files[path].(*testFile)
+
+		statements := make([]string, len(f.assertions))
+		for i, a := range f.assertions {
+			statements[i] = a.sql
+		}
+
+		statementResults, err := db.runInRolledBackTransaction(statements)
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to run tests in %v", path)
+		}
+
+		for i, a := range f.assertions {
+			if a.kind != "" || statementResults[i].err != nil {
+				results = append(results, a.check(path, statementResults[i]))
+			}
+		}
+	}
+
+	return results, nil
+}
+
 // readMigrationState reads the current migration state of the database using
 // the provided DatabaseConnection
 func (s *schemaDirectory) readMigrationState(d DatabaseConnection) error {
@@ -138,6 +770,17 @@ func (s *schemaDirectory) readMigrationState(d DatabaseConnection) error {
 	return nil
 }
 
+// readRecordedState reads the migration state without creating or upgrading
+// the tables that track it, for commands that do not change the database
+func (s *schemaDirectory) readRecordedState(d DatabaseConnection) error {
+	m, err := d.readRecordedState()
+	if err != nil {
+		return err
+	}
+	s.state = m
+	return nil
+}
+
 // readFromDisk reads all of the files from the schema directory and
 // creates an in-memory representation of the content that can then be
 // applied to the database
@@ -145,7 +788,23 @@ func (s *schemaDirectory) readFromDisk() error {
 	// can't use filepath.Rel because it annoyingly prefixes the relative
 	// path with "../" which git doesn't like
 	relativePath := s.root[len(s.gitRoot)+1:]
-	return s.readDirectory(s.root, relativePath)
+	s.parseErrors = nil
+
+	if err := s.readDirectory(s.root, relativePath); err != nil {
+		return err
+	}
+
+	if len(s.parseErrors) > 0 {
+		return s.parseErrors
+	}
+
+	return nil
+}
+
+// validate reads all of the files from the schema directory and returns
+// every parse error found in them
+func (s *schemaDirectory) validate() error {
+	return s.readFromDisk()
 }
 
 func (s *schemaDirectory) readDirectory(path, relativePath string) error {
@@ -165,7 +824,9 @@ func (s *schemaDirectory) readDirectory(path, relativePath string) error {
 			}
 		} else {
 			err := s.readFile(filepath.Join(path, entry.Name()), filepath.Join(relativePath, entry.Name()))
-			if err != nil {
+			if parseErr, ok := err.(*ParseError); ok {
+				s.parseErrors = append(s.parseErrors, parseErr)
+			} else if err != nil {
 				return err
 			}
 		}
@@ -176,6 +837,8 @@ func (s *schemaDirectory) readDirectory(path, relativePath string) error {
 
 var fileTypeCommentRegexp = regexp.MustCompile(`-- pgit type=(\S+)`)
 
+const fileTypeHint = "the first line must be -- pgit type=<changeset|definition|view|seed|test|grants|extension|hook>"
+
 func (s *schemaDirectory) readFile(path, relativePath string) error {
 	fileContent, err := ioutil.ReadFile(path)
 
@@ -186,34 +849,192 @@ func (s *schemaDirectory) readFile(path, relativePath string) error {
 	firstLineLength := strings.IndexAny(string(fileContent), "\r\n")
 
 	if firstLineLength == -1 {
-		return errors.New("empty schema file " + relativePath)
+		return &ParseError{
+			Path:    relativePath,
+			Line:    1,
+			Column:  1,
+			Message: "empty schema file",
+			Hint:    fileTypeHint,
+		}
 	}
 
 	firstLine := fileContent[0:firstLineLength]
 
-	tokens := fileTypeCommentRegexp.FindStringSubmatch(string(firstLine))
+	tokens := fileTypeCommentRegexp.FindStringSubmatchIndex(string(firstLine))
+
+	if len(tokens) != 4 {
+		return &ParseError{
+			Path:    relativePath,
+			Line:    1,
+			Column:  1,
+			Message: "invalid file annotation",
+			Hint:    fileTypeHint,
+		}
+	}
+
+	fileType := string(firstLine[tokens[2]:tokens[3]])
+
+	allowedOptions := map[string][]string{
+		"changeset": {"env"},
+		"hook":      {"phase"},
+		"seed":      {"env"},
+	}
+
+	options, err := parseFileOptions(string(firstLine), tokens[1], relativePath, allowedOptions[fileType]...)
 
-	if len(tokens) != 2 {
-		return errors.New("invalid file annotation for " + relativePath)
+	if err != nil {
+		return err
 	}
 
-	switch tokens[1] {
+	switch fileType {
 	case "changeset":
 		c := changesetFile{path: relativePath}
-		if err := c.parse(fileContent[firstLineLength:]); err != nil {
+		content, err := renderTemplate(relativePath, fileContent[firstLineLength:], s.variables)
+		if err != nil {
 			return err
 		}
+		if err := c.parse(content); err != nil {
+			return err
+		}
+		c.setEnvironment(options["env"], s.environment)
 		s.files[relativePath] = &c
 	case "definition":
-		d := definitionFile{path: relativePath, gitRoot: s.gitRoot, content: fileContent[firstLineLength:]}
+		d := definitionFile{path: relativePath, gitRoot: s.gitRoot, content: fileContent[firstLineLength:], variables: s.variables}
+		content, err := renderTemplate(relativePath, d.content, s.variables)
+		if err != nil {
+			return err
+		}
+		if _, _, err := d.parse(content); err != nil {
+			return err
+		}
 		s.files[relativePath] = &d
+	case "view":
+		v := newViewFile(relativePath, s.gitRoot, fileContent[firstLineLength:])
+		if _, _, err := v.parse(v.content); err != nil {
+			return err
+		}
+		s.files[relativePath] = v
+	case "seed":
+		f := seedFile{
+			path:    relativePath,
+			content: fileContent[firstLineLength:],
+			enabled: environmentEnabled(options["env"], s.environment),
+		}
+		if _, err := splitStatements(string(f.content)); err != nil {
+			return inFile(err, relativePath)
+		}
+		s.files[relativePath] = &f
+	case "grants":
+		g := newGrantsFile(relativePath, s.gitRoot, fileContent[firstLineLength:])
+		if _, err := g.parse(g.content); err != nil {
+			return err
+		}
+		s.files[relativePath] = g
+	case "extension":
+		e := newExtensionFile(relativePath, s.gitRoot, fileContent[firstLineLength:])
+		if e.extensions, err = e.parse(e.content); err != nil {
+			return err
+		}
+		s.files[relativePath] = e
+	case "hook":
+		phase, err := parseHookPhase(options["phase"])
+		if err != nil {
+			column := strings.Index(string(firstLine), "phase=") + 1
+			if column == 0 {
+				column = len(firstLine) + 1
+			}
+			return &ParseError{
+				Path:    relativePath,
+				Line:    1,
+				Column:  column,
+				Message: err.Error(),
+				Hint:    "hook files need a phase, such as -- pgit type=hook phase=before-migrate",
+			}
+		}
+		sql, err := joinStatements(string(fileContent[firstLineLength:]))
+		if err != nil {
+			return inFile(err, relativePath)
+		}
+		s.files[relativePath] = &hookFile{path: relativePath, phase: phase, sql: sql}
+	case "test":
+		f := testFile{path: relativePath}
+		if err := f.parse(fileContent[firstLineLength:]); err != nil {
+			return err
+		}
+		s.files[relativePath] = &f
 	default:
-		return errors.New("unknown file annotation for " + relativePath)
+		return &ParseError{
+			Path:    relativePath,
+			Line:    1,
+			Column:  tokens[2] + 1,
+			Message: fmt.Sprintf("unknown file type %q", fileType),
+			Hint:    fileTypeHint,
+		}
 	}
 
 	return nil
 }
 
+// parseFileOptions parses the options that follow the file type on the first
+// line of a file, such as "env=dev,staging". start is the offset in the line
+// where the options begin.
+func parseFileOptions(firstLine string, start int, relativePath string, allowed ...string) (map[string]string, error) {
+	options := make(map[string]string)
+	rest := firstLine[start:]
+
+	for _, option := range strings.Fields(rest) {
+		column := start + strings.Index(rest, option) + 1
+		name, value := option, ""
+		if i := strings.Index(option, "="); i != -1 {
+			name, value = option[:i], option[i+1:]
+		}
+
+		isAllowed := false
+		for _, a := range allowed {
+			isAllowed = isAllowed || a == name
+		}
+
+		if !isAllowed {
+			return nil, &ParseError{
+				Path:    relativePath,
+				Line:    1,
+				Column:  column,
+				Message: fmt.Sprintf("unknown file option %q", name),
+			}
+		}
+
+		options[name] = value
+	}
+
+	return options, nil
+}
+
+// environmentEnabled reports whether an item restricted to the comma separated
+// list of environments should be applied to the given environment. Entries
+// starting with "!" exclude an environment, such as "!prod". Items without a
+// list of environments are applied everywhere.
+func environmentEnabled(environments string, environment string) bool {
+	if environments == "" {
+		return true
+	}
+
+	included, hasIncluded := false, false
+
+	for _, e := range strings.Split(environments, ",") {
+		e = strings.TrimSpace(e)
+		if strings.HasPrefix(e, "!") {
+			if e[1:] == environment {
+				return false
+			}
+			continue
+		}
+		hasIncluded = true
+		included = included || e == environment
+	}
+
+	return included || !hasIncluded
+}
+
 func getGitRoot(path string) (string, error) {
 	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
 	cmd.Dir = path
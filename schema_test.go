@@ -1,11 +1,14 @@
 package pgit
 
 import (
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -35,16 +38,53 @@ func TestSchemaDirectory(t *testing.T) {
 			assert.FailNowf(t, "should read from disk", "got error: %v", err)
 		}
 
-		assert.Equal(t, 2, len(s.files), "should read two files from the root")
+		assert.Equal(t, 5, len(s.files), "should read five files from the root")
 		assert.IsType(t, &changesetFile{}, s.files["migrations/changelist_file.sql"], "file should be a changeset file")
 		assert.IsType(t, &changesetFile{}, s.files["migrations/subdir/changelist_file.sql"], "file should be a changeset file")
 		assert.Equal(t, "migrations/changelist_file.sql", s.files["migrations/changelist_file.sql"].getPath(), "sets file path relative to git root")
 		assert.Equal(t, "migrations/subdir/changelist_file.sql", s.files["migrations/subdir/changelist_file.sql"].getPath(), "sets file path relative to git root for subdirectory")
+		assert.IsType(t, &seedFile{}, s.files["migrations/countries.sql"], "file should be a seed file")
+		assert.Equal(t, &hookFile{path: "migrations/hooks/analyze.sql", phase: AfterMigrate, sql: "ANALYZE;"}, s.files["migrations/hooks/analyze.sql"], "file should be a hook file")
+		assert.False(t, s.files["migrations/countries.sql"].(*seedFile).enabled, "seed should be disabled outside of its environment")
+
+		s.environment = "dev"
+		assert.NoError(t, s.readFromDisk(), "should read from disk")
+		assert.True(t, s.files["migrations/countries.sql"].(*seedFile).enabled, "seed should be enabled in its environment")
 
 		s, err = newSchemaDirectory("./testdata/bad_root/migrations")
 		assert.NoError(t, err, "failed to create test schema directory")
 
-		assert.Error(t, s.readFromDisk(), "should detect invalid file type")
+		err = s.readFromDisk()
+
+		assert.Equal(t, ParseErrors{
+			{
+				Path:    "migrations/invalid_changelist.sql",
+				Line:    1,
+				Column:  14,
+				Message: `unknown file type "some_type"`,
+				Hint:    fileTypeHint,
+			},
+			{
+				Path:    "migrations/missing_rollback.sql",
+				Line:    3,
+				Column:  1,
+				Message: "missing rollback annotation",
+				Hint:    "add a -- rollback block after the change",
+			},
+			{
+				Path:    "migrations/unknown_option.sql",
+				Line:    1,
+				Column:  19,
+				Message: `unknown file option "repeat"`,
+			},
+			{
+				Path:    "migrations/unknown_phase.sql",
+				Line:    1,
+				Column:  19,
+				Message: `unknown hook phase "sometimes", expected one of before-migrate, after-each-file, after-migrate, before-rollback, after-rollback`,
+				Hint:    "hook files need a phase, such as -- pgit type=hook phase=before-migrate",
+			},
+		}, err, "should report every invalid file")
 	})
 
 	t.Run("read migration state", func(t *testing.T) {
@@ -84,16 +124,318 @@ func TestSchemaDirectory(t *testing.T) {
 				version: "",
 				path:    "migrations/changelist_file.sql",
 			},
-			"CREATE TABLE test_table (\n    col_a text\n);\n\n\n",
+			"CREATE TABLE test_table (\n    col_a text\n);",
 			"1",
 			mockMigration,
 		).Return(nil)
 
 		mockConnection.On("finishMigration", mockMigration).Return(nil)
+		mockConnection.On("executeHook", "ANALYZE;").Return(nil)
+
+		events := make([]HookEvent, 0)
+		recordEvent := func(event HookEvent) error {
+			events = append(events, event)
+			return nil
+		}
+		s.hooks = map[HookPhase][]func(HookEvent) error{
+			BeforeMigrate: {recordEvent},
+			AfterEachFile: {recordEvent},
+			AfterMigrate:  {recordEvent},
+		}
+
+		observed := make([]Event, 0)
+		s.observer = ObserverFunc(func(event Event) {
+			assert.False(t, event.Time.IsZero(), "event should have a time")
+			event.Time, event.Duration = time.Time{}, 0
+			observed = append(observed, event)
+		})
 
 		assert.NoError(t, s.applyLatest(mockConnection), "should apply schema successfully")
 
 		mockConnection.AssertExpectations(t)
+
+		assert.Equal(t, []HookEvent{
+			{Phase: BeforeMigrate, MigrationID: 1},
+			{Phase: AfterEachFile, MigrationID: 1, Path: "migrations/changelist_file.sql", ToVersion: "1"},
+			{Phase: AfterMigrate, MigrationID: 1},
+		}, events, "should run hooks with the migration and file")
+
+		assert.Equal(t, []Event{
+			{Type: FilePlanned, Path: "migrations/changelist_file.sql", ToVersion: "1"},
+			{Type: MigrationStarted, MigrationID: 1},
+			{Type: FileApplying, MigrationID: 1, Path: "migrations/changelist_file.sql", ToVersion: "1"},
+			{Type: FileApplied, MigrationID: 1, Path: "migrations/changelist_file.sql", ToVersion: "1"},
+			{Type: FileSkipped, Path: "migrations/countries.sql", Message: "not enabled for this environment"},
+			{Type: MigrationFinished, MigrationID: 1},
+		}, observed, "should send the events of the migration to the observer")
+	})
+
+	t.Run("failing before-migrate hook", func(t *testing.T) {
+		s, err := newSchemaDirectory("./testdata/good_root/migrations")
+		assert.NoError(t, err, "failed to create test schema directory")
+
+		mockConnection := &MockDatabaseConnection{}
+		mockMigration := &migration{id: 1}
+
+		mockConnection.On("readMigrationState").Return(&migrationState{
+			fileStates: make(map[string]*fileMigrationState),
+		}, nil)
+		mockConnection.On("createNewMigration").Return(mockMigration, nil)
+		mockConnection.On("removeMigration", mockMigration).Return(nil)
+
+		s.hooks = map[HookPhase][]func(HookEvent) error{
+			BeforeMigrate: {func(event HookEvent) error { return errors.New("not allowed") }},
+		}
+
+		assert.EqualError(t, s.applyLatest(mockConnection), "before-migrate hook failed: not allowed", "should stop the migration")
+
+		mockConnection.AssertExpectations(t)
+		mockConnection.AssertNotCalled(t, "applyAndUpdateStateForFile", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("verify rollbacks", func(t *testing.T) {
+		s, err := newSchemaDirectory("./testdata/good_root/migrations")
+		assert.NoError(t, err, "failed to create test schema directory")
+
+		mockConnection := &MockDatabaseConnection{}
+		mockMigration := &migration{id: 1}
+
+		mockConnection.On("readMigrationState").Return(&migrationState{
+			fileStates: make(map[string]*fileMigrationState),
+		}, nil)
+		mockConnection.On("createNewMigration").Return(mockMigration, nil)
+		mockConnection.On("snapshotCatalog").Return([]string{"schema public"}, nil).Once()
+		mockConnection.On("snapshotCatalog").Return([]string{"relation public.test_table r", "schema public"}, nil).Once()
+
+		mockConnection.On(
+			"applyAndUpdateStateForFile",
+			&fileMigrationState{path: "migrations/changelist_file.sql"},
+			"CREATE TABLE test_table (\n    col_a text\n);",
+			"1",
+			mockMigration,
+		).Return(nil).Twice()
+
+		mockConnection.On(
+			"rollbackFile",
+			&fileMigrationState{path: "migrations/changelist_file.sql", version: "1"},
+			"DROP TABLE test_table\n\n",
+			"",
+			mockMigration,
+		).Return(nil)
+
+		mockConnection.On("finishMigration", mockMigration).Return(nil)
+
+		results, err := s.verifyRollbacks(mockConnection)
+
+		assert.NoError(t, err, "should verify the rollbacks")
+		assert.Equal(t, []RollbackVerification{
+			{
+				Path:      "migrations/changelist_file.sql",
+				Change:    "1",
+				ToVersion: "1",
+				Result:    VerifyFailed,
+				Missing:   []string{},
+				Extra:     []string{"relation public.test_table r"},
+				Message:   "rolling back did not restore the database",
+			},
+		}, results, "should report the objects left behind by the rollback")
+
+		mockConnection.AssertExpectations(t)
+		mockConnection.AssertNotCalled(t, "executeHook", "ANALYZE;")
+	})
+
+	t.Run("drift", func(t *testing.T) {
+		s, err := newSchemaDirectory("./testdata/good_root/migrations")
+		assert.NoError(t, err, "failed to create test schema directory")
+		s.hooks = map[HookPhase][]func(HookEvent) error{
+			AfterMigrate: {func(event HookEvent) error {
+				assert.Fail(t, "should not run hooks on the shadow database")
+				return nil
+			}},
+		}
+
+		shadow := &MockDatabaseConnection{}
+		mockMigration := &migration{id: 1}
+
+		shadow.On("readMigrationState").Return(&migrationState{
+			fileStates: make(map[string]*fileMigrationState),
+		}, nil)
+		shadow.On("createNewMigration").Return(mockMigration, nil)
+		shadow.On(
+			"applyAndUpdateStateForFile",
+			&fileMigrationState{path: "migrations/changelist_file.sql"},
+			"CREATE TABLE test_table (\n    col_a text\n);",
+			"1",
+			mockMigration,
+		).Return(nil)
+		shadow.On("finishMigration", mockMigration).Return(nil)
+		shadow.On("executeHook", "ANALYZE;").Return(nil)
+		shadow.On("snapshotCatalog").Return([]string{
+			"column public.test_table.col_a text",
+			"relation public.test_table r",
+		}, nil)
+
+		mockConnection := &MockDatabaseConnection{}
+		mockConnection.On("snapshotCatalog").Return([]string{
+			"column public.test_table.col_a character varying(10)",
+			"relation public.test_table r",
+		}, nil)
+
+		drift, err := s.drift(mockConnection, shadow)
+
+		assert.NoError(t, err, "should compare the database with the shadow database")
+		assert.Equal(t, &SchemaDrift{
+			Missing: []string{"column public.test_table.col_a text"},
+			Extra:   []string{"column public.test_table.col_a character varying(10)"},
+		}, drift, "should report the objects that differ")
+
+		shadow.AssertExpectations(t)
+		mockConnection.AssertExpectations(t)
+
+		migrated := &MockDatabaseConnection{}
+		migrated.On("readMigrationState").Return(&migrationState{
+			fileStates: map[string]*fileMigrationState{
+				"migrations/changelist_file.sql": {path: "migrations/changelist_file.sql", version: "1"},
+			},
+		}, nil)
+
+		_, err = s.drift(mockConnection, migrated)
+
+		assert.EqualError(t, err, "the shadow database has already been migrated, drift needs an empty database", "should need an empty shadow database")
+	})
+
+	t.Run("baseline", func(t *testing.T) {
+		s, err := newSchemaDirectory("./testdata/good_root/migrations")
+		assert.NoError(t, err, "failed to create test schema directory")
+
+		mockConnection := &MockDatabaseConnection{}
+		mockMigration := &migration{id: 1}
+
+		mockConnection.On("readMigrationState").Return(&migrationState{
+			fileStates: make(map[string]*fileMigrationState),
+		}, nil)
+		mockConnection.On("createAdoptedMigration").Return(mockMigration, nil)
+		mockConnection.On(
+			"applyAndUpdateStateForFile",
+			&fileMigrationState{path: "migrations/changelist_file.sql"},
+			"",
+			"1",
+			mockMigration,
+		).Return(nil)
+		mockConnection.On("finishMigration", mockMigration).Return(nil)
+
+		assert.NoError(t, s.baseline(mockConnection, nil), "should record the baseline")
+		mockConnection.AssertExpectations(t)
+		mockConnection.AssertNotCalled(t, "executeHook", "ANALYZE;")
+
+		overridden := &MockDatabaseConnection{}
+		overridden.On("readMigrationState").Return(&migrationState{
+			fileStates: make(map[string]*fileMigrationState),
+		}, nil)
+
+		assert.NoError(t, s.baseline(overridden, map[string]string{"migrations/changelist_file.sql": ""}), "should leave the file to the next migration")
+		overridden.AssertNotCalled(t, "createAdoptedMigration")
+
+		assert.EqualError(
+			t,
+			s.baseline(overridden, map[string]string{"migrations/changelist_file.sql": "2"}),
+			"invalid baseline version for migrations/changelist_file.sql: the file has 1 changesets, got 2",
+			"should refuse more changesets than the file has",
+		)
+
+		assert.EqualError(
+			t,
+			s.baseline(overridden, map[string]string{"migrations/missing.sql": "1"}),
+			"unable to override the baseline of migrations/missing.sql, there is no such schema file",
+			"should refuse overrides of unknown files",
+		)
+
+		migrated := &MockDatabaseConnection{}
+		migrated.On("readMigrationState").Return(&migrationState{
+			fileStates: map[string]*fileMigrationState{
+				"migrations/changelist_file.sql": {path: "migrations/changelist_file.sql", version: "1"},
+			},
+		}, nil)
+
+		assert.Error(t, s.baseline(migrated, nil), "should refuse to baseline a migrated database")
+	})
+
+	t.Run("plan", func(t *testing.T) {
+		s, err := newSchemaDirectory("./testdata/good_root/migrations")
+		assert.NoError(t, err, "failed to create test schema directory")
+
+		mockConnection := &MockDatabaseConnection{}
+		mockConnection.On("readRecordedState").Return(&migrationState{
+			fileStates: make(map[string]*fileMigrationState),
+		}, nil)
+
+		steps, err := s.plan(mockConnection)
+
+		assert.NoError(t, err, "should plan the migration")
+		assert.Equal(t, []PlannedStep{
+			{
+				Path:      "migrations/changelist_file.sql",
+				ToVersion: "1",
+				SQL:       "CREATE TABLE test_table (\n    col_a text\n);",
+			},
+		}, steps, "should return the SQL that would be applied")
+
+		mockConnection.AssertExpectations(t)
+	})
+
+	t.Run("status", func(t *testing.T) {
+		s, err := newSchemaDirectory("./testdata/good_root/migrations")
+		assert.NoError(t, err, "failed to create test schema directory")
+
+		mockConnection := &MockDatabaseConnection{}
+		mockConnection.On("readRecordedState").Return(&migrationState{
+			fileStates: map[string]*fileMigrationState{
+				"migrations/changelist_file.sql": {path: "migrations/changelist_file.sql", version: "1"},
+			},
+		}, nil)
+
+		items, err := s.status(mockConnection)
+
+		assert.NoError(t, err, "should return the status")
+		assert.Equal(t, []StatusItem{
+			{Path: "migrations/changelist_file.sql", Change: "1", State: StateApplied},
+			{Path: "migrations/countries.sql", State: StateSkipped},
+		}, items, "should report applied and skipped items")
+
+		mockConnection.AssertExpectations(t)
+	})
+
+	t.Run("lint", func(t *testing.T) {
+		s, err := newSchemaDirectory("./testdata/good_root/migrations")
+		assert.NoError(t, err, "failed to create test schema directory")
+
+		findings, err := s.lint(nil)
+
+		assert.NoError(t, err, "should lint the schema")
+		assert.Equal(t, []LintFinding{
+			{Path: "migrations/changelist_file.sql", Change: "1", Line: 9, Rule: "rollback-if-exists", Severity: SeverityWarning, Message: "DROP without IF EXISTS fails if the rollback runs after the object is already gone"},
+		}, findings, "should lint every change without a database")
+	})
+
+	t.Run("run tests", func(t *testing.T) {
+		s, err := newSchemaDirectory("./testdata/good_root/migrations")
+		assert.NoError(t, err, "failed to create test schema directory")
+
+		mockConnection := &MockDatabaseConnection{}
+
+		mockConnection.On(
+			"runInRolledBackTransaction",
+			[]string{"SELECT * FROM test_table WHERE col_a IS NULL"},
+		).Return([]statementResult{{rows: 1}}, nil)
+
+		results, err := s.runTests(mockConnection)
+
+		assert.NoError(t, err, "should run tests")
+		assert.Equal(t, []TestResult{
+			{Path: "migrations/tests/test_table.sql", Line: 4, Message: "expected 0 rows, got 1"},
+		}, results, "should report the result of each assertion")
+
+		mockConnection.AssertExpectations(t)
 	})
 
 	t.Run("rollback", func(t *testing.T) {
@@ -121,11 +463,101 @@ func TestSchemaDirectory(t *testing.T) {
 
 		mockConnection.On("getFilesInMigration", &expectedMigration).Return(expectedFilesInMigration, nil)
 
-		mockConnection.On("rollbackFile", fileState, "DROP TABLE test_table\n\n", "0", &expectedMigration).Return(nil)
+		mockConnection.On("rollbackFile", fileState, "DROP TABLE test_table\n\n", "", &expectedMigration).Return(nil)
 
 		mockConnection.On("removeMigration", &expectedMigration).Return(nil)
 
+		assert.Equal(t, &DestructiveError{
+			Operations: []DestructiveOperation{{Path: "migrations/changelist_file.sql", Operation: "DROP TABLE"}},
+		}, s.rollback(mockConnection), "should refuse to drop a table without approval")
+		mockConnection.AssertNotCalled(t, "rollbackFile", fileState, "DROP TABLE test_table\n\n", "", &expectedMigration)
+
+		s.allowDestructive = true
 		assert.NoError(t, s.rollback(mockConnection), "should rollback successfully")
+		mockConnection.AssertExpectations(t)
+	})
+
+	t.Run("roll back a baseline", func(t *testing.T) {
+		s, err := newSchemaDirectory("./testdata/good_root/migrations")
+		assert.NoError(t, err, "failed to create test schema directory")
+		mockConnection := &MockDatabaseConnection{}
+
+		baseline := &migration{id: 1, completed: true, adopted: true}
+		fileState := &fileMigrationState{version: "1", path: "migrations/changelist_file.sql", migration: 1}
+
+		mockConnection.On("readMigrationState").Return(&migrationState{
+			fileStates:    map[string]*fileMigrationState{fileState.path: fileState},
+			lastMigration: baseline,
+		}, nil)
+		mockConnection.On("getFilesInMigration", baseline).Return([]fileMigrationState{*fileState}, nil)
+		mockConnection.On("rollbackFile", fileState, "", "", baseline).Return(nil)
+		mockConnection.On("removeMigration", baseline).Return(nil)
+
+		assert.NoError(t, s.rollback(mockConnection), "should only remove the state of a baseline, without approving destructive SQL")
+		mockConnection.AssertExpectations(t)
+	})
+}
+
+func TestMigrationSteps(t *testing.T) {
+	gitRoot, err := ioutil.TempDir("", "pgit-steps")
+	assert.NoError(t, err, "failed to create temp directory")
+	defer os.RemoveAll(gitRoot)
+
+	root := writeMigrations(t, gitRoot, "schema", map[string]string{
+		"users.sql": `-- pgit type=changeset
+
+-- change id=create_users
+CREATE TABLE users (id integer);
+
+-- rollback
+DROP TABLE users;
+
+-- change id=users_id notransaction
+CREATE INDEX CONCURRENTLY users_id ON users (id);
+
+-- rollback
+DROP INDEX CONCURRENTLY users_id;
+
+-- change id=analyze runAlways
+ANALYZE users;
+
+-- rollback
+SELECT 1;
+`,
+	})
+
+	t.Run("roll back every change of the last migration", func(t *testing.T) {
+		s := &schemaDirectory{gitRoot: gitRoot, root: root, files: make(map[string]schemaFile), state: &migrationState{}, allowDestructive: true}
+		db := &MockDatabaseConnection{}
+
+		last := &migration{id: 2, completed: true}
+		state := &fileMigrationState{path: "schema/users.sql", version: "create_users,users_id,analyze", migration: 2, previous: "create_users"}
+
+		db.On("readMigrationState").Return(&migrationState{fileStates: map[string]*fileMigrationState{}, lastMigration: last}, nil)
+		db.On("getFilesInMigration", last).Return([]fileMigrationState{*state}, nil)
+		db.On("rollbackFile", state, "SELECT 1;\n\n", "create_users,users_id", last).Return(nil)
+		db.On("applyWithoutTransaction", mock.Anything, "DROP INDEX CONCURRENTLY users_id;\n\n", "create_users", last).Return(nil)
+		db.On("removeMigration", last).Return(nil)
+
+		assert.NoError(t, s.rollback(db), "should roll back the migration")
+		db.AssertExpectations(t)
+	})
+
+	t.Run("remove migrations that only re-ran runAlways changes", func(t *testing.T) {
+		s := &schemaDirectory{gitRoot: gitRoot, root: root, files: make(map[string]schemaFile), state: &migrationState{}}
+		db := &MockDatabaseConnection{}
+
+		m := &migration{id: 3}
+		state := &fileMigrationState{path: "schema/users.sql", version: "create_users,users_id,analyze", migration: 2}
+
+		db.On("readMigrationState").Return(&migrationState{fileStates: map[string]*fileMigrationState{"schema/users.sql": state}, lastMigration: &migration{id: 2}}, nil)
+		db.On("createNewMigration").Return(m, nil)
+		db.On("applyAndUpdateStateForFile", state, "ANALYZE users;", "create_users,users_id,analyze", m).Return(nil)
+		db.On("removeMigration", m).Return(nil)
+
+		assert.NoError(t, s.applyLatest(db), "should re-run the runAlways change")
+		db.AssertExpectations(t)
+		db.AssertNotCalled(t, "finishMigration", m)
 	})
 }
 
@@ -139,17 +571,34 @@ func (m *MockDatabaseConnection) readMigrationState() (*migrationState, error) {
 	return mockMigrationState, args.Error(1)
 }
 
+func (m *MockDatabaseConnection) readRecordedState() (*migrationState, error) {
+	args := m.Called()
+	mockMigrationState, _ := args.Get(0).(*migrationState)
+	return mockMigrationState, args.Error(1)
+}
+
 func (m *MockDatabaseConnection) applyAndUpdateStateForFile(f *fileMigrationState, updateSQL string, newVersion string, mig *migration) error {
 	args := m.Called(f, updateSQL, newVersion, mig)
 	return args.Error(0)
 }
 
+func (m *MockDatabaseConnection) applyWithoutTransaction(f *fileMigrationState, updateSQL string, newVersion string, mig *migration) error {
+	args := m.Called(f, updateSQL, newVersion, mig)
+	return args.Error(0)
+}
+
 func (m *MockDatabaseConnection) createNewMigration() (*migration, error) {
 	args := m.Called()
 	mockMigration, _ := args.Get(0).(*migration)
 	return mockMigration, args.Error(1)
 }
 
+func (m *MockDatabaseConnection) createAdoptedMigration() (*migration, error) {
+	args := m.Called()
+	mockMigration, _ := args.Get(0).(*migration)
+	return mockMigration, args.Error(1)
+}
+
 func (m *MockDatabaseConnection) finishMigration(mig *migration) error {
 	args := m.Called(mig)
 	return args.Error(0)
@@ -170,3 +619,50 @@ func (m *MockDatabaseConnection) getFilesInMigration(mig *migration) ([]fileMigr
 	mockFileState, _ := args.Get(0).([]fileMigrationState)
 	return mockFileState, args.Error(1)
 }
+
+func (m *MockDatabaseConnection) runInRolledBackTransaction(statements []string) ([]statementResult, error) {
+	args := m.Called(statements)
+	mockResults, _ := args.Get(0).([]statementResult)
+	return mockResults, args.Error(1)
+}
+
+func (m *MockDatabaseConnection) readGrants(roles []string, schemas []string) ([]grant, error) {
+	args := m.Called(roles, schemas)
+	mockGrants, _ := args.Get(0).([]grant)
+	return mockGrants, args.Error(1)
+}
+
+func (m *MockDatabaseConnection) readExtensions(names []string) ([]catalogExtension, error) {
+	args := m.Called(names)
+	extensions, _ := args.Get(0).([]catalogExtension)
+	return extensions, args.Error(1)
+}
+
+func (m *MockDatabaseConnection) readHistory() ([]MigrationRecord, error) {
+	args := m.Called()
+	history, _ := args.Get(0).([]MigrationRecord)
+	return history, args.Error(1)
+}
+
+func (m *MockDatabaseConnection) snapshotCatalog() ([]string, error) {
+	args := m.Called()
+	objects, _ := args.Get(0).([]string)
+	return objects, args.Error(1)
+}
+
+func (m *MockDatabaseConnection) dumpSchema() ([]schemaObject, error) {
+	args := m.Called()
+	objects, _ := args.Get(0).([]schemaObject)
+	return objects, args.Error(1)
+}
+
+func (m *MockDatabaseConnection) readVersionTable(tool MigrationTool, table string) ([]string, error) {
+	args := m.Called(tool, table)
+	versions, _ := args.Get(0).([]string)
+	return versions, args.Error(1)
+}
+
+func (m *MockDatabaseConnection) executeHook(sql string) error {
+	args := m.Called(sql)
+	return args.Error(0)
+}
@@ -0,0 +1,56 @@
+package pgit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// seedFile represents a file of idempotent SQL, such as upserts of reference
+// data, that is executed again whenever the content of the file changes. The
+// version of a seed file is the hash of its content.
+type seedFile struct {
+	path    string
+	content []byte
+	// enabled is false when the file is restricted to other environments
+	enabled bool
+}
+
+func (f *seedFile) getPath() string {
+	return f.path
+}
+
+// hash returns the digest of the file content that is recorded as its version
+func (f *seedFile) hash() string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(string(f.content))))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func (f *seedFile) getApplySQL(currentVersion string) (string, string, error) {
+	if !f.enabled {
+		return "", currentVersion, nil
+	}
+
+	newVersion := f.hash()
+
+	if newVersion == currentVersion {
+		return "", currentVersion, nil
+	}
+
+	sql, err := joinStatements(string(f.content))
+
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to split seed into statements")
+	}
+
+	return sql, newVersion, nil
+}
+
+// getRollbackSQL returns no SQL because seeds are not rolled back. Removing
+// the recorded version means the seed is executed again on the next
+// migration.
+func (f *seedFile) getRollbackSQL(currentVersion string) (string, string, error) {
+	return "", "", nil
+}
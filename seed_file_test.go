@@ -0,0 +1,58 @@
+package pgit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeedFile(t *testing.T) {
+	f := seedFile{
+		path:    "seeds/countries.sql",
+		content: []byte("\nINSERT INTO countries (code) VALUES ('US')\nON CONFLICT (code) DO NOTHING;\n"),
+		enabled: true,
+	}
+
+	sql, version, err := f.getApplySQL("")
+
+	assert.NoError(t, err, "should return apply SQL")
+	assert.Equal(t, "INSERT INTO countries (code) VALUES ('US')\nON CONFLICT (code) DO NOTHING;", sql, "should apply the seed")
+	assert.Equal(t, f.hash(), version, "should use the content hash as the version")
+	assert.Regexp(t, "^[0-9a-f]{16}$", version, "version should be a hash")
+
+	sql, version, err = f.getApplySQL(f.hash())
+
+	assert.NoError(t, err, "should return apply SQL")
+	assert.Equal(t, "", sql, "should not apply the seed again when unchanged")
+	assert.Equal(t, f.hash(), version, "should keep the version")
+
+	sql, version, err = f.getApplySQL("0123456789abcdef")
+
+	assert.NoError(t, err, "should return apply SQL")
+	assert.NotEqual(t, "", sql, "should apply the seed again when the content changes")
+	assert.Equal(t, f.hash(), version, "should record the new hash")
+
+	sql, version, err = f.getRollbackSQL(f.hash())
+
+	assert.NoError(t, err, "should return rollback SQL")
+	assert.Equal(t, "", sql, "should not roll back seeds")
+	assert.Equal(t, "", version, "should clear the version")
+
+	f.enabled = false
+	sql, version, err = f.getApplySQL("")
+
+	assert.NoError(t, err, "should return apply SQL")
+	assert.Equal(t, "", sql, "should not apply a seed for another environment")
+	assert.Equal(t, "", version, "should not change the version")
+}
+
+func TestEnvironmentEnabled(t *testing.T) {
+	assert.True(t, environmentEnabled("", "prod"), "files without environments are always enabled")
+	assert.True(t, environmentEnabled("dev,staging", "staging"), "should enable listed environments")
+	assert.False(t, environmentEnabled("dev,staging", "prod"), "should disable other environments")
+	assert.False(t, environmentEnabled("dev", ""), "should disable restricted files when no environment is set")
+	assert.False(t, environmentEnabled("!prod", "prod"), "should disable excluded environments")
+	assert.True(t, environmentEnabled("!prod", "dev"), "should enable environments that are not excluded")
+	assert.True(t, environmentEnabled("!prod", ""), "should enable files that only exclude environments when no environment is set")
+	assert.False(t, environmentEnabled("dev,!dev", "dev"), "exclusions should take precedence")
+}
@@ -0,0 +1,283 @@
+package pgit
+
+import (
+	"strings"
+)
+
+// sqlStatement is a single statement extracted from a block of SQL by
+// splitStatements
+type sqlStatement struct {
+	sql    string
+	line   int
+	column int
+}
+
+// sqlLexer walks a block of Postgres SQL while keeping track of string
+// literals, quoted identifiers, dollar-quoted bodies and comments so that
+// semicolons and annotations inside of them are never mistaken for
+// statement boundaries.
+type sqlLexer struct {
+	src    string
+	pos    int
+	line   int
+	column int
+
+	// quotedLines records the lines that begin inside of a string, quoted
+	// identifier, dollar-quoted body or block comment
+	quotedLines map[int]bool
+	quoted      bool
+}
+
+func newSQLLexer(src string) *sqlLexer {
+	return &sqlLexer{src: src, line: 1, column: 1, quotedLines: make(map[int]bool)}
+}
+
+func (l *sqlLexer) done() bool {
+	return l.pos >= len(l.src)
+}
+
+func (l *sqlLexer) peek(offset int) byte {
+	if l.pos+offset >= len(l.src) {
+		return 0
+	}
+	return l.src[l.pos+offset]
+}
+
+func (l *sqlLexer) advance(n int) {
+	for i := 0; i < n && !l.done(); i++ {
+		if l.src[l.pos] == '\n' {
+			l.line++
+			l.column = 1
+			if l.quoted {
+				l.quotedLines[l.line] = true
+			}
+		} else {
+			l.column++
+		}
+		l.pos++
+	}
+}
+
+// next advances past the next token of interest and returns the word that
+// was consumed, if any. Semicolons are returned as ";".
+func (l *sqlLexer) next() (string, error) {
+	c := l.peek(0)
+	line, column := l.line, l.column
+
+	switch {
+	case c == '-' && l.peek(1) == '-':
+		for !l.done() && l.peek(0) != '\n' {
+			l.advance(1)
+		}
+	case c == '/' && l.peek(1) == '*':
+		l.quoted = true
+		defer func() { l.quoted = false }()
+		depth := 0
+		for {
+			if l.done() {
+				return "", &ParseError{Line: line, Column: column, Message: "unterminated block comment"}
+			}
+			if l.peek(0) == '/' && l.peek(1) == '*' {
+				depth++
+				l.advance(2)
+			} else if l.peek(0) == '*' && l.peek(1) == '/' {
+				depth--
+				l.advance(2)
+				if depth == 0 {
+					break
+				}
+			} else {
+				l.advance(1)
+			}
+		}
+	case c == '\'':
+		escapes := l.pos > 0 && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E') &&
+			(l.pos < 2 || !isIdentifierChar(l.src[l.pos-2]))
+		return "", l.skipQuoted('\'', escapes, "string literal", line, column)
+	case c == '"':
+		return "", l.skipQuoted('"', false, "quoted identifier", line, column)
+	case c == '$':
+		tag := l.dollarTag()
+		if tag == "" {
+			l.advance(1)
+			return "", nil
+		}
+		l.quoted = true
+		defer func() { l.quoted = false }()
+		l.advance(len(tag))
+		end := strings.Index(l.src[l.pos:], tag)
+		if end == -1 {
+			return "", &ParseError{
+				Line:    line,
+				Column:  column,
+				Message: "unterminated dollar-quoted string " + tag,
+				Hint:    "the body must end with a matching " + tag,
+			}
+		}
+		l.advance(end + len(tag))
+	case c == ';':
+		l.advance(1)
+		return ";", nil
+	case isIdentifierStart(c):
+		start := l.pos
+		for !l.done() && isIdentifierChar(l.peek(0)) {
+			l.advance(1)
+		}
+		return strings.ToUpper(l.src[start:l.pos]), nil
+	default:
+		l.advance(1)
+	}
+
+	return "", nil
+}
+
+func (l *sqlLexer) skipQuoted(quote byte, escapes bool, kind string, line, column int) error {
+	l.quoted = true
+	defer func() { l.quoted = false }()
+	l.advance(1)
+	for {
+		if l.done() {
+			return &ParseError{Line: line, Column: column, Message: "unterminated " + kind}
+		}
+		c := l.peek(0)
+		if escapes && c == '\\' {
+			l.advance(2)
+		} else if c == quote && l.peek(1) == quote {
+			l.advance(2)
+		} else if c == quote {
+			l.advance(1)
+			return nil
+		} else {
+			l.advance(1)
+		}
+	}
+}
+
+// dollarTag returns the dollar quote tag (e.g. "$$" or "$body$") starting at
+// the current position, or the empty string if there is none. Positional
+// parameters such as $1 are not tags.
+func (l *sqlLexer) dollarTag() string {
+	if l.pos > 0 && isIdentifierChar(l.src[l.pos-1]) {
+		return ""
+	}
+	for i := l.pos + 1; i < len(l.src); i++ {
+		c := l.src[i]
+		if c == '$' {
+			return l.src[l.pos : i+1]
+		}
+		if !isIdentifierChar(c) || (i == l.pos+1 && c >= '0' && c <= '9') {
+			return ""
+		}
+	}
+	return ""
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStart(c) || (c >= '0' && c <= '9') || c == '$'
+}
+
+// splitStatements splits a block of SQL into its individual statements. The
+// returned statements do not include the terminating semicolon, and blocks
+// that contain only whitespace or comments are omitted.
+func splitStatements(src string) ([]sqlStatement, error) {
+	l := newSQLLexer(src)
+	statements := make([]sqlStatement, 0)
+
+	start, end, line, column := 0, 0, 1, 1
+	// atomicDepth tracks BEGIN ATOMIC ... END function bodies, whose
+	// semicolons do not terminate the enclosing statement
+	atomicDepth := 0
+	previousWord := ""
+	hasContent := false
+
+	flush := func() {
+		if hasContent {
+			statements = append(statements, sqlStatement{
+				sql:    strings.TrimSpace(src[start:end]),
+				line:   line,
+				column: column,
+			})
+		}
+		hasContent = false
+		previousWord = ""
+		atomicDepth = 0
+	}
+
+	for !l.done() {
+		c := l.peek(0)
+		isComment := (c == '-' && l.peek(1) == '-') || (c == '/' && l.peek(1) == '*')
+
+		if !hasContent && !isComment && !isSpace(c) && c != ';' {
+			hasContent = true
+			start, line, column = l.pos, l.line, l.column
+		}
+
+		word, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if !isComment && !isSpace(c) && word != ";" {
+			end = l.pos
+		}
+
+		switch {
+		case word == ";" && atomicDepth == 0:
+			flush()
+		case word == "ATOMIC" && previousWord == "BEGIN":
+			atomicDepth++
+		case word == "CASE" && atomicDepth > 0:
+			atomicDepth++
+		case word == "END" && atomicDepth > 0:
+			atomicDepth--
+		}
+
+		if word == ";" && atomicDepth > 0 {
+			end = l.pos
+		} else if word != "" && word != ";" {
+			previousWord = word
+		}
+	}
+
+	flush()
+
+	return statements, nil
+}
+
+// joinStatements combines blocks of SQL into a single script containing one
+// semicolon terminated statement per line.
+func joinStatements(blocks ...string) (string, error) {
+	statements := make([]string, 0)
+	for _, block := range blocks {
+		s, err := splitStatements(block)
+		if err != nil {
+			return "", err
+		}
+		for _, statement := range s {
+			statements = append(statements, statement.sql+";")
+		}
+	}
+	return strings.Join(statements, "\n"), nil
+}
+
+// quotedLines returns the line numbers in src which begin inside of a string
+// literal, quoted identifier, dollar-quoted body or block comment. Lines
+// such as "-- change" that appear on these lines are SQL content rather than
+// pgit annotations.
+func quotedLines(src string) (map[int]bool, error) {
+	l := newSQLLexer(src)
+	for !l.done() {
+		if _, err := l.next(); err != nil {
+			return nil, err
+		}
+	}
+	return l.quotedLines, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
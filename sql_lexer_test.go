@@ -0,0 +1,98 @@
+package pgit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitStatements(t *testing.T) {
+	t.Run("simple statements", func(t *testing.T) {
+		statements, err := splitStatements("CREATE TABLE a (col text);\n\nDROP TABLE b")
+
+		assert.NoError(t, err, "should split statements")
+		assert.Equal(t, []sqlStatement{
+			{sql: "CREATE TABLE a (col text)", line: 1, column: 1},
+			{sql: "DROP TABLE b", line: 3, column: 1},
+		}, statements, "should return each statement with its position")
+	})
+
+	t.Run("dollar-quoted bodies", func(t *testing.T) {
+		statements, err := splitStatements(`
+CREATE FUNCTION f() RETURNS void AS $body$
+BEGIN
+    PERFORM 1;
+    RAISE NOTICE '$$;';
+END;
+$body$ LANGUAGE plpgsql;
+SELECT $1, $$;$$;`)
+
+		assert.NoError(t, err, "should split statements")
+		assert.Equal(t, 2, len(statements), "should not split inside of dollar quotes")
+		assert.Equal(t, 2, statements[0].line, "should record the line of the first statement")
+		assert.Equal(t, "SELECT $1, $$;$$", statements[1].sql, "should treat positional parameters as code")
+	})
+
+	t.Run("strings, identifiers and comments", func(t *testing.T) {
+		statements, err := splitStatements(`
+INSERT INTO "a;b" VALUES ('it''s;', E'\';'); -- trailing; comment
+/* block; /* nested; */ comment */
+SELECT 1 -- no semicolon`)
+
+		assert.NoError(t, err, "should split statements")
+		assert.Equal(t, []sqlStatement{
+			{sql: `INSERT INTO "a;b" VALUES ('it''s;', E'\';')`, line: 2, column: 1},
+			{sql: "SELECT 1", line: 4, column: 1},
+		}, statements, "should ignore semicolons in strings, identifiers and comments")
+	})
+
+	t.Run("sql standard function bodies", func(t *testing.T) {
+		statements, err := splitStatements(`
+CREATE FUNCTION f(a int) RETURNS int
+BEGIN ATOMIC
+    SELECT CASE WHEN a > 0 THEN a ELSE 0 END;
+    SELECT a;
+END;
+SELECT 1;`)
+
+		assert.NoError(t, err, "should split statements")
+		assert.Equal(t, 2, len(statements), "should not split inside of BEGIN ATOMIC bodies")
+		assert.Equal(t, "SELECT 1", statements[1].sql, "should resume splitting after the body")
+	})
+
+	t.Run("unterminated constructs", func(t *testing.T) {
+		_, err := splitStatements("SELECT 'abc;")
+		assert.EqualError(t, err, "line 1, column 8: unterminated string literal")
+
+		_, err = splitStatements("SELECT 1;\nCREATE FUNCTION f() AS $$ SELECT 1;")
+		assert.Equal(t, &ParseError{
+			Line:    2,
+			Column:  24,
+			Message: "unterminated dollar-quoted string $$",
+			Hint:    "the body must end with a matching $$",
+		}, err, "should report the position of the dollar quote")
+
+		_, err = splitStatements("/* comment")
+		assert.EqualError(t, err, "line 1, column 1: unterminated block comment")
+	})
+}
+
+func TestJoinStatements(t *testing.T) {
+	sql, err := joinStatements("DROP FUNCTION f(text);\n\n", "CREATE FUNCTION f(text, text) AS $$ SELECT 1; $$\n")
+
+	assert.NoError(t, err, "should join statements")
+	assert.Equal(
+		t,
+		"DROP FUNCTION f(text);\nCREATE FUNCTION f(text, text) AS $$ SELECT 1; $$;",
+		sql,
+		"should terminate each statement exactly once",
+	)
+}
+
+func TestQuotedLines(t *testing.T) {
+	quoted, err := quotedLines("SELECT $$\n-- change\n$$;\n-- change\n")
+
+	assert.NoError(t, err, "should scan SQL")
+	assert.True(t, quoted[2], "line inside dollar quotes should be quoted")
+	assert.False(t, quoted[4], "line outside dollar quotes should not be quoted")
+}
@@ -0,0 +1,292 @@
+package pgit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// squash replaces the first through changesets of the changeset file at path
+// with a single changeset that creates the objects they leave behind. The
+// objects are read from the catalog of db, which must be an empty scratch
+// database, after applying every file that comes before the changeset file
+// and then the changesets being squashed.
+func (s *schemaDirectory) squash(db DatabaseConnection, path string, through int) error {
+	if err := s.readFromDisk(); err != nil {
+		return errors.Wrap(err, "failed to populate schema from disk")
+	}
+
+	c, ok := s.files[path].(*changesetFile)
+
+	if !ok {
+		return errors.Errorf("%v is not a changeset file", path)
+	}
+
+	if through < 2 || through > len(c.changesets) {
+		return errors.Errorf("unable to squash the first %v changes of %v, which has %v", through, path, len(c.changesets))
+	}
+
+	for i := 0; i < through; i++ {
+		cs := c.changesets[i]
+
+		if cs.runAlways || cs.environments != "" || cs.skipped {
+			return errors.Errorf("change %v runs always or only in some environments, so it cannot be squashed", c.key(i))
+		}
+
+		// the catalog only holds the objects a change creates, so the rows
+		// it writes would be lost
+		statements, err := dataStatements(cs.applySQL)
+
+		if err != nil {
+			return errors.Wrapf(err, "unable to split the SQL of change %v into statements", c.key(i))
+		}
+
+		if len(statements) > 0 {
+			return errors.Errorf(
+				"change %v changes data with %v, which a squashed change cannot keep, squash only the changes before it",
+				c.key(i), strings.Join(statements, ", "),
+			)
+		}
+	}
+
+	filePath := filepath.Join(s.gitRoot, path)
+	content, err := ioutil.ReadFile(filePath)
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to read file %v", path)
+	}
+
+	if err := s.readMigrationState(db); err != nil {
+		return errors.Wrap(err, "failed to read migration state")
+	}
+
+	if len(s.state.fileStates) > 0 {
+		return errors.New("the scratch database has already been migrated, squash needs an empty database")
+	}
+
+	s.useDatabase(db)
+
+	migration, err := db.createNewMigration()
+
+	if err != nil {
+		return err
+	}
+
+	// the files applied before the changeset file provide the objects its
+	// changesets depend on
+	for _, p := range s.sortedPaths() {
+		if p == path {
+			break
+		}
+
+		steps, err := getApplySteps(s.files[p], "")
+
+		if err != nil {
+			return errors.Wrapf(err, "failed to get SQL for applying %v", p)
+		}
+
+		fileState := &fileMigrationState{path: p}
+
+		for _, step := range steps {
+			if err := applyToScratch(db, fileState, step, migration); err != nil {
+				return errors.Wrapf(err, "unable to apply %v to the scratch database", p)
+			}
+		}
+	}
+
+	before, err := db.dumpSchema()
+
+	if err != nil {
+		return err
+	}
+
+	fileState := &fileMigrationState{path: path}
+
+	for i := 0; i < through; i++ {
+		step := applyStep{sql: c.changesets[i].applySQL, version: c.version(i + 1), noTransaction: c.changesets[i].noTransaction}
+		if err := applyToScratch(db, fileState, step, migration); err != nil {
+			return errors.Wrapf(err, "unable to apply change %v to the scratch database", c.key(i))
+		}
+	}
+
+	after, err := db.dumpSchema()
+
+	if err != nil {
+		return err
+	}
+
+	if err := db.finishMigration(migration); err != nil {
+		return err
+	}
+
+	objects, err := squashedObjects(before, after)
+
+	if err != nil {
+		return err
+	}
+
+	squashed, err := squashChangesets(content, c, through, objects)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filePath, squashed, info.Mode())
+}
+
+// applyToScratch applies a step to a scratch database
+func applyToScratch(db DatabaseConnection, fileState *fileMigrationState, step applyStep, m *migration) error {
+	var err error
+	if step.noTransaction {
+		err = db.applyWithoutTransaction(fileState, step.sql, step.version, m)
+	} else {
+		err = db.applyAndUpdateStateForFile(fileState, step.sql, step.version, m)
+	}
+	if err == nil {
+		fileState.version = step.version
+	}
+	return err
+}
+
+// dataStatements returns the kinds of the statements in a block of SQL that
+// change data or run code, such as INSERT or DO, rather than define objects
+func dataStatements(sql string) ([]string, error) {
+	statements, err := splitStatements(sql)
+
+	if err != nil {
+		return nil, err
+	}
+
+	kinds := make([]string, 0)
+
+	for _, statement := range statements {
+		words, err := statementWords(statement.sql)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(words) == 0 {
+			continue
+		}
+
+		switch words[0] {
+		case "INSERT", "UPDATE", "DELETE", "MERGE", "COPY", "TRUNCATE", "DO", "CALL":
+			kinds = append(kinds, words[0])
+		case "WITH":
+			// a data modifying WITH query
+			for _, word := range []string{"INSERT", "UPDATE", "DELETE"} {
+				if containsString(words, word) {
+					kinds = append(kinds, "WITH "+word)
+					break
+				}
+			}
+		}
+	}
+
+	return kinds, nil
+}
+
+// squashedObjects returns the objects of after that are not in before. It
+// returns an error if objects of before were changed or removed, which a
+// changeset that only creates objects cannot do.
+func squashedObjects(before, after []schemaObject) ([]schemaObject, error) {
+	existing := make(map[string]string, len(before))
+	for _, o := range before {
+		existing[o.identity] = o.create
+	}
+
+	created := make([]schemaObject, 0)
+	altered := make([]string, 0)
+
+	for _, o := range after {
+		create, ok := existing[o.identity]
+		switch {
+		case !ok:
+			created = append(created, o)
+		case create != o.create:
+			altered = append(altered, o.identity)
+		}
+		delete(existing, o.identity)
+	}
+
+	for identity := range existing {
+		altered = append(altered, identity)
+	}
+
+	if len(altered) > 0 {
+		sort.Strings(altered)
+		return nil, errors.Errorf(
+			"the changes alter or drop objects created by other files, which a squashed change cannot do: %v",
+			strings.Join(altered, ", "),
+		)
+	}
+
+	return created, nil
+}
+
+// squashChangesets returns the content of the changeset file with its first
+// through changesets replaced by a changeset that creates the objects and
+// records the keys of the changesets it replaces
+func squashChangesets(content []byte, c *changesetFile, through int, objects []schemaObject) ([]byte, error) {
+	lines := strings.Split(string(content), "\n")
+
+	// the line of the change annotation is the line before the SQL
+	start := c.changesets[0].applyLine - 2
+	end := len(lines)
+	if through < len(c.changesets) {
+		end = c.changesets[through].applyLine - 2
+	}
+
+	if isTemplate([]byte(strings.Join(lines[start:end], "\n"))) {
+		return nil, errors.New("the changes use template variables, which a squashed change cannot keep")
+	}
+
+	keys := make([]string, through)
+	for i := range keys {
+		keys[i] = c.key(i)
+	}
+
+	block := []string{
+		fmt.Sprintf("%v id=squashed_%v squashes=%v", changesetAnnotation, keys[through-1], encodeChangesetVersion(keys)),
+		fmt.Sprintf("-- squashed from changes %v to %v", keys[0], keys[through-1]),
+		// functions are created before the tables their bodies use
+		"SET LOCAL check_function_bodies = off;",
+		"",
+	}
+
+	drops := make([]string, 0)
+
+	for _, o := range objects {
+		block = append(block, o.create, "")
+		if o.drop != "" {
+			drops = append([]string{o.drop}, drops...)
+		}
+	}
+
+	block = append(block, rollbackAnnotation)
+	block = append(block, drops...)
+	block = append(block, "")
+
+	squashed := append(append(append([]string{}, lines[:start]...), block...), lines[end:]...)
+	result := []byte(strings.Join(squashed, "\n"))
+
+	// the squashed file must still be valid, for example its ids unique
+	check := changesetFile{path: c.path}
+	if err := check.parse(withoutHeader(result)); err != nil {
+		return nil, errors.Wrap(err, "the squashed file is invalid")
+	}
+
+	return result, nil
+}
@@ -0,0 +1,176 @@
+package pgit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const unsquashedFile = `-- pgit type=changeset
+
+-- change
+CREATE TABLE users (id integer);
+
+-- rollback
+DROP TABLE users;
+
+-- change
+ALTER TABLE users ADD COLUMN email text;
+
+-- rollback
+ALTER TABLE users DROP COLUMN email;
+
+-- change
+CREATE INDEX users_email ON users (email);
+
+-- rollback
+DROP INDEX users_email;
+`
+
+func TestSquashChangesets(t *testing.T) {
+	c := changesetFile{path: "users.sql"}
+
+	if err := c.parse(withoutHeader([]byte(unsquashedFile))); err != nil {
+		assert.FailNowf(t, "should parse the file", "got error: %v", err)
+	}
+
+	content, err := squashChangesets([]byte(unsquashedFile), &c, 2, []schemaObject{
+		{identity: "table public.users", create: "CREATE TABLE public.users (\n    id integer,\n    email text\n);", drop: "DROP TABLE IF EXISTS public.users;"},
+		{identity: "comment public.users", create: "COMMENT ON TABLE public.users IS 'people';"},
+	})
+
+	assert.NoError(t, err, "should squash the changesets")
+	assert.Equal(t, `-- pgit type=changeset
+
+-- change id=squashed_2 squashes=2
+-- squashed from changes 1 to 2
+SET LOCAL check_function_bodies = off;
+
+CREATE TABLE public.users (
+    id integer,
+    email text
+);
+
+COMMENT ON TABLE public.users IS 'people';
+
+-- rollback
+DROP TABLE IF EXISTS public.users;
+
+-- change
+CREATE INDEX users_email ON users (email);
+
+-- rollback
+DROP INDEX users_email;
+`, string(content), "should replace the changesets with one creating the objects")
+
+	squashed := changesetFile{path: "users.sql"}
+
+	if err := squashed.parse(withoutHeader(content)); err != nil {
+		assert.FailNowf(t, "should parse the squashed file", "got error: %v", err)
+	}
+
+	t.Run("translate versions recorded before the squash", func(t *testing.T) {
+		version, err := squashed.unsquash("2")
+		assert.NoError(t, err, "should translate the version")
+		assert.Equal(t, "squashed_2", version, "should replace the squashed changesets")
+
+		version, err = squashed.unsquash("3")
+		assert.NoError(t, err, "should translate the version")
+		assert.Equal(t, "squashed_2,2", version, "should move the following changesets")
+
+		version, err = squashed.unsquash("squashed_2,2")
+		assert.NoError(t, err, "should keep versions recorded after the squash")
+		assert.Equal(t, "squashed_2,2", version, "should not change the version")
+
+		_, err = squashed.unsquash("1")
+		assert.EqualError(
+			t,
+			err,
+			"only 1 of the 2 changes squashed into squashed_2 were applied, apply the rest with the file from before they were squashed",
+			"should refuse versions part way through the squashed changesets",
+		)
+	})
+
+	t.Run("apply from a version recorded before the squash", func(t *testing.T) {
+		steps, err := squashed.getApplySteps("3")
+		assert.NoError(t, err, "should return apply steps")
+		assert.Equal(t, []applyStep{{version: "squashed_2,2"}}, steps, "should record the translated version without running SQL")
+
+		steps, err = squashed.getRollbackSteps("squashed_2,2", "3")
+		assert.NoError(t, err, "should return rollback steps")
+		assert.Equal(t, []applyStep{{version: "3"}}, steps, "should restore the version recorded before the squash without running SQL")
+
+		steps, err = squashed.getApplySteps("2")
+		assert.NoError(t, err, "should return apply steps")
+		assert.Equal(t, []applyStep{
+			{sql: "CREATE INDEX users_email ON users (email);", version: "squashed_2,2"},
+		}, steps, "should apply the changesets after the squashed ones")
+	})
+
+	t.Run("template variables", func(t *testing.T) {
+		_, err := squashChangesets([]byte("-- pgit type=changeset\n-- change\nCREATE ROLE {{ .Role }};\n-- rollback\n-- change\nSELECT 1;\n-- rollback\n"), &changesetFile{
+			changesets: []changeset{{applyLine: 3}, {applyLine: 6}},
+		}, 1, nil)
+		assert.Error(t, err, "should refuse to squash changesets using template variables")
+	})
+}
+
+func TestSquashedObjects(t *testing.T) {
+	before := []schemaObject{
+		{identity: "table public.accounts", create: "CREATE TABLE public.accounts (id integer);"},
+	}
+
+	objects, err := squashedObjects(before, []schemaObject{
+		{identity: "table public.accounts", create: "CREATE TABLE public.accounts (id integer);"},
+		{identity: "table public.users", create: "CREATE TABLE public.users (id integer);"},
+	})
+
+	assert.NoError(t, err, "should return the created objects")
+	assert.Equal(t, []schemaObject{
+		{identity: "table public.users", create: "CREATE TABLE public.users (id integer);"},
+	}, objects, "should leave out objects created by other files")
+
+	_, err = squashedObjects(before, []schemaObject{
+		{identity: "table public.accounts", create: "CREATE TABLE public.accounts (id integer, name text);"},
+	})
+
+	assert.EqualError(
+		t,
+		err,
+		"the changes alter or drop objects created by other files, which a squashed change cannot do: table public.accounts",
+		"should refuse changes to objects of other files",
+	)
+}
+
+func TestChangesetSquashesOption(t *testing.T) {
+	c := changesetFile{path: "users.sql"}
+	err := c.parse([]byte("\n-- change squashes=2\nSELECT 1;\n-- rollback\n"))
+	assert.Equal(t, &ParseError{
+		Path:    "users.sql",
+		Line:    2,
+		Column:  1,
+		Message: "a change that squashes others needs an id",
+		Hint:    "add an id, such as -- change id=squashed_40 squashes=40",
+	}, err, "should need an id")
+
+	c = changesetFile{path: "users.sql"}
+	err = c.parse([]byte("\n-- change\nSELECT 1;\n-- rollback\n-- change id=b squashes=2\nSELECT 2;\n-- rollback\n"))
+	assert.Error(t, err, "should only allow the first change to squash others")
+}
+
+func TestDataStatements(t *testing.T) {
+	kinds, err := dataStatements(`
+CREATE TABLE users (id integer, name text);
+INSERT INTO users VALUES (1, 'update');
+WITH removed AS (DELETE FROM users RETURNING id) SELECT count(*) FROM removed;
+DO $$ BEGIN PERFORM 1; END $$;
+COMMENT ON TABLE users IS 'insert people here';
+`)
+
+	assert.NoError(t, err, "should split the statements")
+	assert.Equal(t, []string{"INSERT", "WITH DELETE", "DO"}, kinds, "should find the statements that change data")
+
+	kinds, err = dataStatements("CREATE INDEX users_name ON users (name);\nALTER TABLE users ADD COLUMN email text;")
+	assert.NoError(t, err, "should split the statements")
+	assert.Empty(t, kinds, "should allow statements that only define objects")
+}
@@ -0,0 +1,73 @@
+package pgit
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"text/template"
+)
+
+// templateActionRegexp matches the placeholders, such as {{ .Role }}, that
+// make a file a template. Files without them are used as is so that SQL such
+// as the array literal '{{1,2},{3,4}}' does not need to be escaped.
+var templateActionRegexp = regexp.MustCompile(`\{\{-?\s*\.`)
+
+var templateErrorRegexp = regexp.MustCompile(`^template: sql:(\d+)(?::(\d+))?: (?:executing "sql" at <[^>]*>: )?(.*)$`)
+
+var missingKeyRegexp = regexp.MustCompile(`^map has no entry for key "(.*)"$`)
+
+// isTemplate reports whether the content of a file contains placeholders
+func isTemplate(content []byte) bool {
+	return templateActionRegexp.Match(content)
+}
+
+// renderTemplate fills in the placeholders in the content of a file with the
+// values of the variables. Using a variable that has no value is an error.
+func renderTemplate(path string, content []byte, variables map[string]string) ([]byte, error) {
+	if !isTemplate(content) {
+		return content, nil
+	}
+
+	if variables == nil {
+		variables = make(map[string]string)
+	}
+
+	t, err := template.New("sql").Option("missingkey=error").Parse(string(content))
+
+	if err != nil {
+		return nil, templateError(path, err)
+	}
+
+	var rendered bytes.Buffer
+
+	if err := t.Execute(&rendered, variables); err != nil {
+		return nil, templateError(path, err)
+	}
+
+	return rendered.Bytes(), nil
+}
+
+// templateError converts an error from text/template into a ParseError
+func templateError(path string, err error) error {
+	parseErr := &ParseError{Path: path, Line: 1, Column: 1, Message: err.Error()}
+
+	tokens := templateErrorRegexp.FindStringSubmatch(err.Error())
+
+	if len(tokens) != 4 {
+		return parseErr
+	}
+
+	parseErr.Line, _ = strconv.Atoi(tokens[1])
+	if tokens[2] != "" {
+		parseErr.Column, _ = strconv.Atoi(tokens[2])
+	}
+	parseErr.Message = tokens[3]
+
+	if missing := missingKeyRegexp.FindStringSubmatch(tokens[3]); len(missing) == 2 {
+		parseErr.Message = fmt.Sprintf("variable %q is not set", missing[1])
+		parseErr.Hint = fmt.Sprintf("set it in the variables file, with PGIT_VAR_%v or with -var %v=<value>", missing[1], missing[1])
+	}
+
+	return parseErr
+}
@@ -0,0 +1,108 @@
+package pgit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	content := []byte("\nGRANT SELECT ON orders TO {{ .ReadRole }};\n")
+
+	rendered, err := renderTemplate("grants.sql", content, map[string]string{"ReadRole": "reporting"})
+
+	assert.NoError(t, err, "should render the template")
+	assert.Equal(t, "\nGRANT SELECT ON orders TO reporting;\n", string(rendered), "should fill in the placeholder")
+
+	_, err = renderTemplate("grants.sql", content, nil)
+
+	assert.Equal(t, &ParseError{
+		Path:    "grants.sql",
+		Line:    2,
+		Column:  29,
+		Message: `variable "ReadRole" is not set`,
+		Hint:    "set it in the variables file, with PGIT_VAR_ReadRole or with -var ReadRole=<value>",
+	}, err, "should report unset variables")
+
+	_, err = renderTemplate("grants.sql", []byte("\n\nSELECT {{ .Role | quote }};\n"), nil)
+
+	assert.IsType(t, &ParseError{}, err, "should report invalid templates")
+	assert.Equal(t, 3, err.(*ParseError).Line, "should report the line of the invalid template")
+
+	arrays := []byte("\nSELECT '{{1,2},{3,4}}'::int[];\n")
+	rendered, err = renderTemplate("arrays.sql", arrays, nil)
+
+	assert.NoError(t, err, "should not treat files without placeholders as templates")
+	assert.Equal(t, arrays, rendered, "should leave files without placeholders unchanged")
+}
+
+func TestDefinitionFileVersion(t *testing.T) {
+	d := definitionFile{path: "roles.sql", content: []byte("-- definition\nCREATE ROLE {{ .Role }} PASSWORD '{{ .Password }}';\n-- rollback\nDROP ROLE {{ .Role }};\n")}
+
+	d.variables = map[string]string{"Role": "app", "Password": "secret"}
+	appVersion, err := d.fileVersion("abc123", d.content)
+
+	assert.NoError(t, err, "should return the version")
+	assert.Regexp(t, `^abc123\+[0-9a-f]{12}$`, appVersion, "should add a hash of the rendered SQL")
+	assert.NotContains(t, appVersion, "secret", "should not record the values of the variables")
+	assert.Equal(t, "abc123", versionCommit(appVersion), "should return the commit of the version")
+
+	d.variables = map[string]string{"Role": "app", "Password": "changed"}
+	changedVersion, err := d.fileVersion("abc123", d.content)
+
+	assert.NoError(t, err, "should return the version")
+	assert.NotEqual(t, appVersion, changedVersion, "should change the version when a variable changes")
+
+	version, err := d.fileVersion("abc123", []byte("-- definition\nSELECT 1;\n-- rollback\nSELECT 2;\n"))
+
+	assert.NoError(t, err, "should return the version")
+	assert.Equal(t, "abc123", version, "should use the commit for files without placeholders")
+}
+
+func TestDefinitionFileTemplateRollback(t *testing.T) {
+	gitRoot, err := ioutil.TempDir("", "pgit-test")
+	assert.NoError(t, err, "failed to create temp directory for test repo")
+	defer os.RemoveAll(gitRoot)
+
+	runCommand(t, gitRoot, "git", "init")
+	runCommand(t, gitRoot, "git", "config", "user.email", "test@test.com")
+	runCommand(t, gitRoot, "git", "config", "user.name", "Test Name")
+
+	first := []byte("-- pgit type=definition\n-- definition\nCREATE ROLE {{ .Role }};\n-- rollback\nDROP ROLE {{ .Role }};\n")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(gitRoot, "roles.sql"), first, 0644), "failed to write file")
+	runCommand(t, gitRoot, "git", "add", "-A")
+	runCommand(t, gitRoot, "git", "commit", "-m", `"commit 1"`)
+
+	d := definitionFile{path: "roles.sql", gitRoot: gitRoot, content: withoutHeader(first), variables: map[string]string{"Role": "app"}}
+
+	firstVersion, err := d.fileVersion(mustGetCurrentSHA(t, &d), d.content)
+	assert.NoError(t, err, "should return the version")
+
+	second := []byte("-- pgit type=definition\n-- definition\nCREATE ROLE {{ .Role }} LOGIN;\n-- rollback\nDROP ROLE {{ .Role }};\n")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(gitRoot, "roles.sql"), second, 0644), "failed to write file")
+	runCommand(t, gitRoot, "git", "add", "-A")
+	runCommand(t, gitRoot, "git", "commit", "-m", `"commit 2"`)
+
+	d.content = withoutHeader(second)
+
+	sql, secondVersion, err := d.getApplySQL(firstVersion)
+
+	assert.NoError(t, err, "should return apply SQL")
+	assert.Equal(t, "DROP ROLE app;\nCREATE ROLE app LOGIN;", sql, "should render both revisions")
+
+	steps, err := d.getRollbackSteps(secondVersion, firstVersion)
+
+	assert.NoError(t, err, "should return rollback steps")
+	assert.Equal(t, []applyStep{{sql: "DROP ROLE app;\nCREATE ROLE app;", version: firstVersion}}, steps, "should restore the previous revision rendered with the current values")
+}
+
+func mustGetCurrentSHA(t *testing.T, d *definitionFile) string {
+	sha, err := d.getCurrentSHA()
+	if err != nil {
+		assert.FailNowf(t, "should get the current commit", "got error: %v", err)
+	}
+	return sha
+}
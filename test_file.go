@@ -0,0 +1,195 @@
+package pgit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const expectAnnotation = "-- expect"
+
+// testFile represents a file of SQL assertions that are checked against the
+// database after it has been migrated. Test files are never applied to the
+// database, they are run inside of a transaction that is always rolled back.
+type testFile struct {
+	path       string
+	assertions []testAssertion
+}
+
+// testAssertion is a single statement in a test file along with the result it
+// is expected to have. Statements without an expectation are setup statements
+// that only need to succeed.
+type testAssertion struct {
+	line     int
+	sql      string
+	kind     string
+	expected string
+}
+
+// statementResult is the observed outcome of executing a statement from a test
+// file. value is the first column of the first row returned, if any.
+type statementResult struct {
+	rows  int
+	value *string
+	err   error
+}
+
+// TestResult is the outcome of a single assertion from a test file
+type TestResult struct {
+	Path    string
+	Line    int
+	Passed  bool
+	Message string
+}
+
+func (f *testFile) getPath() string {
+	return f.path
+}
+
+// getApplySQL returns no SQL because test files are never applied
+func (f *testFile) getApplySQL(currentVersion string) (string, string, error) {
+	return "", currentVersion, nil
+}
+
+// getRollbackSQL returns no SQL because test files are never applied
+func (f *testFile) getRollbackSQL(currentVersion string) (string, string, error) {
+	return "", currentVersion, nil
+}
+
+// parse reads the statements and expectations from the file. Expectations are
+// written as "-- expect rows=N", "-- expect value=V", "-- expect error" or
+// "-- expect error=text" on the line before the statement they apply to.
+func (f *testFile) parse(fileContent []byte) error {
+	content := string(fileContent)
+
+	statements, err := splitStatements(content)
+
+	if err != nil {
+		return inFile(err, f.path)
+	}
+
+	quoted, err := quotedLines(content)
+
+	if err != nil {
+		return inFile(err, f.path)
+	}
+
+	f.assertions = make([]testAssertion, len(statements))
+	for i, s := range statements {
+		f.assertions[i] = testAssertion{line: s.line, sql: s.sql}
+	}
+
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if quoted[i+1] || (line != expectAnnotation && !strings.HasPrefix(line, expectAnnotation+" ")) {
+			continue
+		}
+
+		kind, expected, err := f.parseExpectation(line, i+1)
+
+		if err != nil {
+			return err
+		}
+
+		next := -1
+		for j, s := range statements {
+			if s.line > i+1 {
+				next = j
+				break
+			}
+		}
+
+		if next == -1 {
+			return &ParseError{Path: f.path, Line: i + 1, Column: 1, Message: "expectation is not followed by a statement"}
+		}
+
+		if f.assertions[next].kind != "" {
+			return &ParseError{
+				Path:    f.path,
+				Line:    i + 1,
+				Column:  1,
+				Message: "statement already has an expectation",
+				Hint:    "each statement may only have one expectation",
+			}
+		}
+
+		f.assertions[next].kind = kind
+		f.assertions[next].expected = expected
+	}
+
+	return nil
+}
+
+func (f *testFile) parseExpectation(line string, lineNumber int) (string, string, error) {
+	option := strings.TrimSpace(strings.TrimPrefix(line, expectAnnotation))
+	kind, expected := option, ""
+
+	if i := strings.Index(option, "="); i != -1 {
+		kind, expected = option[:i], option[i+1:]
+	}
+
+	switch kind {
+	case "rows":
+		if _, err := strconv.ParseUint(expected, 10, 64); err != nil {
+			return "", "", &ParseError{
+				Path:    f.path,
+				Line:    lineNumber,
+				Column:  len(expectAnnotation) + 2,
+				Message: fmt.Sprintf("invalid row count %q", expected),
+			}
+		}
+	case "value", "error":
+	default:
+		return "", "", &ParseError{
+			Path:    f.path,
+			Line:    lineNumber,
+			Column:  len(expectAnnotation) + 2,
+			Message: fmt.Sprintf("unknown expectation %q", option),
+			Hint:    "expected one of rows=N, value=V, error or error=text",
+		}
+	}
+
+	return kind, expected, nil
+}
+
+// check compares the result of executing the assertion's statement with its
+// expectation
+func (a *testAssertion) check(path string, result statementResult) TestResult {
+	r := TestResult{Path: path, Line: a.line, Passed: true}
+
+	fail := func(format string, args ...interface{}) TestResult {
+		r.Passed = false
+		r.Message = fmt.Sprintf(format, args...)
+		return r
+	}
+
+	if a.kind == "error" {
+		if result.err == nil {
+			return fail("expected an error but the statement succeeded")
+		}
+		if a.expected != "" && !strings.Contains(result.err.Error(), a.expected) {
+			return fail("expected an error containing %q, got: %v", a.expected, result.err)
+		}
+		return r
+	}
+
+	if result.err != nil {
+		return fail("statement failed: %v", result.err)
+	}
+
+	switch a.kind {
+	case "rows":
+		if strconv.Itoa(result.rows) != a.expected {
+			return fail("expected %v rows, got %v", a.expected, result.rows)
+		}
+	case "value":
+		if result.value == nil {
+			return fail("expected value %q, got no rows", a.expected)
+		}
+		if *result.value != a.expected {
+			return fail("expected value %q, got %q", a.expected, *result.value)
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,76 @@
+package pgit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestFileParse(t *testing.T) {
+	f := testFile{path: "tests/users.sql"}
+
+	err := f.parse([]byte(`
+INSERT INTO users (email) VALUES ('a@example.com');
+
+-- expect rows=0
+SELECT * FROM users WHERE email IS NULL;
+
+-- expect value=t
+SELECT has_table_privilege('reader', 'users', 'SELECT');
+
+-- expect error=duplicate key
+INSERT INTO users (email) VALUES ('a@example.com');
+`))
+
+	assert.NoError(t, err, "should parse test file")
+	assert.Equal(t, []testAssertion{
+		{line: 2, sql: "INSERT INTO users (email) VALUES ('a@example.com')"},
+		{line: 5, sql: "SELECT * FROM users WHERE email IS NULL", kind: "rows", expected: "0"},
+		{line: 8, sql: "SELECT has_table_privilege('reader', 'users', 'SELECT')", kind: "value", expected: "t"},
+		{line: 11, sql: "INSERT INTO users (email) VALUES ('a@example.com')", kind: "error", expected: "duplicate key"},
+	}, f.assertions, "should attach expectations to the following statement")
+
+	err = f.parse([]byte("\n-- expect rows=many\nSELECT 1;\n"))
+	assert.EqualError(t, err, `tests/users.sql:2:11: invalid row count "many"`)
+
+	err = f.parse([]byte("\n-- expect columns=2\nSELECT 1;\n"))
+	assert.EqualError(t, err, `tests/users.sql:2:11: unknown expectation "columns=2" (hint: expected one of rows=N, value=V, error or error=text)`)
+
+	err = f.parse([]byte("\nSELECT 1;\n-- expect rows=1\n"))
+	assert.EqualError(t, err, "tests/users.sql:3:1: expectation is not followed by a statement")
+}
+
+func TestTestAssertionCheck(t *testing.T) {
+	value := "f"
+
+	rows := testAssertion{line: 4, kind: "rows", expected: "0"}
+	assert.Equal(t, TestResult{Path: "a.sql", Line: 4, Passed: true}, rows.check("a.sql", statementResult{}))
+	assert.Equal(
+		t,
+		TestResult{Path: "a.sql", Line: 4, Message: "expected 0 rows, got 2"},
+		rows.check("a.sql", statementResult{rows: 2}),
+	)
+
+	values := testAssertion{line: 7, kind: "value", expected: "t"}
+	assert.Equal(
+		t,
+		TestResult{Path: "a.sql", Line: 7, Message: `expected value "t", got "f"`},
+		values.check("a.sql", statementResult{rows: 1, value: &value}),
+	)
+
+	errs := testAssertion{line: 9, kind: "error", expected: "duplicate key"}
+	assert.True(t, errs.check("a.sql", statementResult{err: errors.New("pq: duplicate key value")}).Passed)
+	assert.Equal(
+		t,
+		TestResult{Path: "a.sql", Line: 9, Message: "expected an error but the statement succeeded"},
+		errs.check("a.sql", statementResult{}),
+	)
+
+	setup := testAssertion{line: 1}
+	assert.Equal(
+		t,
+		TestResult{Path: "a.sql", Line: 1, Message: "statement failed: relation does not exist"},
+		setup.check("a.sql", statementResult{err: errors.New("relation does not exist")}),
+	)
+}
@@ -0,0 +1,4 @@
+-- pgit type=changeset
+
+-- change
+CREATE TABLE broken (col_a text);
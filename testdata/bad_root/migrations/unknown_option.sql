@@ -0,0 +1 @@
+-- pgit type=seed repeat=always
@@ -0,0 +1,3 @@
+-- pgit type=hook phase=sometimes
+
+ANALYZE;
@@ -0,0 +1,19 @@
+-- change
+CREATE TABLE users (
+    email text
+);
+
+-- rollback
+DROP TABLE users;
+
+-- change env=dev,staging
+INSERT INTO users (email) VALUES ('sample@example.com');
+
+-- rollback
+DELETE FROM users WHERE email = 'sample@example.com';
+
+-- change env=!prod
+CREATE FUNCTION debug_users() RETURNS bigint AS 'SELECT count(*) FROM users' LANGUAGE SQL;
+
+-- rollback
+DROP FUNCTION debug_users();
@@ -0,0 +1,19 @@
+-- change
+CREATE TABLE awesome_table (
+    col_a text
+);
+
+-- rollback
+DROP TABLE awesome_table;
+
+-- change id=add_email_column
+ALTER TABLE awesome_table ADD COLUMN email text;
+
+-- rollback
+ALTER TABLE awesome_table DROP COLUMN email;
+
+-- change id=add_name_column
+ALTER TABLE awesome_table ADD COLUMN name text;
+
+-- rollback
+ALTER TABLE awesome_table DROP COLUMN name;
@@ -0,0 +1,25 @@
+-- change id=create_table
+CREATE TABLE awesome_table (
+    col_a text
+);
+
+-- rollback
+DROP TABLE awesome_table;
+
+-- change id=index_col_a notransaction
+CREATE INDEX CONCURRENTLY awesome_table_col_a ON awesome_table (col_a);
+
+-- rollback
+DROP INDEX CONCURRENTLY awesome_table_col_a;
+
+-- change id=refresh_grants runAlways
+GRANT SELECT ON awesome_table TO reader;
+
+-- rollback
+REVOKE SELECT ON awesome_table FROM reader;
+
+-- change id=comment runOnChange
+COMMENT ON TABLE awesome_table IS 'awesome';
+
+-- rollback
+COMMENT ON TABLE awesome_table IS NULL;
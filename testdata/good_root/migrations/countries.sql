@@ -0,0 +1,3 @@
+-- pgit type=seed env=dev
+
+INSERT INTO countries (code) VALUES ('US') ON CONFLICT (code) DO NOTHING;
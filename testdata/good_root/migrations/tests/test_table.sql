@@ -0,0 +1,4 @@
+-- pgit type=test
+
+-- expect rows=0
+SELECT * FROM test_table WHERE col_a IS NULL;
@@ -0,0 +1,284 @@
+package pgit
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Outcomes of verifying that a change rolls back cleanly
+const (
+	VerifyPassed  = "passed"
+	VerifyFailed  = "failed"
+	VerifySkipped = "skipped"
+)
+
+// RollbackVerification is the outcome of applying a single change, or a single
+// revision of a definition file, rolling it back and comparing the database
+// catalog with its state before the change was applied
+type RollbackVerification struct {
+	Path string
+	// Change is the key of the changeset, and empty for other types of files
+	Change      string
+	FromVersion string
+	ToVersion   string
+	Result      string
+
+	// Missing are the objects that existed before the change was applied and
+	// not after it was rolled back, and Extra the objects left behind by the
+	// rollback
+	Missing []string
+	Extra   []string
+
+	// Message explains a skipped or failed verification
+	Message string
+}
+
+// revisionFile is implemented by definition files, which verifyRollbacks
+// applies one revision at a time
+type revisionFile interface {
+	revisionSteps(currentVersion string) ([]applyStep, error)
+}
+
+// verificationSteps returns the steps for a file with one step for every
+// change that can be rolled back on its own
+func verificationSteps(file schemaFile, currentVersion string) ([]applyStep, error) {
+	switch f := file.(type) {
+	case *changesetFile:
+		return f.getChangeSteps(currentVersion)
+	case revisionFile:
+		if _, ok := file.(*extensionFile); !ok {
+			return f.revisionSteps(currentVersion)
+		}
+	}
+	return getApplySteps(file, currentVersion)
+}
+
+// verifyRollbacks applies every pending change to the database one at a time.
+// Each change is rolled back, the catalog compared with its state before the
+// change and the change applied again, so that the database ends up at the
+// latest version of the schema. Hooks are not run and destructive changes are
+// not refused, so db must be a scratch database.
+func (s *schemaDirectory) verifyRollbacks(db DatabaseConnection) ([]RollbackVerification, error) {
+	if err := s.readFromDisk(); err != nil {
+		return nil, errors.Wrap(err, "failed to populate schema from disk")
+	}
+
+	if err := s.readMigrationState(db); err != nil {
+		return nil, errors.Wrap(err, "failed to read migration state")
+	}
+
+	s.useDatabase(db)
+
+	results := make([]RollbackVerification, 0)
+
+	var migration *migration
+
+	for _, filePath := range s.sortedPaths() {
+		file := s.files[filePath]
+		fileState, ok := s.state.fileStates[filePath]
+
+		if !ok {
+			s.state.fileStates[filePath] = &fileMigrationState{version: "", path: filePath}
+			fileState = s.state.fileStates[filePath]
+		}
+
+		seed, isSeed := file.(*seedFile)
+
+		if isSeed && !seed.enabled {
+			continue
+		}
+
+		steps, err := verificationSteps(file, fileState.version)
+
+		if err != nil {
+			results = append(results, RollbackVerification{
+				Path:        filePath,
+				FromVersion: fileState.version,
+				Result:      VerifyFailed,
+				Message:     fmt.Sprintf("failed to get SQL for applying update: %v", err),
+			})
+			return results, nil
+		}
+
+		for _, step := range steps {
+			if migration == nil {
+				if migration, err = db.createNewMigration(); err != nil {
+					return results, err
+				}
+			}
+
+			result, ok := s.verifyStep(db, file, fileState, step, migration, !isSeed)
+
+			if result != nil {
+				results = append(results, *result)
+			}
+
+			if !ok {
+				return results, nil
+			}
+		}
+	}
+
+	if migration == nil {
+		return results, nil
+	}
+
+	return results, db.finishMigration(migration)
+}
+
+// verifyStep applies a step and, when verify is true, rolls it back and
+// applies it again. It returns the outcome of the verification, if there is
+// one, and false when the file could not be brought to the step's version.
+func (s *schemaDirectory) verifyStep(db DatabaseConnection, file schemaFile, fileState *fileMigrationState, step applyStep, m *migration, verify bool) (*RollbackVerification, bool) {
+	fromVersion := fileState.version
+	result := &RollbackVerification{Path: fileState.path, FromVersion: fromVersion, ToVersion: step.version, Result: VerifyFailed}
+
+	if c, ok := file.(*changesetFile); ok {
+		if applied, err := c.applied(step.version); err == nil && len(applied) > 0 {
+			result.Change = entryKey(applied[len(applied)-1])
+		}
+	}
+
+	apply := func() error {
+		if step.noTransaction {
+			return db.applyWithoutTransaction(fileState, step.sql, step.version, m)
+		}
+		return db.applyAndUpdateStateForFile(fileState, step.sql, step.version, m)
+	}
+
+	verify = verify && step.sql != "" && step.version != fromVersion
+
+	var before []string
+	var err error
+
+	if verify {
+		if before, err = db.snapshotCatalog(); err != nil {
+			result.Message = err.Error()
+			return result, false
+		}
+	}
+
+	if err = apply(); err != nil {
+		result.Message = fmt.Sprintf("unable to apply update for file: %v", err)
+		return result, false
+	}
+
+	fileState.version = step.version
+
+	if !verify {
+		return nil, true
+	}
+
+	rollbackSteps, previousVersion, err := s.verifyRollbackSteps(file, step, fromVersion)
+
+	if err != nil {
+		result.Message = fmt.Sprintf("failed to get SQL for rolling back update: %v", err)
+		return result, false
+	}
+
+	if !sameVersion(previousVersion, fromVersion) {
+		result.Result = VerifySkipped
+		result.Message = fmt.Sprintf("rolling back returns the file to version %v rather than %v", previousVersion, fromVersion)
+		return result, true
+	}
+
+	for _, r := range rollbackSteps {
+		rollback := db.rollbackFile
+		if r.noTransaction {
+			rollback = db.applyWithoutTransaction
+		}
+
+		if err = rollback(fileState, r.sql, r.version, m); err != nil {
+			result.Message = fmt.Sprintf("unable to rollback file: %v", err)
+			return result, false
+		}
+
+		fileState.version = r.version
+	}
+
+	after, err := db.snapshotCatalog()
+
+	if err != nil {
+		result.Message = err.Error()
+		return result, false
+	}
+
+	result.Missing, result.Extra = diffCatalogs(before, after)
+
+	if len(result.Missing) == 0 && len(result.Extra) == 0 {
+		result.Result = VerifyPassed
+	} else {
+		result.Message = "rolling back did not restore the database"
+	}
+
+	if err = apply(); err != nil {
+		result.Result = VerifyFailed
+		result.Message = fmt.Sprintf("unable to apply update for file again after rolling it back: %v", err)
+		return result, false
+	}
+
+	fileState.version = step.version
+
+	return result, true
+}
+
+// verifyRollbackSteps returns the steps that roll a file back from the
+// version of step towards fromVersion, and the version they return it to
+func (s *schemaDirectory) verifyRollbackSteps(file schemaFile, step applyStep, fromVersion string) ([]applyStep, string, error) {
+	if f, ok := file.(rollbackStepFile); ok {
+		steps, err := f.getRollbackSteps(step.version, fromVersion)
+		return steps, fromVersion, err
+	}
+
+	rollbackSQL, previousVersion, err := file.getRollbackSQL(step.version)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return []applyStep{{sql: rollbackSQL, version: fromVersion, noTransaction: step.noTransaction}}, previousVersion, nil
+}
+
+// sameVersion reports whether two versions of a file are the same, treating a
+// changeset with nothing applied as a file that was never applied and
+// ignoring the hash of the rendered SQL of a template
+func sameVersion(a, b string) bool {
+	normalize := func(version string) string {
+		if version == "0" {
+			return ""
+		}
+		return versionCommit(version)
+	}
+	return normalize(a) == normalize(b)
+}
+
+// diffCatalogs returns the objects of before that are missing from after and
+// the objects of after that were not in before
+func diffCatalogs(before, after []string) ([]string, []string) {
+	count := make(map[string]int)
+	for _, object := range before {
+		count[object]++
+	}
+	for _, object := range after {
+		count[object]--
+	}
+
+	missing, extra := make([]string, 0), make([]string, 0)
+
+	for _, object := range before {
+		if count[object] > 0 {
+			missing = append(missing, object)
+			count[object]--
+		}
+	}
+
+	for _, object := range after {
+		if count[object] < 0 {
+			extra = append(extra, object)
+			count[object]++
+		}
+	}
+
+	return missing, extra
+}
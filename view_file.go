@@ -0,0 +1,187 @@
+package pgit
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// viewFile represents a file containing only the CREATE VIEW statement for a
+// single view. pgit generates the SQL to drop and recreate the view, along
+// with any views that depend on it, and uses the git history of the file to
+// roll back to the previous definition.
+type viewFile struct {
+	definitionFile
+}
+
+func newViewFile(path, gitRoot string, content []byte) *viewFile {
+	v := &viewFile{definitionFile: definitionFile{path: path, gitRoot: gitRoot, content: content}}
+	v.scripts = v
+	return v
+}
+
+var createViewRegexp = regexp.MustCompile(
+	`(?is)^CREATE\s+(?:OR\s+REPLACE\s+)?(?:TEMP\s+|TEMPORARY\s+)?(?:RECURSIVE\s+)?VIEW\s+` +
+		`((?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)(?:\.(?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*))?)`,
+)
+
+// parse returns the name of the view and the statement that creates it
+func (v *viewFile) parse(fileContent []byte) (string, string, error) {
+	statements, err := splitStatements(string(fileContent))
+
+	if err != nil {
+		return "", "", inFile(err, v.path)
+	}
+
+	if len(statements) != 1 {
+		line := 1
+		if len(statements) > 1 {
+			line = statements[1].line
+		}
+		return "", "", &ParseError{
+			Path:    v.path,
+			Line:    line,
+			Column:  1,
+			Message: fmt.Sprintf("expected a single CREATE VIEW statement, found %v statements", len(statements)),
+			Hint:    "pgit generates the DROP VIEW statements for view files",
+		}
+	}
+
+	tokens := createViewRegexp.FindStringSubmatch(statements[0].sql)
+
+	if len(tokens) != 2 {
+		return "", "", &ParseError{
+			Path:    v.path,
+			Line:    statements[0].line,
+			Column:  statements[0].column,
+			Message: "expected a CREATE VIEW statement",
+		}
+	}
+
+	return tokens[1], statements[0].sql, nil
+}
+
+// transitionSQL returns the SQL to replace the view defined by from with the
+// view defined by to
+func (v *viewFile) transitionSQL(from, to []byte) (string, error) {
+	blocks := make([]string, 0)
+	previousName := ""
+
+	if len(from) > 0 {
+		name, _, err := v.parse(from)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to parse previous version of view")
+		}
+		previousName = name
+	}
+
+	if len(to) == 0 {
+		if previousName == "" {
+			return "", nil
+		}
+		return fmt.Sprintf("DROP VIEW IF EXISTS %v;", previousName), nil
+	}
+
+	name, create, err := v.parse(to)
+
+	if err != nil {
+		return "", errors.Wrap(err, "unable to parse view")
+	}
+
+	if previousName != "" && previousName != name {
+		blocks = append(blocks, fmt.Sprintf("DROP VIEW IF EXISTS %v;", previousName))
+	}
+
+	blocks = append(blocks, recreateViewSQL(name, create))
+
+	return joinStatements(blocks...)
+}
+
+// recreateViewSQL returns SQL that saves the definitions of all views that
+// depend on the named view (found through pg_depend), drops them in reverse
+// dependency order, replaces the view and then recreates the dependent views
+// in dependency order. The owner, options, comments, grants, indexes and
+// triggers of the dependent views are saved as statements that restore them
+// once they are recreated.
+func recreateViewSQL(name, create string) string {
+	return strings.Join([]string{
+		`CREATE TEMP TABLE pgit_dependent_views AS
+WITH RECURSIVE dependents(oid, depth) AS (
+    SELECT r.ev_class, 1
+    FROM pg_depend d
+    JOIN pg_rewrite r ON r.oid = d.objid
+    WHERE d.classid = 'pg_rewrite'::regclass
+      AND d.refclassid = 'pg_class'::regclass
+      AND d.refobjid = to_regclass('` + strings.Replace(name, "'", "''", -1) + `')
+      AND r.ev_class <> d.refobjid
+    UNION ALL
+    SELECT r.ev_class, dependents.depth + 1
+    FROM dependents
+    JOIN pg_depend d ON d.refobjid = dependents.oid
+      AND d.classid = 'pg_rewrite'::regclass
+      AND d.refclassid = 'pg_class'::regclass
+    JOIN pg_rewrite r ON r.oid = d.objid
+    WHERE r.ev_class <> d.refobjid
+)
+SELECT c.oid::regclass::text AS name, k.kind, pg_get_viewdef(c.oid) AS definition, max(dependents.depth) AS depth,
+    ARRAY(
+        SELECT statement FROM (
+            SELECT 1, format('ALTER %s %s OWNER TO %I', k.kind, c.oid::regclass, pg_get_userbyid(c.relowner))
+            UNION ALL
+            SELECT 2, format('ALTER %s %s SET (%s)', k.kind, c.oid::regclass, array_to_string(c.reloptions, ', '))
+            WHERE c.reloptions IS NOT NULL
+            UNION ALL
+            SELECT 3, CASE WHEN d.objsubid = 0
+                THEN format('COMMENT ON %s %s IS %L', k.kind, c.oid::regclass, d.description)
+                ELSE format('COMMENT ON COLUMN %s.%I IS %L', c.oid::regclass, a.attname, d.description) END
+            FROM pg_description d
+            LEFT JOIN pg_attribute a ON a.attrelid = d.objoid AND a.attnum = d.objsubid
+            WHERE d.objoid = c.oid AND d.classoid = 'pg_class'::regclass
+            UNION ALL
+            SELECT 4, format(
+                'GRANT %s ON %s TO %s%s', g.privilege_type, c.oid::regclass,
+                CASE WHEN g.grantee = 0 THEN 'PUBLIC' ELSE quote_ident(pg_get_userbyid(g.grantee)) END,
+                CASE WHEN g.is_grantable THEN ' WITH GRANT OPTION' ELSE '' END
+            )
+            FROM aclexplode(c.relacl) g
+            WHERE g.grantee <> c.relowner
+            UNION ALL
+            SELECT 5, pg_get_indexdef(i.indexrelid) FROM pg_index i WHERE i.indrelid = c.oid
+            UNION ALL
+            SELECT 6, pg_get_triggerdef(t.oid) FROM pg_trigger t WHERE t.tgrelid = c.oid AND NOT t.tgisinternal
+        ) AS s (step, statement)
+        ORDER BY step
+    ) AS restore
+FROM dependents
+JOIN pg_class c ON c.oid = dependents.oid
+CROSS JOIN LATERAL (SELECT CASE WHEN c.relkind = 'm' THEN 'MATERIALIZED VIEW' ELSE 'VIEW' END AS kind) k
+GROUP BY c.oid, k.kind;`,
+		`DO $pgit$
+DECLARE
+    v record;
+BEGIN
+    FOR v IN SELECT * FROM pgit_dependent_views ORDER BY depth DESC LOOP
+        EXECUTE format('DROP %s %s', v.kind, v.name);
+    END LOOP;
+END
+$pgit$;`,
+		fmt.Sprintf("DROP VIEW IF EXISTS %v;", name),
+		create + ";",
+		`DO $pgit$
+DECLARE
+    v record;
+    restore_statement text;
+BEGIN
+    FOR v IN SELECT * FROM pgit_dependent_views ORDER BY depth LOOP
+        EXECUTE format('CREATE %s %s AS %s', v.kind, v.name, v.definition);
+        FOREACH restore_statement IN ARRAY v.restore LOOP
+            EXECUTE restore_statement;
+        END LOOP;
+    END LOOP;
+END
+$pgit$;`,
+		"DROP TABLE pgit_dependent_views;",
+	}, "\n")
+}
@@ -0,0 +1,65 @@
+package pgit
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViewFileParse(t *testing.T) {
+	v := newViewFile("views/active_users.sql", "", nil)
+
+	name, create, err := v.parse([]byte("-- pgit type=view\n\nCREATE OR REPLACE VIEW app.\"Active Users\" AS\n    SELECT * FROM users WHERE active;\n"))
+
+	assert.NoError(t, err, "should parse view")
+	assert.Equal(t, `app."Active Users"`, name, "should read the qualified view name")
+	assert.Equal(t, "CREATE OR REPLACE VIEW app.\"Active Users\" AS\n    SELECT * FROM users WHERE active", create, "should return the create statement")
+
+	_, _, err = v.parse([]byte("\nCREATE VIEW a AS SELECT 1;\nDROP VIEW b;\n"))
+	assert.EqualError(
+		t,
+		err,
+		"views/active_users.sql:3:1: expected a single CREATE VIEW statement, found 2 statements (hint: pgit generates the DROP VIEW statements for view files)",
+	)
+
+	_, _, err = v.parse([]byte("\nCREATE TABLE a (col text);\n"))
+	assert.EqualError(t, err, "views/active_users.sql:2:1: expected a CREATE VIEW statement")
+}
+
+func TestViewFileTransitionSQL(t *testing.T) {
+	v := newViewFile("views/active_users.sql", "", nil)
+
+	t.Run("create view", func(t *testing.T) {
+		sql, err := v.transitionSQL(nil, []byte("\nCREATE VIEW active_users AS SELECT * FROM users WHERE active;\n"))
+
+		assert.NoError(t, err, "should generate SQL")
+
+		statements, err := splitStatements(sql)
+		assert.NoError(t, err, "should generate valid SQL")
+		assert.Equal(t, 6, len(statements), "should save, drop and recreate dependent views")
+		assert.Contains(t, statements[0].sql, "to_regclass('active_users')", "should find views depending on the view")
+		assert.Equal(t, "DROP VIEW IF EXISTS active_users", statements[2].sql, "should drop the view")
+		assert.Equal(t, "CREATE VIEW active_users AS SELECT * FROM users WHERE active", statements[3].sql, "should create the view")
+		assert.True(t, strings.HasPrefix(statements[4].sql, "DO $pgit$"), "should recreate dependent views")
+		assert.Contains(t, statements[0].sql, "aclexplode(c.relacl)", "should save the grants of dependent views")
+		assert.Contains(t, statements[4].sql, "FOREACH restore_statement IN ARRAY v.restore", "should restore the grants, comments, options and indexes of dependent views")
+	})
+
+	t.Run("rename view", func(t *testing.T) {
+		sql, err := v.transitionSQL(
+			[]byte("\nCREATE VIEW active_users AS SELECT * FROM users WHERE active;\n"),
+			[]byte("\nCREATE VIEW current_users AS SELECT * FROM users WHERE active;\n"),
+		)
+
+		assert.NoError(t, err, "should generate SQL")
+		assert.True(t, strings.HasPrefix(sql, "DROP VIEW IF EXISTS active_users;\n"), "should drop the previous view")
+	})
+
+	t.Run("drop view", func(t *testing.T) {
+		sql, err := v.transitionSQL([]byte("\nCREATE VIEW active_users AS SELECT 1;\n"), nil)
+
+		assert.NoError(t, err, "should generate SQL")
+		assert.Equal(t, "DROP VIEW IF EXISTS active_users;", sql, "should drop the view when there is no previous revision")
+	})
+}